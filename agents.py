@@ -1,11 +1,30 @@
-from typing import Any
+from typing import Any, Awaitable, Callable
 import re
 import json
 import logging
 from pydantic import BaseModel
 
+from bedrock import (
+    BedrockInvoker,
+    DEFAULT_MAX_TOKENS,
+    DEFAULT_MODEL_ID,
+    DEFAULT_TEMPERATURE,
+    DEFAULT_TIMEOUT_SECONDS,
+    TokenUsage,
+    invoke_model_with_retry,
+    log_token_usage,
+    parse_completion,
+)
+
 logger = logging.getLogger("negotiation.agents")
 
+# Checks a generated reply before it's stored or emailed. Returns
+# {"status": "pass" | "flagged", "reasons": [...], "method": ...}.
+Moderator = Callable[[str], Awaitable[dict[str, Any]]]
+
+# Stands in for a reply moderation flagged; the original is neither stored nor sent
+WITHHELD_REPLY = "[withheld by content moderation]"
+
 
 def strip_reasoning_tokens(text: str) -> str:
     """
@@ -44,7 +63,8 @@ class NegotiationAgent:
     def __init__(
         self,
         db_pool: Any,
-        client: Any,
+        # None only for dry runs, which build prompts without calling Bedrock
+        client: BedrockInvoker | None,
         sys_prompt: str,
         ng_id: str,
         sup_id: str,
@@ -53,17 +73,50 @@ class NegotiationAgent:
         supplier_email: str | None = None,
         supplier_name: str = "Supplier",
         supplier_insights: str = "",
+        model_id: str = DEFAULT_MODEL_ID,
+        max_tokens: int = DEFAULT_MAX_TOKENS,
+        temperature: float = DEFAULT_TEMPERATURE,
+        timeout: float = DEFAULT_TIMEOUT_SECONDS,
+        history: list[dict[str, str]] | None = None,
+        # Current unit price with currency, e.g. "12.50 EUR", if the product has one
+        product_price: str | None = None,
+        moderator: Moderator | None = None,
     ) -> None:
         self.client = client
         self.db_pool = db_pool
         self.sys_prompt = sys_prompt
         self.product = product
+        self.product_price = product_price
         self.ng_id = ng_id
         self.sup_id = sup_id
         self.email_client = email_client
         self.supplier_email = supplier_email
         self.supplier_name = supplier_name
         self.supplier_insights = supplier_insights
+        self.model_id = model_id
+        self.max_tokens = max_tokens
+        self.temperature = temperature
+        self.timeout = timeout
+        # Cumulative token usage across every Bedrock call this agent makes
+        self.usage = TokenUsage()
+        # Prior user/assistant turns supplied by the caller for the opening call
+        self.history = history or []
+        self.moderator = moderator
+        # Outcome of moderating the latest reply; None until one is checked
+        self.moderation: dict[str, Any] | None = None
+
+    async def _passes_moderation(self, reply: str) -> bool:
+        """Run the moderator, if any, on a reply; False means withhold it."""
+        if self.moderator is None:
+            return True
+        self.moderation = await self.moderator(reply)
+        if self.moderation["status"] == "pass":
+            return True
+        logger.warning(
+            f"[Agent {self.ng_id}:{self.sup_id}] Reply withheld by moderation: "
+            f"{', '.join(self.moderation['reasons']) or 'no reason given'}"
+        )
+        return False
 
     def _map_role(self, db_role: str) -> str:
         """Map database roles to API-compatible roles."""
@@ -102,18 +155,12 @@ class NegotiationAgent:
             )
         return conversation
 
-    async def send_initial_message(self, context: str = "") -> str:
-        """
-        Send the first message to initiate negotiation with the supplier.
-        This asks about possible offers for the product.
-        """
-        logger.info(
-            f"[Agent {self.ng_id}:{self.sup_id}] Preparing initial message for product: {self.product}"
-        )
-
+    def build_initial_messages(self, context: str = "") -> list[dict[str, str]]:
+        """Conversation sent to Bedrock to open the negotiation."""
         conversation: list[dict[str, str]] = []
         if self.sys_prompt:
             conversation.append({"role": "system", "content": self.sys_prompt})
+        conversation.extend(self.history)
 
         # Build insights section if available
         insights_section = ""
@@ -123,13 +170,20 @@ Background information about this supplier:
 {self.supplier_insights}
 
 Use this information strategically in your negotiation approach.
+"""
+
+        price_section = ""
+        if self.product_price:
+            price_section = f"""
+We currently pay {self.product_price} per unit for this product. Use it as the anchor:
+aim for offers below it and treat any quote above it as a starting point to negotiate down.
 """
 
         # Add context about what we're negotiating
         initial_prompt = f"""You are initiating a negotiation with {self.supplier_name} for: {self.product}
 
 {f"Additional context: {context}" if context else ""}
-{insights_section}
+{price_section}{insights_section}
 Write a professional opening message addressed to {self.supplier_name} asking about:
 - Their available offerings for this product
 - Current pricing and volume discounts
@@ -140,30 +194,48 @@ Be polite, professional, and express genuine interest in establishing a business
 Address the supplier by name ({self.supplier_name}) in your message."""
 
         conversation.append({"role": "user", "content": initial_prompt})
+        return conversation
+
+    async def send_initial_message(self, context: str = "") -> str:
+        """
+        Send the first message to initiate negotiation with the supplier.
+        This asks about possible offers for the product.
+        """
+        logger.info(
+            f"[Agent {self.ng_id}:{self.sup_id}] Preparing initial message for product: {self.product}"
+        )
+
+        conversation = self.build_initial_messages(context)
 
         body = {
             "messages": conversation,
-            "max_tokens": 1024,
-            "temperature": 0.7,
+            "max_tokens": self.max_tokens,
+            "temperature": self.temperature,
         }
 
         logger.info(f"[Agent {self.ng_id}:{self.sup_id}] Calling Bedrock model...")
         try:
-            response = self.client.invoke_model(
-                modelId="openai.gpt-oss-120b-1:0",
+            response = await invoke_model_with_retry(
+                self.client,
+                timeout=self.timeout,
+                modelId=self.model_id,
                 contentType="application/json",
                 accept="application/json",
                 body=json.dumps(body),
             )
         except Exception as e:
+            # Raised so the caller reports it per supplier instead of sending it
             logger.error(f"[Agent {self.ng_id}:{self.sup_id}] Bedrock call failed: {e}")
-            return f"Bedrock service is currently unavailable. {e}"
+            raise
 
-        result = json.loads(response["body"].read())
-        reply = result["choices"][0]["message"]["content"]
+        reply, usage = parse_completion(response["body"].read())
+        log_token_usage(usage, self.model_id)
+        self.usage += usage
         logger.info(
             f"[Agent {self.ng_id}:{self.sup_id}] Bedrock response received ({len(reply)} chars)"
         )
+        if not await self._passes_moderation(reply):
+            return WITHHELD_REPLY
 
         # Save the initial message to DB
         logger.info(f"[Agent {self.ng_id}:{self.sup_id}] Saving message to database...")
@@ -211,14 +283,16 @@ Address the supplier by name ({self.supplier_name}) in your message."""
 
         body = {
             "messages": conversation,
-            "max_tokens": 1024,
-            "temperature": 0.7,
+            "max_tokens": self.max_tokens,
+            "temperature": self.temperature,
         }
 
         logger.info(f"[Agent {self.ng_id}:{self.sup_id}] Calling Bedrock model...")
         try:
-            response = self.client.invoke_model(
-                modelId="openai.gpt-oss-120b-1:0",
+            response = await invoke_model_with_retry(
+                self.client,
+                timeout=self.timeout,
+                modelId=self.model_id,
                 contentType="application/json",
                 accept="application/json",
                 body=json.dumps(body),
@@ -227,13 +301,16 @@ Address the supplier by name ({self.supplier_name}) in your message."""
             logger.error(f"[Agent {self.ng_id}:{self.sup_id}] Bedrock call failed: {e}")
             return f"Bedrock service is currently unavailable. {e}"
 
-        result = json.loads(response["body"].read())
-        reply = result["choices"][0]["message"]["content"]
+        reply, usage = parse_completion(response["body"].read())
+        log_token_usage(usage, self.model_id)
+        self.usage += usage
         # Strip reasoning tokens before saving and sending
         reply = strip_reasoning_tokens(reply)
         logger.info(
             f"[Agent {self.ng_id}:{self.sup_id}] Bedrock response received ({len(reply)} chars)"
         )
+        if not await self._passes_moderation(reply):
+            return WITHHELD_REPLY
 
         Message(role="assistant", content=reply)
 
@@ -278,7 +355,9 @@ class OrchestratorAgent:
         strategy: str,
         product: str,
         ng_id: str,
-        client: Any,
+        client: BedrockInvoker,
+        model_id: str = DEFAULT_MODEL_ID,
+        timeout: float = DEFAULT_TIMEOUT_SECONDS,
     ) -> None:
         self.db_pool = db_pool
         self.sys_prompt = sys_promt
@@ -286,6 +365,8 @@ class OrchestratorAgent:
         self.product = product
         self.client = client
         self.ng_id = ng_id
+        self.model_id = model_id
+        self.timeout = timeout
         return
 
     @staticmethod
@@ -374,14 +455,16 @@ Conversation history:
         }
 
         try:
-            response = self.client.invoke_model(
-                modelId="openai.gpt-oss-120b-1:0",
+            response = await invoke_model_with_retry(
+                self.client,
+                timeout=self.timeout,
+                modelId=self.model_id,
                 contentType="application/json",
                 accept="application/json",
                 body=json.dumps(body),
             )
-            result = json.loads(response["body"].read())
-            summary_text = result["choices"][0]["message"]["content"]
+            summary_text, usage = parse_completion(response["body"].read())
+            log_token_usage(usage, self.model_id)
             summary_text = strip_reasoning_tokens(summary_text)
             return summary_text.strip()
         except Exception as exc:  # pragma: no cover - best effort
@@ -551,8 +634,10 @@ RULES:
             "temperature": 0.7,
         }
         try:
-            response = self.client.invoke_model(
-                modelId="openai.gpt-oss-120b-1:0",
+            response = await invoke_model_with_retry(
+                self.client,
+                timeout=self.timeout,
+                modelId=self.model_id,
                 contentType="application/json",
                 accept="application/json",
                 body=json.dumps(body),
@@ -560,8 +645,8 @@ RULES:
         except Exception as e:
             raise RuntimeError(f"Bedrock service is currently unavailable: {e}")
 
-        result = json.loads(response["body"].read())
-        reply = result["choices"][0]["message"]["content"]
+        reply, usage = parse_completion(response["body"].read())
+        log_token_usage(usage, self.model_id)
 
         # 6. Parse the model response using regex for [INSTRUCTION] blocks
         pattern = re.compile(
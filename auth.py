@@ -0,0 +1,62 @@
+import hmac
+import logging
+
+from fastapi import HTTPException, Request
+
+logger = logging.getLogger("negotiation.auth")
+
+
+class APIKeyAuth:
+    """
+    FastAPI dependency checking `Authorization: Bearer <key>` or `X-API-Key`
+    against a set of allowed keys. Attach it app-wide or per route via
+    `Depends(...)`. With no keys configured, authentication is disabled.
+    Admin keys are a subset of `keys` allowed to use admin-only options.
+    """
+
+    def __init__(
+        self,
+        keys: set[str],
+        exempt_paths: set[str] | None = None,
+        admin_keys: set[str] | None = None,
+    ) -> None:
+        self.keys = keys
+        self.exempt_paths = exempt_paths or set()
+        self.admin_keys = admin_keys or set()
+        if not keys:
+            logger.warning("API_KEYS not set - API key authentication is disabled")
+
+    @staticmethod
+    def _extract_key(request: Request) -> str | None:
+        authorization = request.headers.get("Authorization", "")
+        scheme, _, credentials = authorization.partition(" ")
+        if scheme.lower() == "bearer" and credentials:
+            return credentials.strip()
+        return request.headers.get("X-API-Key")
+
+    def _is_valid(self, key: str) -> bool:
+        return any(hmac.compare_digest(key, allowed) for allowed in self.keys)
+
+    def is_admin(self, request: Request) -> bool:
+        """Whether the request carries an admin key; always true with auth disabled."""
+        if not self.keys:
+            return True
+        key = self._extract_key(request)
+        return bool(key) and any(
+            hmac.compare_digest(key, allowed) for allowed in self.admin_keys
+        )
+
+    async def __call__(self, request: Request) -> None:
+        if not self.keys or request.url.path in self.exempt_paths:
+            return
+        key = self._extract_key(request)
+        if not key or not self._is_valid(key):
+            raise HTTPException(
+                status_code=401,
+                detail="invalid or missing API key",
+                headers={"WWW-Authenticate": "Bearer"},
+            )
+
+
+def parse_api_keys(raw: str) -> set[str]:
+    return {key.strip() for key in raw.split(",") if key.strip()}
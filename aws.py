@@ -0,0 +1,62 @@
+from datetime import datetime
+from typing import Any
+import logging
+
+import boto3
+from botocore.credentials import RefreshableCredentials
+from botocore.session import get_session
+
+logger = logging.getLogger("negotiation.aws")
+
+ASSUME_ROLE_SESSION_NAME = "negotiation-api"
+ASSUME_ROLE_DURATION_SECONDS = 3600
+
+
+class AssumeRoleError(RuntimeError):
+    pass
+
+
+def aws_session(
+    region: str, profile: str | None = None, role_arn: str | None = None
+) -> boto3.Session:
+    """
+    Session for the given profile (or the default credential chain). With
+    role_arn, credentials come from STS AssumeRole using the base session and
+    are refreshed before they expire. The role is assumed once up front so a
+    misconfigured role fails at startup with AssumeRoleError.
+    """
+    base = boto3.Session(profile_name=profile, region_name=region)
+    if not role_arn:
+        return base
+
+    sts = base.client("sts")
+
+    def fetch_credentials() -> dict[str, Any]:
+        response = sts.assume_role(
+            RoleArn=role_arn,
+            RoleSessionName=ASSUME_ROLE_SESSION_NAME,
+            DurationSeconds=ASSUME_ROLE_DURATION_SECONDS,
+        )
+        credentials = response["Credentials"]
+        expiration: datetime = credentials["Expiration"]
+        return {
+            "access_key": credentials["AccessKeyId"],
+            "secret_key": credentials["SecretAccessKey"],
+            "token": credentials["SessionToken"],
+            "expiry_time": expiration.isoformat(),
+        }
+
+    try:
+        metadata = fetch_credentials()
+    except Exception as e:
+        raise AssumeRoleError(f"could not assume role {role_arn}: {e}") from e
+    logger.info(f"Assumed role {role_arn} for Bedrock calls")
+
+    botocore_session = get_session()
+    # botocore has no public setter for refreshable credentials
+    botocore_session._credentials = RefreshableCredentials.create_from_metadata(
+        metadata=metadata,
+        refresh_using=fetch_credentials,
+        method="sts-assume-role",
+    )
+    return boto3.Session(botocore_session=botocore_session, region_name=region)
@@ -0,0 +1,408 @@
+from dataclasses import asdict, dataclass
+from typing import Any, Callable, Protocol
+import asyncio
+import json
+import logging
+import random
+import time
+
+from botocore.exceptions import ConnectionError as BotoConnectionError
+from botocore.exceptions import HTTPClientError
+from opentelemetry import trace
+
+from metrics import BEDROCK_CALL_DURATION, BEDROCK_CALL_ERRORS
+
+logger = logging.getLogger("negotiation.bedrock")
+tracer = trace.get_tracer("negotiation.bedrock")
+
+DEFAULT_MODEL_ID = "openai.gpt-oss-120b-1:0"
+
+# Models callers may select per request. All of them accept the OpenAI-style
+# chat completion body we send, so they are interchangeable.
+ALLOWED_MODELS: dict[str, str] = {
+    DEFAULT_MODEL_ID: "GPT-OSS 120B",
+    "openai.gpt-oss-20b-1:0": "GPT-OSS 20B",
+}
+
+# Titan Text Embeddings V2; takes {"inputText": ...}, returns {"embedding": [...]}
+DEFAULT_EMBEDDING_MODEL_ID = "amazon.titan-embed-text-v2:0"
+
+DEFAULT_MAX_TOKENS = 1024
+MAX_TOKENS_LIMIT = 4096
+DEFAULT_TEMPERATURE = 0.7
+
+
+class BedrockInvoker(Protocol):
+    """
+    The part of the bedrock-runtime client this service calls. boto3's client
+    satisfies it as is; tests substitute fakes that return canned completions.
+    """
+
+    def invoke_model(self, **kwargs: Any) -> dict[str, Any]: ...
+
+    def invoke_model_with_response_stream(self, **kwargs: Any) -> dict[str, Any]: ...
+
+
+def validate_generation_params(max_tokens: int, temperature: float) -> None:
+    """Raise ValueError when sampling parameters are outside supported ranges."""
+    if not 1 <= max_tokens <= MAX_TOKENS_LIMIT:
+        raise ValueError(f"max_tokens must be between 1 and {MAX_TOKENS_LIMIT}")
+    if not 0.0 <= temperature <= 1.0:
+        raise ValueError("temperature must be between 0.0 and 1.0")
+
+
+@dataclass
+class TokenUsage:
+    """Token counts reported in the `usage` block of a chat completion."""
+
+    prompt_tokens: int = 0
+    completion_tokens: int = 0
+    total_tokens: int = 0
+
+    @classmethod
+    def from_response(cls, result: dict[str, Any]) -> "TokenUsage":
+        usage = result.get("usage")
+        if not isinstance(usage, dict):
+            usage = {}
+        return cls(
+            prompt_tokens=int(usage.get("prompt_tokens") or 0),
+            completion_tokens=int(usage.get("completion_tokens") or 0),
+            total_tokens=int(usage.get("total_tokens") or 0),
+        )
+
+    def __add__(self, other: "TokenUsage") -> "TokenUsage":
+        return TokenUsage(
+            self.prompt_tokens + other.prompt_tokens,
+            self.completion_tokens + other.completion_tokens,
+            self.total_tokens + other.total_tokens,
+        )
+
+
+class BedrockResponseError(ValueError):
+    """Raised when a completion body doesn't have the expected chat shape."""
+
+
+def parse_completion(raw: bytes | str) -> tuple[str, TokenUsage]:
+    """
+    Extract choices[0].message.content and token usage from an OpenAI-style
+    completion body. Any other shape raises BedrockResponseError rather than
+    silently yielding empty text.
+    """
+    try:
+        result = json.loads(raw)
+        content = result["choices"][0]["message"]["content"]
+    except (ValueError, KeyError, IndexError, TypeError):
+        content = None
+    if not isinstance(content, str):
+        logger.debug(f"Unexpected Bedrock response body: {raw!r}")
+        raise BedrockResponseError("unexpected Bedrock response format")
+    return content, TokenUsage.from_response(result)
+
+
+def parse_embedding(raw: bytes | str) -> list[float]:
+    """Extract the `embedding` vector from a Titan embeddings response body."""
+    try:
+        embedding = json.loads(raw)["embedding"]
+    except (ValueError, KeyError, TypeError):
+        embedding = None
+    if (
+        not isinstance(embedding, list)
+        or not embedding
+        or not all(isinstance(x, (int, float)) for x in embedding)
+    ):
+        logger.debug(f"Unexpected Bedrock embedding body: {raw!r}")
+        raise BedrockResponseError("unexpected Bedrock embedding format")
+    return [float(x) for x in embedding]
+
+
+def log_token_usage(usage: TokenUsage, model_id: str) -> None:
+    """Log per-call token totals for billing reconciliation."""
+    logger.info(
+        f"Bedrock usage: {usage.total_tokens} tokens ({model_id})",
+        extra={"fields": {"model": model_id, **asdict(usage)}},
+    )
+
+
+# Overall deadline for one logical call, retries and backoff included
+DEFAULT_TIMEOUT_SECONDS = 30.0
+
+
+class BedrockTimeoutError(Exception):
+    """Raised when a Bedrock call, including its retries, exceeds its deadline."""
+
+
+class BedrockUnavailableError(Exception):
+    """Raised without calling Bedrock while the circuit breaker is open."""
+
+    def __init__(self, retry_after: float) -> None:
+        super().__init__("Bedrock is unavailable, try again later")
+        self.retry_after = retry_after
+
+
+class CircuitBreaker:
+    """
+    Stops calling Bedrock after `failure_threshold` consecutive outage-type
+    failures (timeouts, throttling, 5xx). While open, calls fail immediately
+    with BedrockUnavailableError; after `reset_timeout` seconds one probe call
+    is let through (half-open) and its outcome closes or re-opens the circuit.
+    """
+
+    def __init__(
+        self,
+        failure_threshold: int = 5,
+        reset_timeout: float = 30.0,
+        clock: Callable[[], float] = time.monotonic,
+    ) -> None:
+        self.failure_threshold = failure_threshold
+        self.reset_timeout = reset_timeout
+        self._clock = clock
+        self._failures = 0
+        self._opened_at: float | None = None
+        self._probing = False
+
+    @property
+    def state(self) -> str:
+        if self._opened_at is None:
+            return "closed"
+        if self._probing or self._clock() - self._opened_at >= self.reset_timeout:
+            return "half_open"
+        return "open"
+
+    def check(self) -> None:
+        """Raise BedrockUnavailableError if a call would be short-circuited."""
+        state = self.state
+        if state == "open" or (state == "half_open" and self._probing):
+            remaining = self.reset_timeout - (self._clock() - self._opened_at)
+            raise BedrockUnavailableError(retry_after=max(remaining, 1.0))
+
+    def before_call(self) -> None:
+        self.check()
+        if self._opened_at is not None:
+            self._probing = True
+
+    def record_success(self) -> None:
+        if self._opened_at is not None:
+            logger.info("Bedrock circuit breaker closed")
+        self._failures = 0
+        self._opened_at = None
+        self._probing = False
+
+    def record_failure(self) -> None:
+        self._failures += 1
+        if self._probing or self._failures >= self.failure_threshold:
+            if self._opened_at is None:
+                logger.warning(
+                    f"Bedrock circuit breaker opened after {self._failures} "
+                    "consecutive failures"
+                )
+            self._opened_at = self._clock()
+        self._probing = False
+
+    def release(self) -> None:
+        """Give up a half-open probe whose outcome is unknown (e.g. cancelled)."""
+        self._probing = False
+
+
+# Shared by every Bedrock call in the process; thresholds are set from config
+breaker = CircuitBreaker()
+
+
+MAX_RETRIES = 3
+BASE_RETRY_DELAY = 0.2  # seconds; doubles on every attempt
+
+# Error codes Bedrock returns for throttling and transient service trouble
+RETRYABLE_ERROR_CODES = {
+    "ThrottlingException",
+    "TooManyRequestsException",
+    "ServiceUnavailableException",
+    "InternalServerException",
+    "ModelNotReadyException",
+}
+
+
+def is_retryable_error(exc: Exception) -> bool:
+    """
+    Return True for throttling and 5xx errors raised by botocore, and for
+    connection failures and read timeouts, which carry no response.
+    """
+    # EndpointConnectionError, ConnectTimeoutError, ReadTimeoutError and
+    # ConnectionClosedError; not credential or parameter errors
+    if isinstance(exc, (BotoConnectionError, HTTPClientError)):
+        return True
+    response = getattr(exc, "response", None)
+    if not isinstance(response, dict):
+        return False
+    code = response.get("Error", {}).get("Code", "")
+    if code in RETRYABLE_ERROR_CODES:
+        return True
+    status = response.get("ResponseMetadata", {}).get("HTTPStatusCode") or 0
+    return status >= 500
+
+
+def is_bedrock_answer(exc: Exception) -> bool:
+    """
+    True for an error response Bedrock itself returned that retrying won't
+    fix, e.g. a 4xx validation error. Connection failures and timeouts carry
+    no response, so they count against the breaker like 5xx errors do.
+    """
+    response = getattr(exc, "response", None)
+    return isinstance(response, dict) and not is_retryable_error(exc)
+
+
+def _record_outcome(exc: Exception) -> None:
+    if is_bedrock_answer(exc):
+        breaker.record_success()
+    else:
+        breaker.record_failure()
+
+
+# Errors that mean this region can't serve the model right now, where another
+# region may: an outage, a cold model, or a model the region doesn't offer
+REGION_UNAVAILABLE_ERROR_CODES = {
+    "ServiceUnavailableException",
+    "ModelNotReadyException",
+    "ResourceNotFoundException",
+}
+
+
+def is_region_unavailable_error(exc: Exception) -> bool:
+    response = getattr(exc, "response", None)
+    if not isinstance(response, dict):
+        return False
+    return response.get("Error", {}).get("Code", "") in REGION_UNAVAILABLE_ERROR_CODES
+
+
+class RegionalBedrockClient:
+    """
+    BedrockInvoker over one client per region, tried in order. A call moves
+    on to the next region only for region availability errors; anything else
+    (throttling, bad requests) is raised from the region that returned it.
+    """
+
+    def __init__(self, clients: list[tuple[str, BedrockInvoker]]) -> None:
+        if not clients:
+            raise ValueError("at least one region is required")
+        self.clients = clients
+
+    def invoke_model(self, **kwargs: Any) -> dict[str, Any]:
+        return self._call("invoke_model", **kwargs)
+
+    def invoke_model_with_response_stream(self, **kwargs: Any) -> dict[str, Any]:
+        return self._call("invoke_model_with_response_stream", **kwargs)
+
+    def _call(self, method: str, **kwargs: Any) -> dict[str, Any]:
+        model_id = kwargs.get("modelId", "")
+        for index, (region, client) in enumerate(self.clients):
+            try:
+                response = getattr(client, method)(**kwargs)
+            except Exception as exc:
+                is_last = index == len(self.clients) - 1
+                if is_last or not is_region_unavailable_error(exc):
+                    raise
+                next_region = self.clients[index + 1][0]
+                logger.warning(
+                    f"Bedrock {model_id} unavailable in {region} ({exc}), "
+                    f"failing over to {next_region}"
+                )
+                continue
+            trace.get_current_span().set_attribute("bedrock.region", region)
+            logger.info(f"Bedrock {model_id} served from {region}")
+            return response
+        raise RuntimeError("unreachable")  # pragma: no cover
+
+
+async def invoke_model_with_retry(
+    client: BedrockInvoker,
+    timeout: float | None = DEFAULT_TIMEOUT_SECONDS,
+    **kwargs: Any,
+) -> dict[str, Any]:
+    """
+    Call client.invoke_model off the event loop, retrying throttling and
+    transient errors with exponential backoff plus jitter.
+    Raises BedrockTimeoutError once `timeout` seconds have passed overall.
+    Cancelling the awaiting task aborts any pending backoff sleep.
+    Raises BedrockUnavailableError without calling Bedrock while `breaker`
+    is open.
+    """
+    breaker.before_call()
+    start = time.perf_counter()
+    # One span per logical call; retries show up as events rather than spans
+    with tracer.start_as_current_span(
+        "bedrock.invoke_model",
+        kind=trace.SpanKind.CLIENT,
+        attributes={"bedrock.model_id": str(kwargs.get("modelId", ""))},
+    ):
+        try:
+            response = await _invoke_with_deadline(client, start, timeout, **kwargs)
+        except BedrockTimeoutError:
+            breaker.record_failure()
+            raise
+        except Exception as exc:
+            _record_outcome(exc)
+            raise
+        except BaseException:
+            breaker.release()
+            raise
+        breaker.record_success()
+        return response
+
+
+def open_response_stream(client: BedrockInvoker, **kwargs: Any) -> dict[str, Any]:
+    """
+    client.invoke_model_with_response_stream behind `breaker`. Blocks until
+    Bedrock accepts the request; only that counts towards the breaker, not
+    errors while reading the stream. Not retried, since a caller may already
+    be waiting on the first token.
+    """
+    breaker.before_call()
+    try:
+        response = client.invoke_model_with_response_stream(**kwargs)
+    except Exception as exc:
+        _record_outcome(exc)
+        raise
+    except BaseException:
+        breaker.release()
+        raise
+    breaker.record_success()
+    return response
+
+
+async def _invoke_with_deadline(
+    client: BedrockInvoker, start: float, timeout: float | None, **kwargs: Any
+) -> dict[str, Any]:
+    try:
+        async with asyncio.timeout(timeout):
+            return await _invoke_with_backoff(client, start, **kwargs)
+    except TimeoutError as exc:
+        BEDROCK_CALL_DURATION.observe(time.perf_counter() - start)
+        BEDROCK_CALL_ERRORS.inc()
+        raise BedrockTimeoutError(
+            f"Bedrock did not respond within {timeout:g} seconds"
+        ) from exc
+
+
+async def _invoke_with_backoff(
+    client: BedrockInvoker, start: float, **kwargs: Any
+) -> dict[str, Any]:
+    for attempt in range(MAX_RETRIES + 1):
+        try:
+            response = await asyncio.to_thread(client.invoke_model, **kwargs)
+            BEDROCK_CALL_DURATION.observe(time.perf_counter() - start)
+            return response
+        except Exception as exc:
+            if attempt == MAX_RETRIES or not is_retryable_error(exc):
+                BEDROCK_CALL_DURATION.observe(time.perf_counter() - start)
+                BEDROCK_CALL_ERRORS.inc()
+                raise
+            delay = BASE_RETRY_DELAY * (2**attempt)
+            delay += random.uniform(0, delay / 2)
+            trace.get_current_span().add_event(
+                "retry", {"attempt": attempt + 1, "error": str(exc)}
+            )
+            # Each retry is routine; callers log the call that ultimately fails
+            logger.info(
+                f"Bedrock call failed ({exc}), retrying in {delay:.2f}s "
+                f"(attempt {attempt + 1}/{MAX_RETRIES})"
+            )
+            await asyncio.sleep(delay)
+    raise RuntimeError("unreachable")  # pragma: no cover
@@ -0,0 +1,71 @@
+from dataclasses import dataclass
+from typing import Any, Callable
+import hashlib
+import json
+import time
+
+
+@dataclass(frozen=True)
+class CacheEntry:
+    body: dict[str, Any]
+    etag: str
+    headers: dict[str, str]
+    expires_at: float
+
+
+def etag_for(body: Any) -> str:
+    """Strong ETag over the JSON body, so identical lists share a tag."""
+    encoded = json.dumps(body, sort_keys=True, separators=(",", ":"), default=str)
+    return f'"{hashlib.sha256(encoded.encode()).hexdigest()[:32]}"'
+
+
+def etag_matches(if_none_match: str | None, etag: str) -> bool:
+    """If-None-Match comparison; weak tags (W/"...") match their strong form."""
+    if not if_none_match:
+        return False
+    if if_none_match.strip() == "*":
+        return True
+    return any(
+        candidate.strip().removeprefix("W/") == etag
+        for candidate in if_none_match.split(",")
+    )
+
+
+class ListCache:
+    """
+    In-memory cache of list responses keyed by path and query string. Writes
+    clear the whole cache; each worker has its own, so another worker can
+    serve a list that is up to `ttl` seconds old. A ttl of 0 disables it.
+    """
+
+    def __init__(
+        self, ttl: float, clock: Callable[[], float] = time.monotonic
+    ) -> None:
+        self.ttl = ttl
+        self._clock = clock
+        self._entries: dict[str, CacheEntry] = {}
+
+    def get(self, key: str) -> CacheEntry | None:
+        entry = self._entries.get(key)
+        if entry is None:
+            return None
+        if entry.expires_at <= self._clock():
+            del self._entries[key]
+            return None
+        return entry
+
+    def set(
+        self, key: str, body: dict[str, Any], headers: dict[str, str] | None = None
+    ) -> CacheEntry:
+        entry = CacheEntry(
+            body=body,
+            etag=etag_for(body),
+            headers=headers or {},
+            expires_at=self._clock() + self.ttl,
+        )
+        if self.ttl > 0:
+            self._entries[key] = entry
+        return entry
+
+    def clear(self) -> None:
+        self._entries.clear()
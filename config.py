@@ -0,0 +1,318 @@
+from dataclasses import dataclass
+from pathlib import Path
+from typing import Callable, Mapping, MutableMapping, TypeVar
+from urllib.parse import quote
+import ipaddress
+import logging
+
+from dotenv import dotenv_values
+
+from auth import parse_api_keys
+from bedrock import (
+    DEFAULT_EMBEDDING_MODEL_ID,
+    DEFAULT_MODEL_ID,
+    DEFAULT_TIMEOUT_SECONDS,
+)
+
+T = TypeVar("T", int, float)
+
+LOG_LEVELS = {
+    "debug": logging.DEBUG,
+    "info": logging.INFO,
+    "warn": logging.WARNING,
+    "warning": logging.WARNING,
+    "error": logging.ERROR,
+}
+
+# Experimental routes, each enabled with FEATURE_<NAME>=true
+FEATURES = ("streaming", "compare")
+
+
+class ConfigError(ValueError):
+    """Raised with every missing or invalid variable listed, one per line."""
+
+    def __init__(self, errors: list[str]) -> None:
+        self.errors = errors
+        super().__init__(
+            "invalid configuration:\n" + "\n".join(f"  - {e}" for e in errors)
+        )
+
+
+@dataclass(frozen=True)
+class Config:
+    database_url: str
+    aws_region: str = "eu-west-1"
+    # Named profile for the base credentials; None uses the default chain
+    aws_profile: str | None = None
+    # Role assumed via STS for Bedrock calls, e.g. in another account
+    bedrock_assume_role_arn: str | None = None
+    # Region tried when aws_region can't serve the model; None disables failover
+    bedrock_fallback_region: str | None = None
+    # Guardrail screening prompts for POST /negotiations/validate; without one a
+    # short classification call is used instead
+    bedrock_guardrail_id: str | None = None
+    bedrock_guardrail_version: str = "DRAFT"
+    # Check generated negotiation text with the same guardrail (or classifier)
+    # before it's stored or emailed; flagged replies are withheld
+    moderate_output: bool = False
+    default_bedrock_model: str = DEFAULT_MODEL_ID
+    # Embeds supplier descriptions for GET /suppliers/duplicates
+    embedding_model: str = DEFAULT_EMBEDDING_MODEL_ID
+    # Cosine similarity at which two suppliers are reported as likely duplicates
+    duplicate_similarity_threshold: float = 0.9
+    app_env: str = "production"
+    port: int = 8000
+    log_level: int = logging.INFO
+    shutdown_timeout: int = 15
+    # Empty means any origin is allowed
+    allowed_origins: tuple[str, ...] = ()
+    # Empty disables API key authentication
+    api_keys: frozenset[str] = frozenset()
+    # Keys (also in API_KEYS) allowed to see soft-deleted records
+    admin_api_keys: frozenset[str] = frozenset()
+    # Proxies (e.g. the ALB subnets) whose X-Forwarded-For is believed; empty
+    # means the peer address is the client
+    trusted_proxies: tuple[ipaddress.IPv4Network | ipaddress.IPv6Network, ...] = ()
+    run_migrations: bool = True
+    # Also check the default Bedrock model is reachable in /ready (no tokens used)
+    ready_check_bedrock: bool = False
+    # Server-side cap on any single query so a hung statement can't pin a connection
+    db_command_timeout: float = 10
+    db_min_conns: int = 2
+    db_max_conns: int = 10
+    db_max_conn_idle_time: float = 300
+    # asyncpg has no max connection lifetime; recycle after this many queries instead
+    db_max_queries: int = 50000
+    db_connect_retries: int = 10
+    db_connect_retry_delay: float = 2
+    # Queries slower than this are logged with their SQL; 0 disables
+    slow_query_ms: float = 500
+    max_body_bytes: int = 1024 * 1024
+    # /stats counts change slowly; 0 disables the cache
+    stats_cache_ttl_seconds: float = 30
+    # /suppliers and /products list responses; writes clear it, 0 disables it
+    cache_ttl_seconds: float = 30
+    # Responses smaller than this aren't worth gzipping
+    gzip_min_bytes: int = 1024
+    rate_limit_rps: float = 10
+    rate_limit_burst: int = 20
+    rate_limit_llm_rps: float = 0.5
+    rate_limit_llm_burst: int = 5
+    bedrock_max_concurrency: int = 5
+    bedrock_timeout_seconds: float = DEFAULT_TIMEOUT_SECONDS
+    bedrock_breaker_failures: int = 5
+    bedrock_breaker_reset_seconds: float = 30.0
+    # Ask Bedrock for insights as JSON (strengths, risks, recommended_approach)
+    structured_insights: bool = False
+    # Bedrock calls per second made by the bulk insights regeneration job
+    insights_job_rps: float = 1
+    # How long an Idempotency-Key replays its stored /negotiate response
+    idempotency_ttl_seconds: float = 24 * 60 * 60
+    # Supplier image uploads are disabled without a bucket
+    s3_bucket: str | None = None
+    max_image_bytes: int = 5 * 1024 * 1024
+    negotiation_system_prompt: str | None = None
+    email_user: str | None = None
+    email_password: str | None = None
+    # Tracing is disabled unless an OTLP/HTTP collector endpoint is set
+    otel_endpoint: str | None = None
+    otel_service_name: str = "negotiation-api"
+    # Serve heap, task and thread profiles under /debug/pprof; needs API_KEYS
+    enable_pprof: bool = False
+    # Names from FEATURES whose routes are served; the rest return 404
+    features: frozenset[str] = frozenset()
+    # Stamped into the image at build time (docker build --build-arg)
+    version: str = "dev"
+    commit: str = "unknown"
+    build_time: str = "unknown"
+
+    @property
+    def debug(self) -> bool:
+        # Debug mode renders tracebacks in 500 responses, so it must be opted into
+        return self.app_env in ("development", "debug")
+
+
+def env_file_candidates(environ: Mapping[str, str]) -> list[Path]:
+    """
+    ENV_FILE when set, otherwise .env in the working directory and then next
+    to the application code, so it's found whichever directory we start in.
+    """
+    if environ.get("ENV_FILE"):
+        return [Path(environ["ENV_FILE"])]
+    return [Path.cwd() / ".env", Path(__file__).resolve().parent / ".env"]
+
+
+def load_env_file(environ: MutableMapping[str, str]) -> Path | None:
+    """
+    Copy variables from the first existing candidate file into environ.
+    Variables already set in the real environment always win. Returns the
+    file used, or None when there was none (not an error: in containers the
+    environment is usually set directly).
+    """
+    for path in env_file_candidates(environ):
+        if path.is_file():
+            for key, value in dotenv_values(path).items():
+                if value is not None:
+                    environ.setdefault(key, value)
+            return path
+    return None
+
+
+def _database_url(environ: Mapping[str, str], errors: list[str]) -> str:
+    """
+    Use DB_URL when set, otherwise assemble a URL from the libpq-style
+    PGHOST/PGPORT/PGUSER/PGPASSWORD/PGDATABASE variables.
+    """
+    if environ.get("DB_URL"):
+        return environ["DB_URL"]
+    missing = [
+        name for name in ("PGHOST", "PGUSER", "PGDATABASE") if not environ.get(name)
+    ]
+    if missing:
+        errors.append(f"DB_URL is not set and neither are {', '.join(missing)}")
+        return ""
+    credentials = quote(environ["PGUSER"], safe="")
+    if environ.get("PGPASSWORD"):
+        credentials += ":" + quote(environ["PGPASSWORD"], safe="")
+    return (
+        f"postgresql://{credentials}@{environ['PGHOST']}:"
+        f"{environ.get('PGPORT') or '5432'}/{quote(environ['PGDATABASE'], safe='')}"
+    )
+
+
+def load_config(environ: Mapping[str, str]) -> Config:
+    """
+    Parse and validate every setting up front. Raises ConfigError listing all
+    problems at once rather than stopping at the first one.
+    """
+    errors: list[str] = []
+
+    def number(name: str, cast: Callable[[str], T], default: T, minimum: T) -> T:
+        raw = environ.get(name)
+        if not raw:
+            return default
+        try:
+            value = cast(raw)
+        except ValueError:
+            errors.append(f"{name} must be a number, got {raw!r}")
+            return default
+        if value < minimum:
+            errors.append(f"{name} must be at least {minimum}, got {raw!r}")
+        return value
+
+    log_level = (environ.get("LOG_LEVEL") or "info").lower()
+    if log_level not in LOG_LEVELS:
+        errors.append(
+            f"LOG_LEVEL must be one of {', '.join(LOG_LEVELS)}, got {log_level!r}"
+        )
+        log_level = "info"
+
+    aws_region = environ.get("AWS_REGION") or "eu-west-1"
+    fallback_region = environ.get("BEDROCK_FALLBACK_REGION") or None
+    if fallback_region == aws_region:
+        errors.append("BEDROCK_FALLBACK_REGION must differ from AWS_REGION")
+        fallback_region = None
+
+    trusted_proxies: list[ipaddress.IPv4Network | ipaddress.IPv6Network] = []
+    for cidr in environ.get("TRUSTED_PROXIES", "").split(","):
+        if not cidr.strip():
+            continue
+        try:
+            trusted_proxies.append(ipaddress.ip_network(cidr.strip(), strict=False))
+        except ValueError:
+            errors.append(f"TRUSTED_PROXIES has an invalid CIDR: {cidr.strip()!r}")
+
+    # ALLOWED_ORIGINS is preferred; FRONTEND_ORIGINS is kept for existing deployments
+    origins = environ.get("ALLOWED_ORIGINS") or environ.get("FRONTEND_ORIGINS", "")
+
+    config = Config(
+        database_url=_database_url(environ, errors),
+        aws_region=aws_region,
+        aws_profile=environ.get("AWS_PROFILE") or None,
+        bedrock_assume_role_arn=environ.get("BEDROCK_ASSUME_ROLE_ARN") or None,
+        bedrock_fallback_region=fallback_region,
+        bedrock_guardrail_id=environ.get("BEDROCK_GUARDRAIL_ID") or None,
+        bedrock_guardrail_version=environ.get("BEDROCK_GUARDRAIL_VERSION") or "DRAFT",
+        moderate_output=environ.get("MODERATE_OUTPUT", "false").lower() == "true",
+        default_bedrock_model=environ.get("DEFAULT_BEDROCK_MODEL") or DEFAULT_MODEL_ID,
+        embedding_model=environ.get("EMBEDDING_MODEL") or DEFAULT_EMBEDDING_MODEL_ID,
+        duplicate_similarity_threshold=number(
+            "DUPLICATE_SIMILARITY_THRESHOLD", float, 0.9, 0.0
+        ),
+        app_env=(environ.get("APP_ENV") or "production").lower(),
+        port=number("PORT", int, 8000, 1),
+        log_level=LOG_LEVELS[log_level],
+        shutdown_timeout=number("SHUTDOWN_TIMEOUT", int, 15, 0),
+        allowed_origins=tuple(o.strip() for o in origins.split(",") if o.strip()),
+        api_keys=frozenset(parse_api_keys(environ.get("API_KEYS", ""))),
+        admin_api_keys=frozenset(parse_api_keys(environ.get("ADMIN_API_KEYS", ""))),
+        trusted_proxies=tuple(trusted_proxies),
+        run_migrations=environ.get("RUN_MIGRATIONS", "true").lower() == "true",
+        ready_check_bedrock=environ.get("READY_CHECK_BEDROCK", "false").lower()
+        == "true",
+        db_command_timeout=number("DB_COMMAND_TIMEOUT", float, 10.0, 0.0),
+        db_min_conns=number("DB_MIN_CONNS", int, 2, 0),
+        db_max_conns=number("DB_MAX_CONNS", int, 10, 1),
+        db_max_conn_idle_time=number("DB_MAX_CONN_IDLE_TIME", float, 300.0, 0.0),
+        db_max_queries=number("DB_MAX_QUERIES", int, 50000, 1),
+        db_connect_retries=number("DB_CONNECT_RETRIES", int, 10, 1),
+        db_connect_retry_delay=number("DB_CONNECT_RETRY_DELAY", float, 2.0, 0.0),
+        slow_query_ms=number("SLOW_QUERY_MS", float, 500.0, 0.0),
+        max_body_bytes=number("MAX_BODY_BYTES", int, 1024 * 1024, 1),
+        stats_cache_ttl_seconds=number("STATS_CACHE_TTL_SECONDS", float, 30.0, 0.0),
+        cache_ttl_seconds=number("CACHE_TTL", float, 30.0, 0.0),
+        gzip_min_bytes=number("GZIP_MIN_BYTES", int, 1024, 0),
+        rate_limit_rps=number("RATE_LIMIT_RPS", float, 10.0, 0.0),
+        rate_limit_burst=number("RATE_LIMIT_BURST", int, 20, 1),
+        rate_limit_llm_rps=number("RATE_LIMIT_LLM_RPS", float, 0.5, 0.0),
+        rate_limit_llm_burst=number("RATE_LIMIT_LLM_BURST", int, 5, 1),
+        bedrock_max_concurrency=number("BEDROCK_MAX_CONCURRENCY", int, 5, 1),
+        bedrock_timeout_seconds=number(
+            "BEDROCK_TIMEOUT_SECONDS", float, DEFAULT_TIMEOUT_SECONDS, 1.0
+        ),
+        bedrock_breaker_failures=number("BEDROCK_BREAKER_FAILURES", int, 5, 1),
+        bedrock_breaker_reset_seconds=number(
+            "BEDROCK_BREAKER_RESET_SECONDS", float, 30.0, 1.0
+        ),
+        structured_insights=environ.get("STRUCTURED_INSIGHTS", "false").lower()
+        == "true",
+        insights_job_rps=number("INSIGHTS_JOB_RPS", float, 1.0, 0.0),
+        idempotency_ttl_seconds=number(
+            "IDEMPOTENCY_TTL_SECONDS", float, 24 * 60 * 60.0, 1.0
+        ),
+        s3_bucket=environ.get("S3_BUCKET") or None,
+        max_image_bytes=number("MAX_IMAGE_BYTES", int, 5 * 1024 * 1024, 1),
+        negotiation_system_prompt=environ.get("NEGOTIATION_SYSTEM_PROMPT") or None,
+        email_user=environ.get("EMAIL_USER") or None,
+        email_password=environ.get("EMAIL_PASSWORD") or None,
+        otel_endpoint=environ.get("OTEL_EXPORTER_OTLP_ENDPOINT") or None,
+        otel_service_name=environ.get("OTEL_SERVICE_NAME") or "negotiation-api",
+        version=environ.get("APP_VERSION") or "dev",
+        commit=environ.get("GIT_COMMIT") or "unknown",
+        build_time=environ.get("BUILD_TIME") or "unknown",
+        enable_pprof=environ.get("ENABLE_PPROF", "false").lower() == "true",
+        features=frozenset(
+            name
+            for name in FEATURES
+            if environ.get(f"FEATURE_{name.upper()}", "false").lower() == "true"
+        ),
+    )
+    for name, rate in (
+        ("RATE_LIMIT_RPS", config.rate_limit_rps),
+        ("RATE_LIMIT_LLM_RPS", config.rate_limit_llm_rps),
+        ("INSIGHTS_JOB_RPS", config.insights_job_rps),
+    ):
+        if rate <= 0:
+            errors.append(f"{name} must be greater than 0")
+    if config.duplicate_similarity_threshold > 1:
+        errors.append("DUPLICATE_SIMILARITY_THRESHOLD must be at most 1")
+    if config.enable_pprof and not config.api_keys:
+        # Profiles expose code paths and memory contents; never serve them openly
+        errors.append("ENABLE_PPROF requires API_KEYS")
+    if not config.admin_api_keys <= config.api_keys:
+        errors.append("ADMIN_API_KEYS must also be listed in API_KEYS")
+    if config.db_min_conns > config.db_max_conns:
+        errors.append("DB_MIN_CONNS must not exceed DB_MAX_CONNS")
+    if errors:
+        raise ConfigError(errors)
+    return config
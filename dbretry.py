@@ -0,0 +1,53 @@
+from typing import Awaitable, Callable, TypeVar
+import asyncio
+import logging
+import random
+
+import asyncpg
+
+logger = logging.getLogger("negotiation.db")
+
+T = TypeVar("T")
+
+MAX_DB_RETRIES = 2
+BASE_DB_RETRY_DELAY = 0.05  # seconds; doubles on every attempt
+
+# Serialization failure, deadlock, and the server going away or not taking
+# connections yet (admin/crash shutdown, failover). SQLSTATE class 08,
+# connection exceptions, is matched as a whole.
+RETRYABLE_SQLSTATES = {"40001", "40P01", "57P01", "57P02", "57P03"}
+
+
+def is_retryable_db_error(exc: BaseException) -> bool:
+    """True for errors a fresh attempt on another connection may not hit."""
+    if isinstance(exc, (asyncpg.ConnectionDoesNotExistError, ConnectionError)):
+        return True
+    if not isinstance(exc, asyncpg.PostgresError):
+        return False
+    sqlstate = getattr(exc, "sqlstate", None) or ""
+    return sqlstate.startswith("08") or sqlstate in RETRYABLE_SQLSTATES
+
+
+async def with_db_retry(
+    query: Callable[[], Awaitable[T]], retries: int = MAX_DB_RETRIES
+) -> T:
+    """
+    Run `query`, retrying transient failures with exponential backoff plus
+    jitter; anything else is raised straight away. `query` must be safe to
+    repeat and should use the pool rather than a held connection, so each
+    attempt can land on a healthy one.
+    """
+    for attempt in range(retries + 1):
+        try:
+            return await query()
+        except Exception as exc:
+            if attempt == retries or not is_retryable_db_error(exc):
+                raise
+            delay = BASE_DB_RETRY_DELAY * (2**attempt)
+            delay += random.uniform(0, delay / 2)
+            logger.info(
+                f"Database query failed ({type(exc).__name__}: {exc}), retrying "
+                f"in {delay:.2f}s (attempt {attempt + 1}/{retries})"
+            )
+            await asyncio.sleep(delay)
+    raise RuntimeError("unreachable")  # pragma: no cover
@@ -0,0 +1,85 @@
+from typing import Any
+
+import asyncpg
+
+# Stable, machine-readable codes sent with every error. Clients switch on
+# these; `detail` is a human-readable message and may be reworded.
+ERROR_CODES = {
+    400: "invalid_request",
+    401: "unauthorized",
+    403: "forbidden",
+    404: "not_found",
+    405: "method_not_allowed",
+    409: "conflict",
+    413: "payload_too_large",
+    415: "unsupported_media_type",
+    422: "unprocessable",
+    429: "rate_limited",
+    500: "internal_error",
+    502: "upstream_error",
+    503: "unavailable",
+    504: "timeout",
+}
+
+
+def error_body(
+    status_code: int, detail: Any, code: str | None = None
+) -> dict[str, Any]:
+    """The error envelope: {"detail": <message>, "code": <stable code>}."""
+    return {"detail": detail, "code": code or ERROR_CODES.get(status_code, "error")}
+
+
+class APIError(Exception):
+    """
+    An error with a message that is safe to show clients. `internal` carries
+    the underlying cause (SQL state, upstream error text) for the logs only.
+    """
+
+    def __init__(
+        self,
+        status_code: int,
+        message: str,
+        code: str | None = None,
+        internal: str | None = None,
+        headers: dict[str, str] | None = None,
+    ) -> None:
+        super().__init__(message)
+        self.status_code = status_code
+        self.message = message
+        self.code = code or ERROR_CODES.get(status_code, "error")
+        self.internal = internal
+        self.headers = headers
+
+    def body(self) -> dict[str, Any]:
+        return error_body(self.status_code, self.message, self.code)
+
+
+def from_db_error(exc: Exception) -> APIError:
+    """
+    Map an asyncpg error a handler didn't catch to a client-safe APIError.
+    Constraint and table names stay in `internal`.
+    """
+    internal = f"{type(exc).__name__}: {exc}"
+    if isinstance(exc, asyncpg.UniqueViolationError):
+        return APIError(409, "resource already exists", "already_exists", internal)
+    if isinstance(exc, asyncpg.ForeignKeyViolationError):
+        return APIError(
+            409, "a referenced resource is missing or in use", "conflict", internal
+        )
+    if isinstance(
+        exc,
+        (
+            asyncpg.DataError,
+            asyncpg.NotNullViolationError,
+            asyncpg.CheckViolationError,
+        ),
+    ):
+        return APIError(400, "invalid value", "invalid_request", internal)
+    if isinstance(exc, asyncpg.QueryCanceledError):
+        return APIError(504, "database query timed out", "timeout", internal)
+    if isinstance(
+        exc,
+        (asyncpg.PostgresConnectionError, asyncpg.InterfaceError, ConnectionError),
+    ):
+        return APIError(503, "database unavailable", "unavailable", internal)
+    return APIError(500, "internal server error", "internal_error", internal)
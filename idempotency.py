@@ -0,0 +1,57 @@
+from typing import Any
+import hashlib
+import json
+
+import asyncpg
+
+MAX_KEY_LENGTH = 255
+
+
+def fingerprint(payload: Any) -> str:
+    """Stable hash of a request body, to catch a key reused for another request."""
+    encoded = json.dumps(payload, sort_keys=True, separators=(",", ":"))
+    return hashlib.sha256(encoded.encode()).hexdigest()
+
+
+async def claim_key(
+    db: asyncpg.Pool, key: str, request_fingerprint: str, ttl_seconds: float
+) -> asyncpg.Record | None:
+    """
+    Reserve key for a new request. Returns None when the caller now owns the
+    key and should run the request, otherwise the existing row, whose
+    response is still NULL while the first request is in flight.
+    Expired keys are pruned first, so a key can be reused after the TTL.
+    """
+    await db.execute(
+        "DELETE FROM idempotency_key WHERE created_at < now() - make_interval(secs => $1)",
+        ttl_seconds,
+    )
+    claimed = await db.fetchval(
+        """
+        INSERT INTO idempotency_key (key, fingerprint) VALUES ($1, $2)
+        ON CONFLICT (key) DO NOTHING
+        RETURNING key
+        """,
+        key,
+        request_fingerprint,
+    )
+    if claimed is not None:
+        return None
+    return await db.fetchrow(
+        "SELECT fingerprint, response FROM idempotency_key WHERE key = $1", key
+    )
+
+
+async def store_response(db: asyncpg.Pool, key: str, response: Any) -> None:
+    await db.execute(
+        "UPDATE idempotency_key SET response = $2::jsonb WHERE key = $1",
+        key,
+        json.dumps(response),
+    )
+
+
+async def release_key(db: asyncpg.Pool, key: str) -> None:
+    """Forget a key whose request failed, so the client can retry it."""
+    await db.execute(
+        "DELETE FROM idempotency_key WHERE key = $1 AND response IS NULL", key
+    )
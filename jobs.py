@@ -0,0 +1,86 @@
+from dataclasses import asdict, dataclass, field
+from datetime import datetime, timezone
+from typing import Any, Awaitable, Callable
+import asyncio
+import logging
+import uuid
+
+logger = logging.getLogger("negotiation.jobs")
+
+
+def _now() -> datetime:
+    return datetime.now(timezone.utc)
+
+
+@dataclass
+class Job:
+    """Progress of a background job; `work` updates the counts as it goes."""
+
+    kind: str
+    job_id: str = field(default_factory=lambda: str(uuid.uuid4()))
+    status: str = "pending"  # pending -> running -> done | failed
+    total: int = 0
+    succeeded: int = 0
+    failed: int = 0
+    error: str | None = None
+    created_at: datetime = field(default_factory=_now)
+    finished_at: datetime | None = None
+
+    def to_dict(self) -> dict[str, Any]:
+        data = asdict(self)
+        data["created_at"] = self.created_at.isoformat()
+        data["finished_at"] = self.finished_at.isoformat() if self.finished_at else None
+        return data
+
+
+class JobRegistry:
+    """
+    In-process job tracker. Jobs live only as long as this instance, which is
+    enough for ops-triggered batch work polled shortly after it's started.
+    """
+
+    def __init__(self, max_jobs: int = 100) -> None:
+        self.max_jobs = max_jobs
+        self._jobs: dict[str, Job] = {}
+        self._tasks: dict[str, asyncio.Task] = {}
+
+    def get(self, job_id: str) -> Job | None:
+        return self._jobs.get(job_id)
+
+    def start(self, kind: str, work: Callable[[Job], Awaitable[None]]) -> Job:
+        """Create a job and run work(job) in the background."""
+        job = Job(kind=kind)
+        self._jobs[job.job_id] = job
+        self._prune()
+        self._tasks[job.job_id] = asyncio.create_task(self._run(job, work))
+        return job
+
+    async def _run(self, job: Job, work: Callable[[Job], Awaitable[None]]) -> None:
+        job.status = "running"
+        try:
+            await work(job)
+            job.status = "done"
+        except asyncio.CancelledError:
+            job.status, job.error = "failed", "cancelled"
+            raise
+        except Exception as e:
+            logger.exception(f"Job {job.job_id} ({job.kind}) failed")
+            job.status, job.error = "failed", str(e)
+        finally:
+            job.finished_at = _now()
+            self._tasks.pop(job.job_id, None)
+
+    def _prune(self) -> None:
+        # Forget the oldest finished jobs; running ones are always kept
+        finished = [
+            job_id for job_id, job in self._jobs.items() if job.finished_at is not None
+        ]
+        for job_id in finished[: max(0, len(self._jobs) - self.max_jobs)]:
+            del self._jobs[job_id]
+
+    async def shutdown(self) -> None:
+        """Cancel jobs still running, e.g. when the server stops."""
+        tasks = list(self._tasks.values())
+        for task in tasks:
+            task.cancel()
+        await asyncio.gather(*tasks, return_exceptions=True)
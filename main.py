@@ -1,42 +1,136 @@
 import asyncio
+import base64
+import codecs
+import csv
+import functools
+import io
 import json
+import math
 import os
+import re
+import time
 import uuid
 import logging
 from contextlib import asynccontextmanager
-from typing import Any, Optional
-from datetime import datetime
-
-from dotenv import load_dotenv
-from pydantic import BaseModel
-from fastapi import HTTPException, FastAPI
+from dataclasses import asdict
+from typing import (
+    Annotated,
+    Any,
+    AsyncIterator,
+    Callable,
+    Generic,
+    Iterable,
+    Iterator,
+    Literal,
+    Optional,
+    TypeVar,
+)
+from datetime import datetime, timezone
+from decimal import Decimal
+
+from pydantic import BaseModel, Field, ValidationError, field_validator
+from fastapi import (
+    Depends,
+    File,
+    Header,
+    HTTPException,
+    FastAPI,
+    Request,
+    Response,
+    UploadFile,
+)
+from fastapi.exceptions import RequestValidationError
 from fastapi.middleware.cors import CORSMiddleware
+from fastapi.encoders import jsonable_encoder
+from fastapi.responses import JSONResponse, StreamingResponse
+from starlette.exceptions import HTTPException as StarletteHTTPException
 import asyncpg
-import boto3
+from botocore.config import Config as BotoConfig
 
 # Local imports
+from auth import APIKeyAuth
+from aws import aws_session
+from config import Config, env_file_candidates, load_config, load_env_file
 from email_client import EmailClient
+from bedrock import (
+    ALLOWED_MODELS,
+    BedrockInvoker,
+    BedrockResponseError,
+    BedrockTimeoutError,
+    BedrockUnavailableError,
+    DEFAULT_MAX_TOKENS,
+    DEFAULT_TEMPERATURE,
+    RegionalBedrockClient,
+    TokenUsage,
+    breaker as bedrock_breaker,
+    invoke_model_with_retry,
+    log_token_usage,
+    open_response_stream,
+    parse_completion,
+    parse_embedding,
+    validate_generation_params,
+)
+from metrics import metrics_middleware, metrics_response
+from profiling import heap_profile, start_heap_tracing, task_dump, thread_dump
+from idempotency import (
+    MAX_KEY_LENGTH,
+    claim_key,
+    fingerprint,
+    release_key,
+    store_response,
+)
+from jobs import Job, JobRegistry
+from migrations import apply_migrations
+from tracing import configure_tracing
+from querylog import SlowQueryLogger
+from middleware import (
+    BodySizeLimitMiddleware,
+    DebugBodyLogMiddleware,
+    GZipMiddleware,
+    JSONContentTypeMiddleware,
+    ProxyHeadersMiddleware,
+    RateLimiter,
+    configure_logging,
+    make_rate_limit_middleware,
+    recovery_middleware,
+    request_context_middleware,
+)
 from agents import NegotiationAgent, OrchestratorAgent, strip_reasoning_tokens
 from router import EmailEventRouter, NegotiationSession
+from cache import CacheEntry, ListCache, etag_matches
+from currencies import normalize_currency
+from dbretry import with_db_retry
+from errors import APIError, error_body, from_db_error
+from similarity import cluster_by_similarity, embedding_key
+from store import PgStore, Store
 
-load_dotenv()
-
-# Setup logging
-logging.basicConfig(
-    level=logging.INFO, format="%(asctime)s - %(name)s - %(levelname)s - %(message)s"
-)
-logger = logging.getLogger("negotiation")
+env_file = load_env_file(os.environ)
 
-DATABASE_URL = os.environ["DB_URL"]
-AWS_REGION = os.environ.get("AWS_REGION", "eu-west-1")
-FRONTEND_ORIGINS = os.environ.get("FRONTEND_ORIGINS", "")
+# Fails fast with every missing/invalid variable listed at once
+config = load_config(os.environ)
 
-NEGOTIATOR_AGENT_SYSTEM_PROMPT = """
+configure_logging(config.log_level)
+logger = logging.getLogger("negotiation")
+if env_file:
+    logger.info(f"Loaded environment from {env_file}")
+else:
+    tried = ", ".join(str(path) for path in env_file_candidates(os.environ))
+    logger.warning(f"No .env file found (tried {tried}), using the environment only")
+
+DEFAULT_PAGE_LIMIT = 50
+MAX_PAGE_LIMIT = 500
+
+NEGOTIATOR_AGENT_SYSTEM_PROMPT = (
+    config.negotiation_system_prompt
+    or """
 You are a skilled negotation agent representing a buyer in a procurment process. Your goal is to win the best possible deal for the
 the company. While your are negotiating an Supervisor agent is monetoring your progress and giving you new 
 instructions every new step of the negotiation. Follow their instructions carefully and adapt your strategy accordingly
 Further instructions might be provided following this. Make sure to follow them closely.
 """
+)
+# Per-request overrides are capped so a pasted document can't blow up every prompt
+MAX_SYSTEM_PROMPT_LENGTH = 4000
 
 OCHESTRATOR_AGENT_SYSTEM_PROMPT = """
 Your are a negotiationg orchestration agent. The company you are are working for is looking to procure a product. Your goal is to 
@@ -51,16 +145,50 @@ competing offer from another supplier that your agents are alo negotiating with.
 If you see during your anaylsis that one of the suppliers has made a final offer. Mark the negotiation as complete;
 """
 
-bedrock_client = boto3.client("bedrock-runtime", region_name=AWS_REGION)
+aws = aws_session(config.aws_region, config.aws_profile)
+# Raises AssumeRoleError, aborting startup, if the role can't be assumed
+bedrock_aws = aws_session(
+    config.aws_region, config.aws_profile, config.bedrock_assume_role_arn
+)
+# The read timeout also stops the worker threads behind timed-out calls.
+# invoke_model_with_retry does the retrying, so botocore makes one attempt.
+bedrock_runtime_config = BotoConfig(
+    read_timeout=config.bedrock_timeout_seconds,
+    retries={"mode": "standard", "total_max_attempts": 1},
+)
+bedrock_regions: list[tuple[str, BedrockInvoker]] = [
+    (
+        config.aws_region,
+        bedrock_aws.client("bedrock-runtime", config=bedrock_runtime_config),
+    )
+]
+if config.bedrock_fallback_region:
+    bedrock_regions.append(
+        (
+            config.bedrock_fallback_region,
+            aws_session(
+                config.bedrock_fallback_region,
+                config.aws_profile,
+                config.bedrock_assume_role_arn,
+            ).client("bedrock-runtime", config=bedrock_runtime_config),
+        )
+    )
+# Every Bedrock call goes through this, so tests swap in a fake BedrockInvoker
+bedrock_client: BedrockInvoker = RegionalBedrockClient(bedrock_regions)
+# Guardrails are created per region, so checks always use the primary one
+bedrock_guardrail_client = bedrock_regions[0][1]
+bedrock_breaker.failure_threshold = config.bedrock_breaker_failures
+bedrock_breaker.reset_timeout = config.bedrock_breaker_reset_seconds
+s3_client = aws.client("s3")
+# Control-plane client, only used to check which models the region offers
+bedrock_catalog_client = bedrock_aws.client("bedrock")
 
 pool: asyncpg.Pool | None = None
 # --- Initialize Email Client ---
 email_client = EmailClient()
 email_router = EmailEventRouter()
 active_sessions: dict[str, NegotiationSession] = {}
-
-EMAIL_ADDRESS = os.environ.get("EMAIL_USER")
-EMAIL_PASSWORD = os.environ.get("EMAIL_PASSWORD")
+jobs = JobRegistry()
 
 
 def _clean_snippet(text: str | None, limit: int = 220) -> str | None:
@@ -202,14 +330,16 @@ Context:
     }
 
     try:
-        response = bedrock_client.invoke_model(
-            modelId="openai.gpt-oss-120b-1:0",
+        response = await invoke_model_with_retry(
+            bedrock_client,
+            timeout=config.bedrock_timeout_seconds,
+            modelId=config.default_bedrock_model,
             contentType="application/json",
             accept="application/json",
             body=json.dumps(body),
         )
-        result = json.loads(response["body"].read())
-        overview_text = result["choices"][0]["message"]["content"]
+        overview_text, usage = parse_completion(response["body"].read())
+        log_token_usage(usage, config.default_bedrock_model)
         overview_text = strip_reasoning_tokens(overview_text)
         return overview_text.strip()
     except Exception as exc:  # pragma: no cover - best effort
@@ -224,14 +354,14 @@ async def email_watcher():
     import re
 
     logger.info("Starting email watcher task...")
-    logger.info(f"Email client logged in: {email_client.email_address is not None}")
-    logger.info(f"Active sessions count: {len(active_sessions)}")
+    logger.debug(f"Email client logged in: {email_client.email_address is not None}")
+    logger.debug(f"Active sessions count: {len(active_sessions)}")
 
     try:
-        logger.info("Starting email_trigger generator...")
+        logger.debug("Starting email_trigger generator...")
         async for email_data in email_client.email_trigger():
-            logger.info("=" * 50)
-            logger.info("EMAIL WATCHER: Received email from email_trigger")
+            logger.debug("=" * 50)
+            logger.debug("EMAIL WATCHER: Received email from email_trigger")
             logger.info(
                 f"New email received from: {email_data['sender']}, subject: {email_data['subject']}"
             )
@@ -316,7 +446,7 @@ async def email_watcher():
 
             # Fallback: find any active negotiation for this supplier
             if not ng_id and supplier_id:
-                logger.info("No ng_id in subject, searching active sessions...")
+                logger.debug("No ng_id in subject, searching active sessions...")
                 for session_ng_id, session in active_sessions.items():
                     if supplier_id in session._agents:
                         ng_id = session_ng_id
@@ -343,10 +473,10 @@ async def email_watcher():
                 ng_id=ng_id,
                 raw=email_data,
             )
-            logger.info(f"Pushing event to email_router...")
+            logger.debug(f"Pushing event to email_router...")
             await email_router.push(event)
-            logger.info(f"Event pushed successfully")
-            logger.info("=" * 50)
+            logger.debug(f"Event pushed successfully")
+            logger.debug("=" * 50)
 
     except asyncio.CancelledError:
         logger.info("Email watcher cancelled")
@@ -357,18 +487,65 @@ async def email_watcher():
 email_watcher_task: asyncio.Task | None = None
 
 
+async def _connect_db_with_retry(config: Config) -> asyncpg.Pool:
+    """Create the pool and ping it, retrying while Postgres is still starting."""
+    attempts = config.db_connect_retries
+    delay = config.db_connect_retry_delay
+    logger.debug(
+        f"Database pool settings: min_size={config.db_min_conns}, "
+        f"max_size={config.db_max_conns}, "
+        f"max_inactive_connection_lifetime={config.db_max_conn_idle_time}s, "
+        f"max_queries={config.db_max_queries}, "
+        f"command_timeout={config.db_command_timeout}s, "
+        f"slow_query_ms={config.slow_query_ms}"
+    )
+    slow_query_logger = (
+        SlowQueryLogger(config.slow_query_ms) if config.slow_query_ms else None
+    )
+    for attempt in range(1, attempts + 1):
+        try:
+            logger.debug(f"Connecting to database (attempt {attempt}/{attempts})...")
+            db = await asyncpg.create_pool(
+                config.database_url,
+                statement_cache_size=0,
+                command_timeout=config.db_command_timeout,
+                min_size=config.db_min_conns,
+                max_size=config.db_max_conns,
+                max_inactive_connection_lifetime=config.db_max_conn_idle_time,
+                max_queries=config.db_max_queries,
+                init=slow_query_logger.install if slow_query_logger else None,
+            )
+            await db.fetchval("SELECT 1")
+            return db
+        except Exception as e:
+            if attempt == attempts:
+                raise RuntimeError(
+                    f"Could not connect to database after {attempts} attempts: {e}"
+                ) from e
+            logger.warning(f"Database not ready ({e}), retrying in {delay}s")
+            await asyncio.sleep(delay)
+    raise RuntimeError("DB_CONNECT_RETRIES must be at least 1")
+
+
 @asynccontextmanager
 async def lifespan(app: FastAPI):
     global pool, email_watcher_task
     logger.info("Starting application...")
-    pool = await asyncpg.create_pool(DATABASE_URL, statement_cache_size=0)
+    logger.info(f"Enabled features: {', '.join(sorted(config.features)) or 'none'}")
+    if config.enable_pprof:
+        start_heap_tracing()
+        logger.warning("Profiling enabled at /debug/pprof")
+    pool = await _connect_db_with_retry(config)
     logger.info("Database pool created")
+    if config.run_migrations:
+        # Raises MigrationError and aborts startup if any migration fails
+        await apply_migrations(pool)
 
     # Login email client if credentials are provided
-    if EMAIL_ADDRESS and EMAIL_PASSWORD:
+    if config.email_user and config.email_password:
         try:
-            logger.info(f"Logging in email client as {EMAIL_ADDRESS}...")
-            await email_client.email_login(EMAIL_ADDRESS, EMAIL_PASSWORD)
+            logger.info(f"Logging in email client as {config.email_user}...")
+            await email_client.email_login(config.email_user, config.email_password)
             logger.info("Email client logged in successfully")
 
             # Start email watcher background task
@@ -384,6 +561,7 @@ async def lifespan(app: FastAPI):
     yield
 
     logger.info("Shutting down...")
+    await jobs.shutdown()
     if email_watcher_task:
         email_watcher_task.cancel()
         try:
@@ -394,13 +572,90 @@ async def lifespan(app: FastAPI):
     if pool:
         await pool.close()
         logger.info("Database pool closed")
+    if tracer_provider:
+        # Flush spans still queued in the batch processor
+        tracer_provider.shutdown()
+
+
+logger.info(f"Running in {config.app_env} mode (debug={config.debug})")
+
+# Probes must keep working without credentials
+api_key_auth = APIKeyAuth(
+    set(config.api_keys),
+    exempt_paths={"/health", "/ready", "/version"},
+    admin_keys=set(config.admin_api_keys),
+)
+
+app = FastAPI(
+    title="Negotiation API",
+    description="Suppliers, products and LLM-driven supplier negotiations.",
+    version="0.1.0",
+    # The interactive UI; the spec itself is served at /openapi.json
+    docs_url="/swagger",
+    lifespan=lifespan,
+    debug=config.debug,
+    dependencies=[Depends(api_key_auth)],
+)
+
+tracer_provider = configure_tracing(
+    app, config.otel_endpoint, config.otel_service_name
+)
+
+allowed_origins = list(config.allowed_origins)
+if not allowed_origins:
+    logger.warning("ALLOWED_ORIGINS not set - allowing requests from any origin")
+    allowed_origins = ["*"]
+# Routes that call Bedrock get a much tighter budget than read-only endpoints
+LLM_ROUTE_PATTERN = re.compile(
+    r"^/(negotiate|negotiations/(compare|validate)|test/stream"
+    r"|negotiation_overview/[^/]+|suppliers/[^/]+/insights|suppliers/duplicates)$"
+)
+
+
+def _is_llm_request(request: Request) -> bool:
+    # Reading stored insights is a plain lookup; only generating them calls Bedrock
+    if request.method == "GET" and request.url.path.endswith("/insights"):
+        return False
+    return bool(LLM_ROUTE_PATTERN.match(request.url.path))
 
 
-app = FastAPI(title="Health API", version="0.1.0", lifespan=lifespan)
+rate_limiter = RateLimiter(rate=config.rate_limit_rps, burst=config.rate_limit_burst)
+llm_rate_limiter = RateLimiter(
+    rate=config.rate_limit_llm_rps, burst=config.rate_limit_llm_burst
+)
 
-allowed_origins = [
-    origin.strip() for origin in FRONTEND_ORIGINS.split(",") if origin.strip()
-] or ["*"]
+# Innermost, so the request ID is still set and the 500 is counted and logged
+app.middleware("http")(recovery_middleware)
+if config.log_level <= logging.DEBUG:
+    # Sees the body as the handler reads it, inside the request ID context
+    app.add_middleware(DebugBodyLogMiddleware)
+# Caps prompts and other payloads before they reach handlers (or Bedrock)
+app.add_middleware(
+    BodySizeLimitMiddleware,
+    max_bytes=config.max_body_bytes,
+    # Leave headroom for the multipart envelope around the image itself
+    route_limits=[
+        (re.compile(r"^/suppliers/[^/]+/image$"), config.max_image_bytes + 64 * 1024)
+    ],
+)
+# Write bodies must be JSON, apart from the routes that take uploads or CSV
+app.add_middleware(
+    JSONContentTypeMiddleware,
+    route_types=[
+        (re.compile(r"^/suppliers/[^/]+/image$"), frozenset({"multipart/form-data"})),
+        (re.compile(r"^/products/bulk$"), frozenset({"application/json", "text/csv"})),
+    ],
+)
+app.middleware("http")(
+    make_rate_limit_middleware(
+        rate_limiter,
+        llm_rate_limiter,
+        _is_llm_request,
+    )
+)
+app.middleware("http")(metrics_middleware)
+app.middleware("http")(request_context_middleware)
+app.add_middleware(GZipMiddleware, minimum_size=config.gzip_min_bytes)
 app.add_middleware(
     CORSMiddleware,
     allow_origins=allowed_origins,
@@ -408,6 +663,108 @@ app.add_middleware(
     allow_methods=["*"],
     allow_headers=["*"],
 )
+# Outermost, so rate limiting and access logs see the resolved client IP
+app.add_middleware(ProxyHeadersMiddleware, trusted=config.trusted_proxies)
+
+
+@app.exception_handler(StarletteHTTPException)
+async def route_not_found_handler(request: Request, exc: StarletteHTTPException):
+    # The router raises these with Starlette's default detail when no route or
+    # method matches; endpoints raising their own 404s keep their message.
+    if (exc.status_code, exc.detail) in (
+        (404, "Not Found"),
+        (405, "Method Not Allowed"),
+    ):
+        return JSONResponse(
+            status_code=exc.status_code,
+            content={
+                **error_body(exc.status_code, exc.detail.lower()),
+                "path": request.url.path,
+            },
+            headers=exc.headers,
+        )
+    return JSONResponse(
+        status_code=exc.status_code,
+        content=error_body(exc.status_code, exc.detail),
+        headers=exc.headers,
+    )
+
+
+@app.exception_handler(APIError)
+async def api_error_handler(request: Request, exc: APIError):
+    if exc.internal:
+        level = logging.ERROR if exc.status_code >= 500 else logging.WARNING
+        logger.log(
+            level,
+            f"{request.method} {request.url.path} failed ({exc.code}): {exc.internal}",
+        )
+    return JSONResponse(
+        status_code=exc.status_code, content=exc.body(), headers=exc.headers
+    )
+
+
+@app.exception_handler(asyncpg.PostgresError)
+@app.exception_handler(asyncpg.InterfaceError)
+async def database_error_handler(request: Request, exc: Exception):
+    # Raw asyncpg messages name tables and constraints; only the code gets out
+    return await api_error_handler(request, from_db_error(exc))
+
+
+# Where a value came from is implied by the endpoint, so it isn't part of the field
+VALIDATION_LOCATIONS = {"body", "query", "path", "header", "cookie"}
+
+
+def _field_errors(errors: Iterable[dict[str, Any]]) -> list[dict[str, str]]:
+    """Flatten pydantic errors into {"field", "message"} pairs for form mapping."""
+    result = []
+    for error in errors:
+        loc = [str(part) for part in error["loc"]]
+        if loc and loc[0] in VALIDATION_LOCATIONS:
+            loc = loc[1:]
+        if error["type"] == "json_invalid":
+            # loc holds the character offset of the syntax error, not a field
+            field, message = "body", "must be valid JSON"
+        elif error["type"] == "missing":
+            field, message = ".".join(loc), "is required"
+        elif error["type"] == "value_error":
+            # Raised by our own validators; drop pydantic's "Value error, " prefix
+            message = str(error.get("ctx", {}).get("error") or error["msg"])
+            field = ".".join(loc) or "body"
+        else:
+            field, message = ".".join(loc) or "body", error["msg"]
+        result.append({"field": field, "message": message})
+    return result
+
+
+@app.exception_handler(RequestValidationError)
+async def validation_exception_handler(request: Request, exc: RequestValidationError):
+    return JSONResponse(
+        status_code=400,
+        content={
+            **error_body(400, "invalid request"),
+            "errors": _field_errors(exc.errors()),
+        },
+    )
+
+
+@app.exception_handler(BedrockTimeoutError)
+async def bedrock_timeout_handler(request: Request, exc: BedrockTimeoutError):
+    return JSONResponse(status_code=504, content=error_body(504, str(exc)))
+
+
+@app.exception_handler(BedrockUnavailableError)
+async def bedrock_unavailable_handler(request: Request, exc: BedrockUnavailableError):
+    return JSONResponse(
+        status_code=503,
+        content=error_body(503, str(exc)),
+        headers={"Retry-After": str(math.ceil(exc.retry_after))},
+    )
+
+
+@app.exception_handler(asyncio.TimeoutError)
+async def timeout_exception_handler(request: Request, exc: asyncio.TimeoutError):
+    logger.warning(f"Request timed out: {request.method} {request.url.path}")
+    return JSONResponse(status_code=504, content=error_body(504, "Request timed out"))
 
 
 async def get_pool() -> asyncpg.Pool:
@@ -416,224 +773,2681 @@ async def get_pool() -> asyncpg.Pool:
     return pool
 
 
+async def get_store() -> Store:
+    """Handler dependency; tests can override it with a fake Store."""
+    return PgStore(await get_pool())
+
+
+def require_feature(name: str) -> Callable[[], None]:
+    """
+    Route dependency for experimental endpoints. While FEATURE_<NAME> is off
+    the route answers exactly like one that doesn't exist.
+    """
+
+    def check() -> None:
+        if name not in config.features:
+            raise HTTPException(status_code=404)
+
+    return check
+
+
 @app.get("/health")
 async def health_check() -> dict[str, str]:
     return {"status": "ok"}
 
 
-@app.get("/suppliers")
-async def list_suppliers() -> list[dict[str, Any]]:
-    db = await get_pool()
-    rows = await db.fetch("SELECT * FROM supplier")
-    return [dict(row) for row in rows]
+@app.get("/version")
+async def version() -> dict[str, str]:
+    return {
+        "version": config.version,
+        "commit": config.commit,
+        "build_time": config.build_time,
+    }
 
 
-@app.get("/products")
-async def list_products() -> list[dict[str, Any]]:
-    db = await get_pool()
-    rows = await db.fetch("SELECT * FROM product")
-    return [dict(row) for row in rows]
+def _set_link_header(
+    request: Request, response: Response, limit: int, offset: int, total: int
+) -> None:
+    """
+    RFC 8288 Link header with first/prev/next/last pages, built from the
+    request URL so other query parameters (filters, sort) carry over.
+    """
+    if limit <= 0:
+        return
+    last = max(0, (total - 1) // limit * limit)
+    pages = {"first": 0, "last": last}
+    if offset > 0:
+        pages["prev"] = max(0, min(offset - limit, last))
+    if offset + limit < total:
+        pages["next"] = offset + limit
+    response.headers["Link"] = ", ".join(
+        f'<{request.url.include_query_params(limit=limit, offset=page_offset)}>; '
+        f'rel="{rel}"'
+        for rel, page_offset in pages.items()
+    )
 
 
-@app.get("/search")
-async def search_items(product: str) -> list[dict[str, Any]]:
-    db = await get_pool()
-    rows = await db.fetch(
-        "SELECT * FROM product WHERE product_name ILIKE $1", f"%{product}%"
+# Clients revalidate every time (no-cache) so a write shows up on their next
+# request; the ETag turns an unchanged list into an empty 304
+LIST_CACHE_CONTROL = "private, no-cache"
+
+list_cache = ListCache(config.cache_ttl_seconds)
+
+
+def _list_cache_key(request: Request) -> str:
+    return f"{request.url.path}?{sorted(request.query_params.multi_items())}"
+
+
+def _list_response(
+    request: Request, response: Response, entry: CacheEntry
+) -> dict[str, Any] | Response:
+    headers = {
+        **entry.headers,
+        "ETag": entry.etag,
+        "Cache-Control": LIST_CACHE_CONTROL,
+    }
+    if etag_matches(request.headers.get("If-None-Match"), entry.etag):
+        return Response(status_code=304, headers=headers)
+    response.headers.update(headers)
+    return entry.body
+
+
+def _cached_list(
+    request: Request, response: Response
+) -> dict[str, Any] | Response | None:
+    """The cached list for this URL, or None on a miss."""
+    entry = list_cache.get(_list_cache_key(request))
+    if entry is None:
+        return None
+    return _list_response(request, response, entry)
+
+
+def _cache_list(
+    request: Request, response: Response, body: dict[str, Any]
+) -> dict[str, Any] | Response:
+    link = response.headers.get("Link")
+    entry = list_cache.set(
+        _list_cache_key(request), body, {"Link": link} if link else None
     )
-    return [dict(row) for row in rows]
+    return _list_response(request, response, entry)
 
 
-def call_bedrock(prompt: str, system_prompt: str = "") -> str:
-    """Call Amazon Bedrock gpt-oss-120b model and return response text."""
-    messages = [{"role": "user", "content": prompt}]
-    if system_prompt:
-        messages.insert(0, {"role": "system", "content": system_prompt})
+def _parse_pagination(
+    limit: str | None, offset: str | None
+) -> tuple[int, int, str | None]:
+    """
+    Validate raw limit/offset query values, rejecting bad input with a 400.
+    A missing or zero limit means the default; one above MAX_PAGE_LIMIT is
+    clamped, and the returned warning (otherwise None) says so for the body.
+    """
+    try:
+        parsed_limit = int(limit) if limit is not None else 0
+        parsed_offset = int(offset) if offset is not None else 0
+    except ValueError:
+        raise HTTPException(
+            status_code=400, detail="limit and offset must be integers"
+        )
+    if parsed_limit < 0 or parsed_offset < 0:
+        raise HTTPException(
+            status_code=400, detail="limit and offset must not be negative"
+        )
+    if parsed_limit == 0:
+        return DEFAULT_PAGE_LIMIT, parsed_offset, None
+    if parsed_limit > MAX_PAGE_LIMIT:
+        warning = f"limit {parsed_limit} exceeds the maximum, using {MAX_PAGE_LIMIT}"
+        return MAX_PAGE_LIMIT, parsed_offset, warning
+    return parsed_limit, parsed_offset, None
 
-    body = {
-        "messages": messages,
-        "max_tokens": 1024,
-        "temperature": 0.7,
+
+async def _check_database() -> dict[str, Any]:
+    start = time.perf_counter()
+    try:
+        db = await get_pool()
+        await db.fetchval("SELECT 1")
+        status = "ok"
+    except Exception as e:
+        # /ready is unauthenticated, so the cause only goes to the logs
+        logger.error(f"Readiness check: database unavailable: {e}")
+        status = "error"
+    return {
+        "status": status,
+        "latency_ms": round((time.perf_counter() - start) * 1000, 2),
     }
 
+
+async def _check_bedrock_model() -> dict[str, Any]:
+    # A metadata lookup fails on the same wrong-region / missing-IAM setups as
+    # an invoke would, without spending tokens on every probe
+    start = time.perf_counter()
     try:
-        response = bedrock_client.invoke_model(
-            modelId="openai.gpt-oss-120b-1:0",
-            contentType="application/json",
-            accept="application/json",
-            body=json.dumps(body),
+        await asyncio.wait_for(
+            asyncio.to_thread(
+                bedrock_catalog_client.get_foundation_model,
+                modelIdentifier=config.default_bedrock_model,
+            ),
+            5,
         )
+        status = "ok"
     except Exception as e:
-        return f"Bedrock service is currently unavailable. {e}"
+        logger.error(
+            "Readiness check: Bedrock model unavailable: "
+            f"{str(e) or type(e).__name__}"
+        )
+        status = "error"
+    return {
+        "status": status,
+        "latency_ms": round((time.perf_counter() - start) * 1000, 2),
+    }
 
-    result = json.loads(response["body"].read())
-    return result["choices"][0]["message"]["content"]
 
+def _check_bedrock() -> dict[str, Any]:
+    state = bedrock_breaker.state
+    return {"status": "ok" if state == "closed" else "degraded", "state": state}
 
-# FIXED SYNTAX ERROR HERE
-async def crate_negotiation_agent(supplier_id: str, tactics: str, product: str) -> str:
-    db = await get_pool()
-    row = await db.fetch(
-        "SELECT * FROM supplier WHERE supplier_name = $1 LIMIT 1", supplier_id
-    )
-    if not row:
-        return ""
-    insights = row[0]["insights"]
-    prompt = f"""
-    Negotiate for {product} with tactics {tactics}. Insights: {insights}
-    """
-    return prompt
 
+@app.get("/metrics")
+async def metrics() -> Response:
+    return metrics_response()
 
-# --- NEW EMAIL ENDPOINTS ---
 
+@app.get("/ready")
+async def readiness_check() -> JSONResponse:
+    checks = {"database": await _check_database()}
+    if config.ready_check_bedrock:
+        checks["bedrock_model"] = await _check_bedrock_model()
+    ready = all(check["status"] == "ok" for check in checks.values())
+    # An open Bedrock breaker only affects LLM routes, which already fail fast
+    # with 503, so it's reported but doesn't take the instance out of rotation
+    checks["bedrock"] = _check_bedrock()
+    return JSONResponse(
+        status_code=200 if ready else 503,
+        content={"status": "ok" if ready else "unavailable", "checks": checks},
+    )
 
-class LoginRequest(BaseModel):
-    email: str
-    password: str
 
+# Response shapes for the OpenAPI spec only. Handlers keep returning plain
+# dicts, so columns added to these tables are passed through, not dropped.
+class Supplier(BaseModel):
+    supplier_id: str
+    supplier_name: str | None = None
+    supplier_email: str | None = None
+    description: str
+    insights: str | None = None
+    # JSON text; GET /suppliers/{id}/insights returns it decoded
+    insights_structured: str | None = None
+    image_url: str | None = None
+    tags: list[str] = []
+    deleted_at: datetime | None = None
+    created_at: datetime | None = None
+    updated_at: datetime | None = None
+
+
+class Product(BaseModel):
+    product_id: str
+    product_name: str
+    supplier_id: str
+    supplier_name: str
+    price: Decimal | None = None
+    currency: str | None = None
+    created_at: datetime | None = None
+    updated_at: datetime | None = None
+
+
+class ProductSupplier(BaseModel):
+    supplier_id: str
+    supplier_name: str | None = None
+    description: str
+    image_url: str | None = None
+
+
+class ProductDetail(BaseModel):
+    product_id: str
+    product_name: str
+    price: Decimal | None = None
+    currency: str | None = None
+    created_at: datetime | None = None
+    updated_at: datetime | None = None
+    supplier: ProductSupplier
+
+
+T = TypeVar("T")
+
+
+class Page(BaseModel, Generic[T]):
+    data: list[T]
+    limit: int
+    offset: int
+    total: int
+
+
+class CursorPage(BaseModel, Generic[T]):
+    data: list[T]
+    limit: int
+    next_cursor: str | None = None
+
+
+def require_admin_for_deleted(request: Request, include_deleted: bool = False) -> None:
+    """Soft-deleted records are kept for audits; only admin keys may read them."""
+    if include_deleted and not api_key_auth.is_admin(request):
+        raise HTTPException(
+            status_code=403, detail="include_deleted requires an admin API key"
+        )
 
-@app.post("/email/login")
-async def email_login_endpoint(creds: LoginRequest):
-    """
-    Exposed endpoint for frontend to log in the email client.
-    """
+
+@app.get(
+    "/suppliers",
+    response_model=None,
+    responses={200: {"model": Page[Supplier]}},
+    dependencies=[Depends(require_admin_for_deleted)],
+)
+async def list_suppliers(
+    request: Request,
+    response: Response,
+    limit: Optional[str] = None,
+    offset: Optional[str] = None,
+    include_deleted: bool = False,
+    tag: Optional[str] = None,
+    sort: Optional[str] = None,
+    created_after: Optional[str] = None,
+    store: Store = Depends(get_store),
+) -> dict[str, Any] | Response:
+    cached = _cached_list(request, response)
+    if cached is not None:
+        return cached
+    page_limit, page_offset, warning = _parse_pagination(limit, offset)
     try:
-        await email_client.email_login(creds.email, creds.password)
-        return {"status": "success", "message": "Logged in successfully"}
-    except Exception as e:
+        rows, total = await store.list_suppliers(
+            page_limit,
+            page_offset,
+            include_deleted=include_deleted,
+            tag=_normalize_tag(tag) if tag is not None else None,
+            sort=sort or "supplier_id",
+            created_after=_parse_created_after(created_after),
+        )
+    except ValueError as e:
         raise HTTPException(status_code=400, detail=str(e))
+    _set_link_header(request, response, page_limit, page_offset, total)
+    return _cache_list(
+        request,
+        response,
+        {
+            "data": rows,
+            "limit": page_limit,
+            **({"warning": warning} if warning else {}),
+            "offset": page_offset,
+            "total": total,
+        },
+    )
 
 
-class SendEmailRequest(BaseModel):
-    to_email: str
-    subject: str
-    body: str
+class SupplierCreate(BaseModel):
+    description: str
+    supplier_id: str | None = None
+    supplier_name: str | None = None
+    supplier_email: str | None = None
+    insights: str | None = None
+    image_url: str | None = None
 
 
-@app.post("/email/send")
-async def email_send_endpoint(req: SendEmailRequest):
-    """
-    Exposed endpoint to send emails using logged in credentials.
-    """
+@app.post("/suppliers", status_code=201, responses={201: {"model": Supplier}})
+async def create_supplier(supplier: SupplierCreate) -> dict[str, Any]:
+    if not supplier.description.strip():
+        raise HTTPException(status_code=400, detail="description must not be empty")
+
+    db = await get_pool()
     try:
-        await email_client.email_send(req.to_email, req.subject, req.body)
-        return {"status": "success"}
-    except Exception as e:
-        raise HTTPException(status_code=500, detail=str(e))
+        row = await db.fetchrow(
+            """
+            INSERT INTO supplier
+                (supplier_id, supplier_name, supplier_email, description, insights, image_url)
+            VALUES (COALESCE($1::uuid, gen_random_uuid()), $2, $3, $4, $5, $6)
+            RETURNING *
+            """,
+            supplier.supplier_id,
+            supplier.supplier_name,
+            supplier.supplier_email,
+            supplier.description,
+            supplier.insights,
+            supplier.image_url,
+        )
+    except asyncpg.UniqueViolationError:
+        raise HTTPException(status_code=409, detail="supplier already exists")
+    except asyncpg.DataError:
+        raise HTTPException(status_code=400, detail="supplier_id must be a UUID")
+    list_cache.clear()
+    return dict(row)
+
+
+class SupplierUpdate(BaseModel):
+    supplier_name: str | None = None
+    supplier_email: str | None = None
+    description: str | None = None
+    insights: str | None = None
+    image_url: str | None = None
+
+
+@app.patch("/suppliers/{supplier_id}", responses={200: {"model": Supplier}})
+async def update_supplier(supplier_id: str, update: SupplierUpdate) -> dict[str, Any]:
+    supplier_id = _normalize_id(supplier_id)
+    # Only fields present in the body are touched; an explicit null clears the column
+    fields = update.model_dump(exclude_unset=True)
+    if not fields:
+        raise HTTPException(status_code=400, detail="no fields to update")
+    if "description" in fields and not (fields["description"] or "").strip():
+        raise HTTPException(status_code=400, detail="description must not be empty")
+
+    assignments = ", ".join(
+        f"{column} = ${index}" for index, column in enumerate(fields, start=1)
+    )
+    db = await get_pool()
+    try:
+        row = await db.fetchrow(
+            f"""
+            UPDATE supplier SET {assignments}
+            WHERE supplier_id = ${len(fields) + 1} AND deleted_at IS NULL
+            RETURNING *
+            """,
+            *fields.values(),
+            supplier_id,
+        )
+    except asyncpg.DataError:
+        row = None
+    if not row:
+        raise HTTPException(status_code=404, detail="supplier not found")
+    list_cache.clear()
+    return dict(row)
 
 
-# ---------------------------
+MAX_TAG_LENGTH = 50
+MAX_TAGS_PER_REQUEST = 20
 
 
-class NegotiationRequest(BaseModel):
-    product: str
-    prompt: str
-    tactics: str
-    suppliers: list[str]
+def _normalize_tag(tag: str) -> str:
+    """Tags are compared case-insensitively, so they're stored lowercased."""
+    normalized = " ".join(tag.split()).lower()
+    if not normalized:
+        raise HTTPException(status_code=400, detail="tag must not be empty")
+    if len(normalized) > MAX_TAG_LENGTH:
+        raise HTTPException(
+            status_code=400, detail=f"tag must be at most {MAX_TAG_LENGTH} characters"
+        )
+    return normalized
 
 
-@app.post("/negotiate")
-async def trigger_negotiations(request: NegotiationRequest) -> dict[str, Any]:
-    logger.info(f"Starting negotiation for product: {request.product}")
-    logger.info(f"Suppliers: {request.suppliers}")
-    logger.info(f"Tactics: {request.tactics}")
+class SupplierTags(BaseModel):
+    tags: list[str] = Field(min_length=1, max_length=MAX_TAGS_PER_REQUEST)
 
+
+@app.post("/suppliers/{supplier_id}/tags")
+async def add_supplier_tags(supplier_id: str, body: SupplierTags) -> dict[str, Any]:
+    """Add tags to a supplier; tags it already has are left as they are."""
+    supplier_id = _normalize_id(supplier_id)
+    tags = [_normalize_tag(tag) for tag in body.tags]
     db = await get_pool()
+    try:
+        row = await db.fetchrow(
+            """
+            UPDATE supplier
+            SET tags = ARRAY(
+                SELECT DISTINCT tag FROM unnest(tags || $1::text[]) AS tag ORDER BY tag
+            )
+            WHERE supplier_id = $2 AND deleted_at IS NULL
+            RETURNING tags
+            """,
+            tags,
+            supplier_id,
+        )
+    except asyncpg.DataError:
+        row = None
+    if not row:
+        raise HTTPException(status_code=404, detail="supplier not found")
+    list_cache.clear()
+    return {"supplier_id": supplier_id, "tags": list(row["tags"])}
 
-    ng_id = str(uuid.uuid4())
-    logger.info(f"Created negotiation ID: {ng_id}")
 
-    # Save negotiation to DB
-    await db.execute(
-        """
-        INSERT INTO negotiation (ng_id, product, strategy, status)
-        VALUES ($1, $2, $3, 'active')
-        """,
-        ng_id,
-        request.product,
-        request.tactics,
-    )
-    logger.info("Negotiation saved to database")
+@app.delete("/suppliers/{supplier_id}/tags/{tag}")
+async def remove_supplier_tag(supplier_id: str, tag: str) -> dict[str, Any]:
+    """Remove a tag; removing one the supplier doesn't have is a no-op."""
+    supplier_id = _normalize_id(supplier_id)
+    db = await get_pool()
+    try:
+        row = await db.fetchrow(
+            """
+            UPDATE supplier SET tags = array_remove(tags, $1)
+            WHERE supplier_id = $2 AND deleted_at IS NULL
+            RETURNING tags
+            """,
+            _normalize_tag(tag),
+            supplier_id,
+        )
+    except asyncpg.DataError:
+        row = None
+    if not row:
+        raise HTTPException(status_code=404, detail="supplier not found")
+    list_cache.clear()
+    return {"supplier_id": supplier_id, "tags": list(row["tags"])}
+
+
+# Declared before /suppliers/{supplier_id} so "search" isn't taken as an ID
+@app.get("/suppliers/search", responses={200: {"model": Page[Supplier]}})
+async def search_suppliers(
+    request: Request,
+    response: Response,
+    q: Optional[str] = None,
+    limit: Optional[str] = None,
+    offset: Optional[str] = None,
+) -> dict[str, Any]:
+    term = (q or "").strip()
+    if not term:
+        raise HTTPException(status_code=400, detail="q must not be empty")
+    if len(term) > MAX_SEARCH_QUERY_LENGTH:
+        raise HTTPException(
+            status_code=400,
+            detail=f"q must be at most {MAX_SEARCH_QUERY_LENGTH} characters",
+        )
+    page_limit, page_offset, warning = _parse_pagination(limit, offset)
 
-    orchestrator = OrchestratorAgent(
-        client=bedrock_client,
-        strategy=request.tactics,
-        product=request.product,
-        sys_promt=OCHESTRATOR_AGENT_SYSTEM_PROMPT,
-        db_pool=db,
-        ng_id=ng_id,
+    match = (
+        "deleted_at IS NULL AND "
+        "to_tsvector('english', description) @@ plainto_tsquery('english', $1)"
     )
-    logger.info("Orchestrator agent created")
+    db = await get_pool()
+    # As in /search, the window count covers every match without a second scan
+    rows = await with_db_retry(
+        lambda: db.fetch(
+            f"""
+            SELECT *, COUNT(*) OVER () AS total_count
+            FROM supplier
+            WHERE {match}
+            ORDER BY ts_rank(
+                to_tsvector('english', description), plainto_tsquery('english', $1)
+            ) DESC, supplier_name
+            LIMIT $2 OFFSET $3
+            """,
+            term,
+            page_limit,
+            page_offset,
+        )
+    )
+    if rows:
+        total = rows[0]["total_count"]
+    elif page_offset:
+        # Past the last page no row carries the count
+        total = await with_db_retry(
+            lambda: db.fetchval(f"SELECT COUNT(*) FROM supplier WHERE {match}", term)
+        )
+    else:
+        total = 0
+    data = [dict(row) for row in rows]
+    for supplier in data:
+        del supplier["total_count"]
+    _set_link_header(request, response, page_limit, page_offset, total)
+    return {
+        "data": data,
+        "limit": page_limit,
+        **({"warning": warning} if warning else {}),
+        "offset": page_offset,
+        "total": total,
+    }
 
-    # Create a session to manage this negotiation
-    session = NegotiationSession(
-        db_pool=db,
-        client=bedrock_client,
-        ng_id=ng_id,
-        orchestrator=orchestrator,
-        router=email_router,
+
+async def _embed_text(text: str) -> list[float]:
+    response = await invoke_model_with_retry(
+        bedrock_client,
+        timeout=config.bedrock_timeout_seconds,
+        modelId=config.embedding_model,
+        contentType="application/json",
+        accept="application/json",
+        body=json.dumps({"inputText": text}),
     )
-    logger.info("Negotiation session created")
+    return parse_embedding(response["body"].read())
 
-    for supplier in request.suppliers:
-        logger.info(f"Processing supplier: {supplier}")
 
-        # Fetch supplier info from DB
-        supplier_row = await db.fetchrow(
-            "SELECT supplier_name, supplier_email, description, insights FROM supplier WHERE supplier_id = $1",
-            supplier,
-        )
-        if not supplier_row:
-            logger.warning(f"Supplier {supplier} not found in database, skipping")
+async def _supplier_embeddings(
+    db: asyncpg.Pool, suppliers: list[asyncpg.Record]
+) -> dict[str, list[float]]:
+    """
+    Description embeddings by supplier id, embedding only the descriptions
+    that changed since they were stored. Blank descriptions are skipped.
+    """
+    embeddings: dict[str, list[float]] = {}
+    stale: list[tuple[str, str, str]] = []
+    for supplier in suppliers:
+        supplier_id = str(supplier["supplier_id"])
+        description = (supplier["description"] or "").strip()
+        if not description:
             continue
+        key = embedding_key(config.embedding_model, description)
+        if supplier["embedding_key"] == key:
+            embeddings[supplier_id] = list(supplier["embedding"])
+        else:
+            stale.append((supplier_id, description, key))
 
-        supplier_name = supplier_row["supplier_name"] or "Supplier"
-        supplier_email = supplier_row["supplier_email"]
-        supplier_description = supplier_row["description"] or ""
-        supplier_insights = supplier_row["insights"] or ""
-
-        logger.info(f"Supplier: {supplier_name}, email: {supplier_email or 'NOT SET'}")
+    semaphore = asyncio.Semaphore(config.bedrock_max_concurrency)
 
-        # Save negotiator agent to DB
+    async def embed(supplier_id: str, description: str, key: str) -> None:
+        async with semaphore:
+            embedding = await _embed_text(description)
         await db.execute(
             """
-            INSERT INTO agent (ng_id, sup_id, sys_prompt, role)
-            VALUES ($1, $2, $3, 'negotiator')
+            INSERT INTO supplier_embedding (supplier_id, embedding, embedding_key)
+            VALUES ($1, $2, $3)
+            ON CONFLICT (supplier_id) DO UPDATE
+            SET embedding = EXCLUDED.embedding,
+                embedding_key = EXCLUDED.embedding_key,
+                updated_at = now()
             """,
-            ng_id,
-            supplier,
-            NEGOTIATOR_AGENT_SYSTEM_PROMPT,
+            supplier_id,
+            embedding,
+            key,
         )
-        logger.info(f"Agent saved to database for supplier {supplier}")
+        embeddings[supplier_id] = embedding
 
-        agent = NegotiationAgent(
-            db_pool=db,
-            sys_prompt=NEGOTIATOR_AGENT_SYSTEM_PROMPT,
-            ng_id=ng_id,
-            sup_id=supplier,
-            client=bedrock_client,
-            product=request.product,
-            email_client=email_client,
-            supplier_email=supplier_email,
-            supplier_name=supplier_name,
-            supplier_insights=supplier_insights,
-        )
-        logger.info(f"NegotiationAgent created for supplier {supplier}")
+    if stale:
+        logger.info(f"Embedding {len(stale)} supplier descriptions")
+    await asyncio.gather(*(embed(*args) for args in stale))
+    # Back in supplier order; the embedding calls finish in any order
+    return {
+        str(supplier["supplier_id"]): embeddings[str(supplier["supplier_id"])]
+        for supplier in suppliers
+        if str(supplier["supplier_id"]) in embeddings
+    }
 
-        # Register agent with session - this sets up the email handler
+
+@app.get("/suppliers/duplicates")
+async def find_duplicate_suppliers(
+    threshold: Optional[float] = None,
+) -> dict[str, Any]:
+    """
+    Groups of active suppliers whose descriptions are at least `threshold`
+    similar (cosine similarity of their embeddings), for a person to review.
+    `similarity` is the weakest pair similarity holding a group together.
+    """
+    if threshold is None:
+        threshold = config.duplicate_similarity_threshold
+    if not 0 < threshold <= 1:
+        raise HTTPException(
+            status_code=400, detail="threshold must be greater than 0 and at most 1"
+        )
+    db = await get_pool()
+    suppliers = await db.fetch(
+        """
+        SELECT s.supplier_id, s.supplier_name, s.description,
+               e.embedding, e.embedding_key
+        FROM supplier s
+        LEFT JOIN supplier_embedding e USING (supplier_id)
+        WHERE s.deleted_at IS NULL
+        ORDER BY s.supplier_id
+        """
+    )
+    try:
+        embeddings = await _supplier_embeddings(db, suppliers)
+    except (BedrockTimeoutError, BedrockUnavailableError, asyncio.TimeoutError):
+        raise
+    except (asyncpg.PostgresError, asyncpg.InterfaceError):
+        raise
+    except Exception as e:
+        logger.error(f"Failed to embed supplier descriptions: {e}")
+        raise HTTPException(
+            status_code=502, detail="Bedrock service is currently unavailable"
+        )
+
+    by_id = {str(supplier["supplier_id"]): supplier for supplier in suppliers}
+    return {
+        "threshold": threshold,
+        "groups": [
+            {
+                "similarity": round(similarity, 4),
+                "suppliers": [
+                    {
+                        "supplier_id": supplier_id,
+                        "supplier_name": by_id[supplier_id]["supplier_name"],
+                        "description": by_id[supplier_id]["description"],
+                    }
+                    for supplier_id in group
+                ],
+            }
+            for group, similarity in cluster_by_similarity(embeddings, threshold)
+        ],
+    }
+
+
+@app.get(
+    "/suppliers/{supplier_id}",
+    responses={200: {"model": Supplier}},
+    dependencies=[Depends(require_admin_for_deleted)],
+)
+async def get_supplier(
+    supplier_id: str,
+    include_deleted: bool = False,
+    store: Store = Depends(get_store),
+) -> dict[str, Any]:
+    supplier = await store.get_supplier(_normalize_id(supplier_id), include_deleted)
+    if supplier is None:
+        raise HTTPException(status_code=404, detail="supplier not found")
+    return supplier
+
+
+def _head_response(body: Any) -> Response:
+    """GET's status and Content-Length for a HEAD request, without the body."""
+    content = JSONResponse(jsonable_encoder(body)).body
+    return Response(
+        media_type="application/json",
+        headers={"Content-Length": str(len(content))},
+    )
+
+
+# FastAPI doesn't answer HEAD for GET routes, so existence checks would 405
+@app.head(
+    "/suppliers/{supplier_id}",
+    include_in_schema=False,
+    dependencies=[Depends(require_admin_for_deleted)],
+)
+async def head_supplier(
+    supplier_id: str,
+    include_deleted: bool = False,
+    store: Store = Depends(get_store),
+) -> Response:
+    return _head_response(await get_supplier(supplier_id, include_deleted, store))
+
+
+@app.delete("/suppliers/{supplier_id}", status_code=204)
+async def delete_supplier(
+    supplier_id: str, store: Store = Depends(get_store)
+) -> Response:
+    if not await store.delete_supplier(_normalize_id(supplier_id)):
+        raise HTTPException(status_code=404, detail="supplier not found")
+    list_cache.clear()
+    return Response(status_code=204)
+
+
+# Accepted image types and the leading bytes each must start with, so the
+# declared Content-Type can't smuggle in other files
+SUPPLIER_IMAGE_TYPES = {
+    "image/png": ("png", b"\x89PNG\r\n\x1a\n"),
+    "image/jpeg": ("jpg", b"\xff\xd8\xff"),
+}
+
+
+@app.post("/suppliers/{supplier_id}/image")
+async def upload_supplier_image(
+    supplier_id: str, file: UploadFile = File(...)
+) -> dict[str, Any]:
+    supplier_id = _normalize_id(supplier_id)
+    if not config.s3_bucket:
+        raise HTTPException(status_code=503, detail="image uploads are not configured")
+    if file.content_type not in SUPPLIER_IMAGE_TYPES:
+        raise HTTPException(status_code=415, detail="image must be PNG or JPEG")
+    extension, signature = SUPPLIER_IMAGE_TYPES[file.content_type]
+    data = await file.read(config.max_image_bytes + 1)
+    if len(data) > config.max_image_bytes:
+        raise HTTPException(
+            status_code=413,
+            detail=f"image must be at most {config.max_image_bytes} bytes",
+        )
+    if not data.startswith(signature):
+        raise HTTPException(
+            status_code=415, detail=f"file is not a valid {file.content_type}"
+        )
+
+    db = await get_pool()
+    try:
+        supplier = await db.fetchrow(
+            "SELECT 1 FROM supplier WHERE supplier_id = $1 AND deleted_at IS NULL",
+            supplier_id,
+        )
+    except asyncpg.DataError:
+        supplier = None
+    if not supplier:
+        raise HTTPException(status_code=404, detail="supplier not found")
+
+    key = f"suppliers/{supplier_id}/{uuid.uuid4()}.{extension}"
+    try:
+        await asyncio.to_thread(
+            s3_client.put_object,
+            Bucket=config.s3_bucket,
+            Key=key,
+            Body=data,
+            ContentType=file.content_type,
+        )
+    except Exception as e:
+        logger.error(f"Failed to upload image for supplier {supplier_id}: {e}")
+        raise HTTPException(status_code=502, detail="image upload failed")
+
+    image_url = f"https://{config.s3_bucket}.s3.{config.aws_region}.amazonaws.com/{key}"
+    await db.execute(
+        """
+        UPDATE supplier SET image_url = $1
+        WHERE supplier_id = $2 AND deleted_at IS NULL
+        """,
+        image_url,
+        supplier_id,
+    )
+    list_cache.clear()
+    return {"supplier_id": supplier_id, "image_url": image_url}
+
+
+PRODUCT_SORT_COLUMNS = {
+    "product_name",
+    "product_id",
+    "supplier_name",
+    "supplier_id",
+    "created_at",
+}
+
+
+def _parse_sort(
+    sort: str | None, allowed: set[str], default: str, tiebreaker: str | None = None
+) -> str:
+    """
+    Translate "col" / "-col" into an ORDER BY clause for allow-listed columns.
+    A tiebreaker (a unique column) keeps rows with equal values, such as a
+    bulk import's shared created_at, in a fixed order across pages.
+    """
+    sort = sort or default
+    column = sort.removeprefix("-")
+    if column not in allowed:
+        raise HTTPException(
+            status_code=400,
+            detail=f"sort must be one of: {', '.join(sorted(allowed))}",
+        )
+    direction = "DESC" if sort.startswith("-") else "ASC"
+    if tiebreaker and column != tiebreaker:
+        return f"ORDER BY {column} {direction}, {tiebreaker} ASC"
+    return f"ORDER BY {column} {direction}"
+
+
+def _parse_created_after(value: str | None) -> datetime | None:
+    """ISO 8601 date or timestamp; one without an offset is taken as UTC."""
+    if value is None:
+        return None
+    try:
+        parsed = datetime.fromisoformat(value.strip())
+    except ValueError:
+        raise HTTPException(
+            status_code=400, detail="created_after must be an ISO 8601 timestamp"
+        )
+    return parsed if parsed.tzinfo else parsed.replace(tzinfo=timezone.utc)
+
+
+def _encode_cursor(product_id: Any) -> str:
+    return base64.urlsafe_b64encode(str(product_id).encode()).decode().rstrip("=")
+
+
+def _decode_cursor(cursor: str) -> str | None:
+    """Product ID encoded in cursor, or None if the cursor is malformed."""
+    try:
+        decoded = base64.urlsafe_b64decode(cursor + "=" * (-len(cursor) % 4))
+        return _uuid_key(decoded.decode())
+    except (ValueError, UnicodeDecodeError):
+        return None
+
+
+@app.get(
+    "/products",
+    response_model=None,
+    responses={200: {"model": Page[Product] | CursorPage[Product]}},
+)
+async def list_products(
+    request: Request,
+    response: Response,
+    limit: Optional[str] = None,
+    offset: Optional[str] = None,
+    sort: Optional[str] = None,
+    supplier_id: Optional[str] = None,
+    cursor: Optional[str] = None,
+    created_after: Optional[str] = None,
+) -> dict[str, Any] | Response:
+    cached = _cached_list(request, response)
+    if cached is not None:
+        return cached
+    after = _parse_created_after(created_after)
+    if cursor is not None:
+        return _cache_list(
+            request,
+            response,
+            await _list_products_by_cursor(
+                request, response, cursor, limit, offset, sort, supplier_id, after
+            ),
+        )
+
+    page_limit, page_offset, warning = _parse_pagination(limit, offset)
+    order_by = _parse_sort(sort, PRODUCT_SORT_COLUMNS, "product_name", "product_id")
+
+    params: list[Any] = []
+    conditions: list[str] = []
+    if supplier_id:
+        params.append(supplier_id)
+        conditions.append(f"supplier_id = ${len(params)}")
+    if after:
+        params.append(after)
+        conditions.append(f"created_at > ${len(params)}")
+    where = f"WHERE {' AND '.join(conditions)}" if conditions else ""
+
+    db = await get_pool()
+    try:
+        total = await with_db_retry(
+            lambda: db.fetchval(f"SELECT COUNT(*) FROM product {where}", *params)
+        )
+        rows = await with_db_retry(
+            lambda: db.fetch(
+                f"SELECT * FROM product {where} {order_by} "
+                f"LIMIT ${len(params) + 1} OFFSET ${len(params) + 2}",
+                *params,
+                page_limit,
+                page_offset,
+            )
+        )
+    except asyncpg.DataError:
+        raise HTTPException(status_code=400, detail="supplier_id must be a UUID")
+    _set_link_header(request, response, page_limit, page_offset, total)
+    return _cache_list(
+        request,
+        response,
+        {
+            "data": [dict(row) for row in rows],
+            "limit": page_limit,
+            **({"warning": warning} if warning else {}),
+            "offset": page_offset,
+            "total": total,
+        },
+    )
+
+
+async def _list_products_by_cursor(
+    request: Request,
+    response: Response,
+    cursor: str,
+    limit: str | None,
+    offset: str | None,
+    sort: str | None,
+    supplier_id: str | None,
+    created_after: datetime | None = None,
+) -> dict[str, Any]:
+    """
+    Keyset pagination ordered by product_id: stable while rows are inserted
+    or deleted, and doesn't scan skipped rows like OFFSET. An empty cursor
+    requests the first page; each page returns the cursor for the next one.
+    """
+    if offset is not None:
+        raise HTTPException(
+            status_code=400, detail="offset cannot be combined with cursor"
+        )
+    if sort not in (None, "product_id"):
+        raise HTTPException(
+            status_code=400, detail="cursor pagination is ordered by product_id"
+        )
+    page_limit, _, warning = _parse_pagination(limit, None)
+
+    conditions: list[str] = []
+    params: list[Any] = []
+    if cursor:
+        after = _decode_cursor(cursor)
+        if not after:
+            raise HTTPException(status_code=400, detail="invalid cursor")
+        params.append(after)
+        conditions.append(f"product_id > ${len(params)}")
+    if supplier_id:
+        params.append(supplier_id)
+        conditions.append(f"supplier_id = ${len(params)}")
+    if created_after:
+        params.append(created_after)
+        conditions.append(f"created_at > ${len(params)}")
+    where = f"WHERE {' AND '.join(conditions)}" if conditions else ""
+
+    db = await get_pool()
+    try:
+        rows = await with_db_retry(
+            lambda: db.fetch(
+                f"SELECT * FROM product {where} ORDER BY product_id "
+                f"LIMIT ${len(params) + 1}",
+                *params,
+                page_limit,
+            )
+        )
+    except asyncpg.DataError:
+        raise HTTPException(status_code=400, detail="supplier_id must be a UUID")
+    # A short page means there is nothing after it
+    next_cursor = (
+        _encode_cursor(rows[-1]["product_id"]) if len(rows) == page_limit else None
+    )
+    if next_cursor:
+        next_url = request.url.include_query_params(cursor=next_cursor)
+        response.headers["Link"] = f'<{next_url}>; rel="next"'
+    return {
+        "data": [dict(row) for row in rows],
+        "limit": page_limit,
+        **({"warning": warning} if warning else {}),
+        "next_cursor": next_cursor,
+    }
+
+
+@app.get(
+    "/suppliers/{supplier_id}/products", responses={200: {"model": Page[Product]}}
+)
+async def list_supplier_products(
+    request: Request,
+    response: Response,
+    supplier_id: str,
+    limit: Optional[str] = None,
+    offset: Optional[str] = None,
+    sort: Optional[str] = None,
+    created_after: Optional[str] = None,
+) -> dict[str, Any]:
+    supplier_id = _normalize_id(supplier_id)
+    # Distinguish an unknown supplier (404) from one without products (empty page)
+    db = await get_pool()
+    try:
+        supplier = await db.fetchrow(
+            "SELECT 1 FROM supplier WHERE supplier_id = $1 AND deleted_at IS NULL",
+            supplier_id,
+        )
+    except asyncpg.DataError:
+        supplier = None
+    if not supplier:
+        raise HTTPException(status_code=404, detail="supplier not found")
+    return await list_products(
+        request,
+        response,
+        limit,
+        offset,
+        sort,
+        supplier_id=supplier_id,
+        created_after=created_after,
+    )
+
+
+PRODUCT_CSV_COLUMNS = [
+    "product_id",
+    "product_name",
+    "supplier_id",
+    "supplier_name",
+    "price",
+    "currency",
+]
+
+
+@app.get("/products.csv")
+async def export_products_csv(
+    sort: Optional[str] = None, supplier_id: Optional[str] = None
+) -> StreamingResponse:
+    order_by = _parse_sort(sort, PRODUCT_SORT_COLUMNS, "product_name", "product_id")
+    params: list[Any] = []
+    where = ""
+    if supplier_id:
+        # Validate up front: once streaming starts the status can't change
+        if not _uuid_key(supplier_id):
+            raise HTTPException(status_code=400, detail="supplier_id must be a UUID")
+        params.append(supplier_id)
+        where = "WHERE supplier_id = $1::uuid"
+    query = f"SELECT {', '.join(PRODUCT_CSV_COLUMNS)} FROM product {where} {order_by}"
+    db = await get_pool()
+
+    async def csv_lines() -> AsyncIterator[str]:
+        buffer = io.StringIO()
+        writer = csv.writer(buffer)
+        writer.writerow(PRODUCT_CSV_COLUMNS)
+        async with db.acquire() as conn:
+            # asyncpg cursors fetch in batches but need a transaction
+            async with conn.transaction():
+                async for row in conn.cursor(query, *params):
+                    writer.writerow([row[column] for column in PRODUCT_CSV_COLUMNS])
+                    yield buffer.getvalue()
+                    buffer.seek(0)
+                    buffer.truncate()
+        yield buffer.getvalue()
+
+    return StreamingResponse(
+        csv_lines(),
+        media_type="text/csv",
+        headers={"Content-Disposition": "attachment; filename=products.csv"},
+    )
+
+
+MAX_BULK_PRODUCTS = 1000
+
+
+# Matches the NUMERIC(12, 2) column
+ProductPrice = Annotated[Decimal, Field(ge=0, max_digits=12, decimal_places=2)]
+
+
+def _check_price(fields: dict[str, Any]) -> None:
+    """
+    Validate price and currency in place, raising ValueError. They're set
+    (or cleared) together, since a price is meaningless without its currency.
+    """
+    both_given = ("price" in fields) == ("currency" in fields)
+    price, currency = fields.get("price"), fields.get("currency")
+    if not both_given or (price is None) != (currency is None):
+        raise ValueError("price and currency must be set together")
+    if currency is not None:
+        fields["currency"] = normalize_currency(currency)
+
+
+class ProductImport(BaseModel):
+    product_name: str
+    supplier_id: str
+    product_id: str | None = None
+    price: ProductPrice | None = None
+    currency: str | None = None
+
+
+async def _read_bulk_products(request: Request) -> list[Any]:
+    """Rows from a JSON array body, or from a CSV body with a header line."""
+    body = await request.body()
+    content_type = request.headers.get("content-type", "")
+    if content_type.startswith("text/csv"):
+        try:
+            reader = csv.DictReader(io.StringIO(body.decode("utf-8-sig")))
+            # Empty cells mean "not provided", e.g. a blank product_id column;
+            # cells beyond the header land under a None key and are dropped
+            rows: list[Any] = [
+                {key: value for key, value in row.items() if key and value}
+                for row in reader
+            ]
+        except (UnicodeDecodeError, csv.Error) as e:
+            raise HTTPException(status_code=400, detail=f"invalid CSV: {e}")
+    else:
+        try:
+            rows = json.loads(body)
+        except ValueError:
+            raise HTTPException(status_code=400, detail="body must be a JSON array")
+        if not isinstance(rows, list):
+            raise HTTPException(status_code=400, detail="body must be a JSON array")
+    if not rows:
+        raise HTTPException(status_code=400, detail="no products to import")
+    if len(rows) > MAX_BULK_PRODUCTS:
+        raise HTTPException(
+            status_code=400,
+            detail=f"at most {MAX_BULK_PRODUCTS} products per request",
+        )
+    return rows
+
+
+def _validate_bulk_product(raw: Any) -> ProductImport:
+    """Parse one row, raising ValueError with a reason fit for the summary."""
+    if not isinstance(raw, dict):
+        raise ValueError("row must be an object")
+    try:
+        product = ProductImport.model_validate(raw)
+    except ValidationError as e:
+        error = _field_errors(e.errors())[0]
+        raise ValueError(f"{error['field']} {error['message']}")
+    return _check_new_product(product)
+
+
+def _check_new_product(product: ProductImport) -> ProductImport:
+    """Trim and canonicalize a new product's fields, raising ValueError."""
+    product.product_name = product.product_name.strip()
+    if not product.product_name:
+        raise ValueError("product_name must not be empty")
+    supplier_id = _uuid_key(product.supplier_id)
+    if not supplier_id:
+        raise ValueError("supplier_id must be a UUID")
+    product.supplier_id = supplier_id
+    if product.product_id is not None:
+        product_id = _uuid_key(product.product_id)
+        if not product_id:
+            raise ValueError("product_id must be a UUID")
+        product.product_id = product_id
+    price = {"price": product.price, "currency": product.currency}
+    _check_price(price)
+    product.currency = price["currency"]
+    return product
+
+
+@app.post("/products/bulk")
+async def import_products(request: Request, strict: bool = False) -> JSONResponse:
+    """
+    Insert a batch of products given as a JSON array or a CSV upload
+    (product_name, supplier_id and optional product_id, price and currency
+    columns).
+    Invalid rows are skipped and reported; with strict=true any invalid row
+    rejects the whole batch with a 422 and nothing is inserted.
+    """
+    raw_rows = await _read_bulk_products(request)
+
+    failed: list[dict[str, Any]] = []
+    valid: list[tuple[int, ProductImport]] = []
+    seen_ids: set[str] = set()
+    # Rows are numbered from 1 in the order they were sent
+    for number, raw in enumerate(raw_rows, start=1):
+        try:
+            product = _validate_bulk_product(raw)
+            if product.product_id in seen_ids:
+                raise ValueError("duplicate product_id in batch")
+        except ValueError as e:
+            failed.append({"row": number, "error": str(e)})
+            continue
+        if product.product_id:
+            seen_ids.add(product.product_id)
+        valid.append((number, product))
+
+    db = await get_pool()
+    async with db.acquire() as conn:
+        async with conn.transaction():
+            suppliers = {
+                str(row["supplier_id"]): row["supplier_name"]
+                for row in await conn.fetch(
+                    "SELECT supplier_id, supplier_name FROM supplier "
+                    "WHERE supplier_id = ANY($1::uuid[])",
+                    list({product.supplier_id for _, product in valid}),
+                )
+            }
+            existing: set[str] = set()
+            if seen_ids:
+                existing = {
+                    str(row["product_id"])
+                    for row in await conn.fetch(
+                        "SELECT product_id FROM product "
+                        "WHERE product_id = ANY($1::uuid[])",
+                        list(seen_ids),
+                    )
+                }
+
+            to_insert: list[ProductImport] = []
+            for number, product in valid:
+                if product.supplier_id not in suppliers:
+                    failed.append({"row": number, "error": "supplier not found"})
+                elif product.product_id in existing:
+                    failed.append({"row": number, "error": "product already exists"})
+                else:
+                    to_insert.append(product)
+            failed.sort(key=lambda failure: failure["row"])
+
+            if strict and failed:
+                return JSONResponse(
+                    status_code=422,
+                    content={
+                        **error_body(422, "batch rejected: some rows are invalid"),
+                        "inserted": 0,
+                        "failed": failed,
+                    },
+                )
+            if to_insert:
+                # One statement for the whole batch rather than a round trip per row
+                try:
+                    await conn.execute(
+                        """
+                        INSERT INTO product
+                            (product_id, supplier_id, product_name, supplier_name,
+                             price, currency)
+                        SELECT COALESCE(product_id, gen_random_uuid()), supplier_id,
+                               product_name, supplier_name, price, currency
+                        FROM unnest(
+                            $1::uuid[], $2::uuid[], $3::text[], $4::text[],
+                            $5::numeric[], $6::text[]
+                        ) AS t(product_id, supplier_id, product_name, supplier_name,
+                               price, currency)
+                        """,
+                        [product.product_id for product in to_insert],
+                        [product.supplier_id for product in to_insert],
+                        [product.product_name for product in to_insert],
+                        [suppliers[product.supplier_id] or "" for product in to_insert],
+                        [product.price for product in to_insert],
+                        [product.currency for product in to_insert],
+                    )
+                except asyncpg.UniqueViolationError:
+                    # Lost a race with a concurrent insert of the same product_id
+                    raise HTTPException(
+                        status_code=409, detail="product already exists"
+                    )
+    if to_insert:
+        list_cache.clear()
+    return JSONResponse(content={"inserted": len(to_insert), "failed": failed})
+
+
+@app.post("/products", status_code=201, responses={201: {"model": Product}})
+async def create_product(product: ProductImport) -> dict[str, Any]:
+    """
+    Create one product under an existing, active supplier. A malformed body
+    is a 400; a well-formed one naming a supplier that doesn't exist is a 422.
+    """
+    try:
+        product = _check_new_product(product)
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+
+    db = await get_pool()
+    try:
+        # Selecting from supplier checks it exists and copies its name in the
+        # same statement, so a concurrent delete can't slip in between
+        row = await db.fetchrow(
+            """
+            INSERT INTO product
+                (product_id, supplier_id, product_name, supplier_name, price, currency)
+            SELECT COALESCE($1::uuid, gen_random_uuid()), supplier_id, $3,
+                   COALESCE(supplier_name, ''), $4, $5
+            FROM supplier
+            WHERE supplier_id = $2 AND deleted_at IS NULL
+            RETURNING *
+            """,
+            product.product_id,
+            product.supplier_id,
+            product.product_name,
+            product.price,
+            product.currency,
+        )
+    except asyncpg.UniqueViolationError:
+        raise HTTPException(status_code=409, detail="product already exists")
+    except asyncpg.ForeignKeyViolationError:
+        row = None
+    if row is None:
+        raise HTTPException(status_code=422, detail="supplier not found")
+    list_cache.clear()
+    return dict(row)
+
+
+@app.get("/products/{product_id}", responses={200: {"model": ProductDetail}})
+async def get_product(
+    product_id: str, store: Store = Depends(get_store)
+) -> dict[str, Any]:
+    row = await store.get_product(_normalize_id(product_id))
+    if row is None:
+        raise HTTPException(status_code=404, detail="product not found")
+    return {
+        "product_id": str(row["product_id"]),
+        "product_name": row["product_name"],
+        "price": row["price"],
+        "currency": row["currency"],
+        "created_at": row["created_at"],
+        "updated_at": row["updated_at"],
+        "supplier": {
+            "supplier_id": str(row["supplier_id"]),
+            "supplier_name": row["supplier_name"],
+            "description": row["description"],
+            "image_url": row["image_url"],
+        },
+    }
+
+
+@app.head("/products/{product_id}", include_in_schema=False)
+async def head_product(
+    product_id: str, store: Store = Depends(get_store)
+) -> Response:
+    return _head_response(await get_product(product_id, store))
+
+
+class ProductUpdate(BaseModel):
+    product_name: str | None = None
+    price: ProductPrice | None = None
+    currency: str | None = None
+
+
+@app.patch("/products/{product_id}", responses={200: {"model": Product}})
+async def update_product(product_id: str, update: ProductUpdate) -> dict[str, Any]:
+    # Only fields present in the body are touched; null price and currency clear them
+    fields = update.model_dump(exclude_unset=True)
+    if not fields:
+        raise HTTPException(status_code=400, detail="no fields to update")
+    if "product_name" in fields:
+        fields["product_name"] = (fields["product_name"] or "").strip()
+        if not fields["product_name"]:
+            raise HTTPException(
+                status_code=400, detail="product_name must not be empty"
+            )
+    if "price" in fields or "currency" in fields:
+        try:
+            _check_price(fields)
+        except ValueError as e:
+            raise HTTPException(status_code=400, detail=str(e))
+
+    assignments = ", ".join(
+        f"{column} = ${index}" for index, column in enumerate(fields, start=1)
+    )
+    db = await get_pool()
+    try:
+        row = await db.fetchrow(
+            f"UPDATE product SET {assignments} WHERE product_id = ${len(fields) + 1} RETURNING *",
+            *fields.values(),
+            _normalize_id(product_id),
+        )
+    except asyncpg.DataError:
+        row = None
+    if not row:
+        raise HTTPException(status_code=404, detail="product not found")
+    list_cache.clear()
+    return dict(row)
+
+
+@app.delete("/products/{product_id}", status_code=204)
+async def delete_product(product_id: str) -> Response:
+    product_id = _normalize_id(product_id)
+    db = await get_pool()
+    async with db.acquire() as conn:
+        async with conn.transaction():
+            try:
+                product = await conn.fetchrow(
+                    "SELECT product_id FROM product WHERE product_id = $1 FOR UPDATE",
+                    product_id,
+                )
+            except asyncpg.DataError:
+                product = None
+            if not product:
+                raise HTTPException(status_code=404, detail="product not found")
+
+            # By ID, so renames and other products sharing the name don't matter
+            in_use = await conn.fetchval(
+                "SELECT COUNT(*) FROM negotiation WHERE product_id = $1",
+                product_id,
+            )
+            if in_use:
+                raise HTTPException(
+                    status_code=409,
+                    detail=f"product is referenced by {in_use} negotiation(s)",
+                )
+
+            await conn.execute("DELETE FROM product WHERE product_id = $1", product_id)
+    list_cache.clear()
+    return Response(status_code=204)
+
+
+# Each scope contributes one branch to the search UNION. $1 is the full-text
+# query, $2 the ILIKE pattern that catches partial words ("duc"); ILIKE-only
+# hits get rank 0 and sort after full-text matches.
+SEARCH_QUERIES = {
+    "products": """
+        SELECT 'product' AS type,
+               product_id::text AS id,
+               product_name AS name,
+               supplier_id::text AS supplier_id,
+               ts_rank(
+                   to_tsvector('english', product_name),
+                   plainto_tsquery('english', $1)
+               ) AS rank
+        FROM product
+        WHERE to_tsvector('english', product_name) @@ plainto_tsquery('english', $1)
+           OR product_name ILIKE $2
+    """,
+    "suppliers": """
+        SELECT 'supplier' AS type,
+               supplier_id::text AS id,
+               supplier_name AS name,
+               supplier_id::text AS supplier_id,
+               ts_rank(
+                   to_tsvector('english', coalesce(supplier_name, '') || ' ' || description),
+                   plainto_tsquery('english', $1)
+               ) AS rank
+        FROM supplier
+        WHERE deleted_at IS NULL
+          AND (
+              to_tsvector('english', coalesce(supplier_name, '') || ' ' || description)
+                  @@ plainto_tsquery('english', $1)
+              OR supplier_name ILIKE $2
+              OR description ILIKE $2
+          )
+    """,
+}
+SEARCH_SCOPES = {"products": ["products"], "suppliers": ["suppliers"]}
+SEARCH_SCOPES["all"] = SEARCH_SCOPES["products"] + SEARCH_SCOPES["suppliers"]
+MAX_SEARCH_QUERY_LENGTH = 200
+
+
+def _like_pattern(term: str) -> str:
+    """Substring ILIKE pattern matching term literally, wildcards included."""
+    escaped = term.replace("\\", "\\\\").replace("%", "\\%").replace("_", "\\_")
+    return f"%{escaped}%"
+
+
+@app.get("/search")
+async def search_items(
+    request: Request,
+    response: Response,
+    q: Optional[str] = None,
+    product: Optional[str] = None,
+    scope: str = "products",
+    limit: Optional[str] = None,
+    offset: Optional[str] = None,
+) -> dict[str, Any]:
+    # `product` is the original parameter name, kept for existing clients
+    term = (q or product or "").strip()
+    if not term:
+        raise HTTPException(status_code=400, detail="q must not be empty")
+    if len(term) > MAX_SEARCH_QUERY_LENGTH:
+        raise HTTPException(
+            status_code=400,
+            detail=f"q must be at most {MAX_SEARCH_QUERY_LENGTH} characters",
+        )
+    if scope not in SEARCH_SCOPES:
+        raise HTTPException(
+            status_code=400,
+            detail=f"scope must be one of: {', '.join(sorted(SEARCH_SCOPES))}",
+        )
+    page_limit, page_offset, warning = _parse_pagination(limit, offset)
+
+    hits = " UNION ALL ".join(SEARCH_QUERIES[name] for name in SEARCH_SCOPES[scope])
+    pattern = _like_pattern(term)
+    db = await get_pool()
+    # The window count is taken before LIMIT, so it covers every match and
+    # saves a second scan of both tables.
+    rows = await with_db_retry(
+        lambda: db.fetch(
+            f"""
+            SELECT *, COUNT(*) OVER () AS total_count FROM ({hits}) hits
+            ORDER BY rank DESC, name, id
+            LIMIT $3 OFFSET $4
+            """,
+            term,
+            pattern,
+            page_limit,
+            page_offset,
+        )
+    )
+    if rows:
+        total = rows[0]["total_count"]
+    elif page_offset:
+        # Past the last page no row carries the count
+        total = await with_db_retry(
+            lambda: db.fetchval(f"SELECT COUNT(*) FROM ({hits}) hits", term, pattern)
+        )
+    else:
+        total = 0
+    data = [dict(row) for row in rows]
+    for hit in data:
+        del hit["total_count"]
+    _set_link_header(request, response, page_limit, page_offset, total)
+    return {
+        "data": data,
+        "limit": page_limit,
+        **({"warning": warning} if warning else {}),
+        "offset": page_offset,
+        "total": total,
+    }
+
+
+_stats_cache: tuple[float, dict[str, Any]] | None = None
+
+
+@app.get("/stats")
+async def get_stats() -> dict[str, Any]:
+    """Dashboard totals, cached for STATS_CACHE_TTL_SECONDS."""
+    global _stats_cache
+    now = time.monotonic()
+    if _stats_cache and now - _stats_cache[0] < config.stats_cache_ttl_seconds:
+        return _stats_cache[1]
+
+    db = await get_pool()
+    row = await with_db_retry(
+        lambda: db.fetchrow(
+            """
+            SELECT (
+                       SELECT COUNT(*) FROM supplier WHERE deleted_at IS NULL
+                   ) AS suppliers,
+                   (
+                       SELECT COUNT(*) FROM product p
+                       JOIN supplier s USING (supplier_id)
+                       WHERE s.deleted_at IS NULL
+                   ) AS products,
+                   (SELECT COUNT(*) FROM negotiation) AS negotiations
+            """
+        )
+    )
+    stats = {
+        "suppliers": row["suppliers"],
+        "products": row["products"],
+        # Suppliers without products count too, so this is the catalog average
+        "avg_products_per_supplier": round(row["products"] / row["suppliers"], 2)
+        if row["suppliers"]
+        else 0.0,
+        "negotiations": row["negotiations"],
+        "generated_at": datetime.now(timezone.utc).isoformat(),
+    }
+    _stats_cache = (now, stats)
+    return stats
+
+
+MODEL_AVAILABILITY_TTL = 300  # seconds
+_model_availability: tuple[float, set[str]] | None = None
+
+
+async def _available_model_ids() -> set[str] | None:
+    """
+    Model IDs Bedrock lists as available in our region, cached for a few
+    minutes. None when the lookup fails (e.g. missing IAM permission).
+    """
+    global _model_availability
+    now = time.monotonic()
+    if _model_availability and now - _model_availability[0] < MODEL_AVAILABILITY_TTL:
+        return _model_availability[1]
+    try:
+        response = await asyncio.wait_for(
+            asyncio.to_thread(bedrock_catalog_client.list_foundation_models), 5
+        )
+    except Exception as e:
+        logger.warning(f"Could not list Bedrock foundation models: {e}")
+        return None
+    model_ids = {summary["modelId"] for summary in response["modelSummaries"]}
+    _model_availability = (now, model_ids)
+    return model_ids
+
+
+@app.get("/models")
+async def list_models() -> dict[str, Any]:
+    models = dict(ALLOWED_MODELS)
+    models.setdefault(config.default_bedrock_model, config.default_bedrock_model)
+    available = await _available_model_ids()
+    return {
+        "default": config.default_bedrock_model,
+        "models": [
+            {
+                "id": model_id,
+                "label": label,
+                # None when availability couldn't be checked
+                "available": None if available is None else model_id in available,
+            }
+            for model_id, label in models.items()
+        ],
+    }
+
+
+def resolve_model(model: str | None) -> str:
+    """Return the model to invoke, rejecting anything outside the allow-list."""
+    if not model:
+        return config.default_bedrock_model
+    if model != config.default_bedrock_model and model not in ALLOWED_MODELS:
+        raise HTTPException(status_code=400, detail=f"model not allowed: {model}")
+    return model
+
+
+async def _bedrock_completion(
+    prompt: str,
+    system_prompt: str = "",
+    model: str | None = None,
+    max_tokens: int = DEFAULT_MAX_TOKENS,
+    temperature: float = DEFAULT_TEMPERATURE,
+) -> tuple[str, TokenUsage]:
+    """Call an Amazon Bedrock chat model, raising if the call fails."""
+    validate_generation_params(max_tokens, temperature)
+    messages = [{"role": "user", "content": prompt}]
+    if system_prompt:
+        messages.insert(0, {"role": "system", "content": system_prompt})
+
+    body = {
+        "messages": messages,
+        "max_tokens": max_tokens,
+        "temperature": temperature,
+    }
+
+    response = await invoke_model_with_retry(
+        bedrock_client,
+        timeout=config.bedrock_timeout_seconds,
+        modelId=model or config.default_bedrock_model,
+        contentType="application/json",
+        accept="application/json",
+        body=json.dumps(body),
+    )
+    content, usage = parse_completion(response["body"].read())
+    log_token_usage(usage, model or config.default_bedrock_model)
+    return content, usage
+
+
+def _iter_stream_events(chunks: Iterable[bytes]) -> Iterator[dict[str, Any]]:
+    """
+    Decode JSON events from raw Bedrock stream chunks.
+    A chunk may end mid-object (or mid UTF-8 sequence), so undecodable
+    tails are buffered until the following chunk completes them.
+    """
+    decoder = json.JSONDecoder()
+    utf8 = codecs.getincrementaldecoder("utf-8")()
+    buffer = ""
+    for chunk in chunks:
+        buffer += utf8.decode(chunk)
+        while True:
+            buffer = buffer.lstrip()
+            if not buffer:
+                break
+            try:
+                event, end = decoder.raw_decode(buffer)
+            except json.JSONDecodeError:
+                break
+            buffer = buffer[end:]
+            yield event
+
+
+def call_bedrock_stream(
+    prompt: str,
+    system_prompt: str = "",
+    model: str | None = None,
+    max_tokens: int = DEFAULT_MAX_TOKENS,
+    temperature: float = DEFAULT_TEMPERATURE,
+) -> Iterator[str]:
+    """
+    Open a Bedrock chat completion stream and return its text deltas as they
+    arrive. Opening blocks until Bedrock accepts the request and raises
+    BedrockUnavailableError while the breaker is open; call it off the loop.
+    """
+    validate_generation_params(max_tokens, temperature)
+    messages = [{"role": "user", "content": prompt}]
+    if system_prompt:
+        messages.insert(0, {"role": "system", "content": system_prompt})
+
+    body = {
+        "messages": messages,
+        "max_tokens": max_tokens,
+        "temperature": temperature,
+        "stream": True,
+    }
+
+    response = open_response_stream(
+        bedrock_client,
+        modelId=model or config.default_bedrock_model,
+        contentType="application/json",
+        accept="application/json",
+        body=json.dumps(body),
+    )
+    return _stream_deltas(response)
+
+
+def _stream_deltas(response: dict[str, Any]) -> Iterator[str]:
+    chunks = (
+        event["chunk"]["bytes"] for event in response["body"] if "chunk" in event
+    )
+    for event in _iter_stream_events(chunks):
+        for choice in event.get("choices") or []:
+            delta = (choice.get("delta") or {}).get("content")
+            if delta:
+                yield delta
+
+
+async def _sse_events(
+    tokens: Iterator[str], timeout: float | None = None
+) -> AsyncIterator[str]:
+    """
+    Server-sent events for a blocking token stream, read off the event loop.
+    The stream ends with an error event if no token arrives within `timeout`
+    seconds; when the client disconnects, Starlette cancels the wait.
+    """
+    done = object()
+    try:
+        while True:
+            async with asyncio.timeout(timeout):
+                token = await asyncio.to_thread(next, tokens, done)
+            if token is done:
+                break
+            yield f"data: {json.dumps({'delta': token})}\n\n"
+    except TimeoutError:
+        error = f"Bedrock did not respond within {timeout:g} seconds"
+        logger.error(f"Bedrock stream failed: {error}")
+        yield f"event: error\ndata: {json.dumps({'error': error})}\n\n"
+        return
+    except Exception as e:
+        logger.error(f"Bedrock stream failed: {e}")
+        error = "Bedrock service is currently unavailable"
+        yield f"event: error\ndata: {json.dumps({'error': error})}\n\n"
+        return
+    yield "data: [DONE]\n\n"
+
+
+DEFAULT_TEST_PROMPT = "Write a short, friendly greeting to a new supplier."
+MAX_TEST_PROMPT_LENGTH = 2000
+
+
+@app.get("/test/stream", dependencies=[Depends(require_feature("streaming"))])
+async def test_stream(prompt: Optional[str] = None) -> StreamingResponse:
+    """
+    Stream a Bedrock completion to the client as server-sent events, for
+    ad-hoc checks. Each wait for the next token is bounded by the Bedrock
+    timeout.
+    """
+    prompt = DEFAULT_TEST_PROMPT if prompt is None else prompt.strip()
+    if not prompt:
+        raise HTTPException(status_code=400, detail="prompt must not be empty")
+    if len(prompt) > MAX_TEST_PROMPT_LENGTH:
+        raise HTTPException(
+            status_code=400,
+            detail=f"prompt must be at most {MAX_TEST_PROMPT_LENGTH} characters",
+        )
+    timeout = config.bedrock_timeout_seconds
+    try:
+        async with asyncio.timeout(timeout):
+            tokens = await asyncio.to_thread(call_bedrock_stream, prompt)
+    except TimeoutError:
+        raise BedrockTimeoutError(
+            f"Bedrock did not respond within {timeout:g} seconds"
+        )
+    except BedrockUnavailableError:
+        raise
+    except Exception as e:
+        logger.error(f"Failed to open Bedrock stream: {e}")
+        raise HTTPException(
+            status_code=502, detail="Bedrock service is currently unavailable"
+        )
+    return StreamingResponse(
+        _sse_events(tokens, timeout),
+        media_type="text/event-stream",
+        headers={"Cache-Control": "no-cache", "X-Accel-Buffering": "no"},
+    )
+
+
+@app.post("/suppliers/{supplier_id}/insights")
+async def generate_supplier_insights(
+    supplier_id: str, refresh: bool = False
+) -> dict[str, Any]:
+    """Return cached supplier insights, generating them via Bedrock when missing."""
+    supplier_id = _normalize_id(supplier_id)
+    db = await get_pool()
+    try:
+        supplier = await db.fetchrow(
+            """
+            SELECT supplier_name, description, insights FROM supplier
+            WHERE supplier_id = $1 AND deleted_at IS NULL
+            """,
+            supplier_id,
+        )
+    except asyncpg.DataError:
+        supplier = None
+    if not supplier:
+        raise HTTPException(status_code=404, detail="supplier not found")
+
+    if supplier["insights"] and not refresh:
+        return {
+            "supplier_id": supplier_id,
+            "insights": supplier["insights"],
+            "cached": True,
+        }
+
+    try:
+        insights = await _regenerate_insights(db, supplier_id, supplier)
+    except BedrockTimeoutError as e:
+        raise HTTPException(status_code=504, detail=str(e))
+    except BedrockUnavailableError:
+        raise
+    except Exception as e:
+        logger.error(f"Failed to generate insights for supplier {supplier_id}: {e}")
+        raise HTTPException(
+            status_code=502, detail="Bedrock service is currently unavailable"
+        )
+    return {"supplier_id": supplier_id, "insights": insights, "cached": False}
+
+
+class SupplierInsights(BaseModel):
+    strengths: list[str] = Field(min_length=1)
+    risks: list[str]
+    recommended_approach: str = Field(min_length=1)
+
+    def to_text(self) -> str:
+        """Plain-text rendering stored in supplier.insights for agent prompts."""
+        return (
+            f"Strengths: {'; '.join(self.strengths)}\n"
+            f"Risks: {'; '.join(self.risks) or 'none noted'}\n"
+            f"Recommended approach: {self.recommended_approach}"
+        )
+
+
+STRUCTURED_INSIGHTS_INSTRUCTIONS = """Respond with a single JSON object only:
+{"strengths": ["<buyer leverage point>", ...], "risks": ["<risk>", ...], "recommended_approach": "<one or two sentences>"}"""
+
+
+def _parse_structured_insights(text: str) -> SupplierInsights | None:
+    """Extract and validate the JSON object, or None if the model didn't comply."""
+    match = re.search(r"\{.*\}", text, re.DOTALL)
+    if not match:
+        return None
+    try:
+        return SupplierInsights.model_validate_json(match.group(0))
+    except ValidationError:
+        return None
+
+
+async def _regenerate_insights(
+    db: asyncpg.Pool, supplier_id: str, supplier: asyncpg.Record
+) -> str:
+    """
+    Ask Bedrock for fresh leverage points and store them on the supplier.
+    With STRUCTURED_INSIGHTS the model is asked for JSON; output that doesn't
+    parse is kept as plain text and the structured column is cleared.
+    """
+    products = await db.fetch(
+        "SELECT product_name FROM product WHERE supplier_id = $1", supplier_id
+    )
+    product_list = ", ".join(row["product_name"] for row in products) or "unknown"
+    prompt = f"""Supplier: {supplier["supplier_name"] or "Supplier"}
+Description: {supplier["description"]}
+Products: {product_list}
+
+Summarize the negotiation leverage points a buyer could use with this supplier
+(pricing pressure, volume, alternatives, risks).
+"""
+    if config.structured_insights:
+        prompt += STRUCTURED_INSIGHTS_INSTRUCTIONS
+    else:
+        prompt += "Keep it under 120 words, plain text only."
+
+    insights, _ = await _bedrock_completion(
+        prompt, "You are a procurement analyst preparing buyers for negotiations."
+    )
+    insights = strip_reasoning_tokens(insights)
+    structured = None
+    if config.structured_insights:
+        parsed = _parse_structured_insights(insights)
+        if parsed is None:
+            logger.warning(
+                f"Insights for supplier {supplier_id} were not valid JSON, "
+                "storing them as text"
+            )
+        else:
+            insights, structured = parsed.to_text(), parsed.model_dump_json()
+
+    await db.execute(
+        """
+        UPDATE supplier SET insights = $1, insights_structured = $2::jsonb
+        WHERE supplier_id = $3 AND deleted_at IS NULL
+        """,
+        insights,
+        structured,
+        supplier_id,
+    )
+    list_cache.clear()
+    return insights
+
+
+@app.get("/suppliers/{supplier_id}/insights")
+async def get_supplier_insights(supplier_id: str) -> dict[str, Any]:
+    """Structured insights for dashboards; 404 until they've been generated."""
+    supplier_id = _normalize_id(supplier_id)
+    db = await get_pool()
+    try:
+        row = await db.fetchrow(
+            """
+            SELECT insights_structured FROM supplier
+            WHERE supplier_id = $1 AND deleted_at IS NULL
+            """,
+            supplier_id,
+        )
+    except asyncpg.DataError:
+        row = None
+    if not row:
+        raise HTTPException(status_code=404, detail="supplier not found")
+    if row["insights_structured"] is None:
+        raise HTTPException(
+            status_code=404, detail="structured insights not available"
+        )
+    return {
+        "supplier_id": supplier_id,
+        "insights": json.loads(row["insights_structured"]),
+    }
+
+
+async def _regenerate_all_insights(job: Job) -> None:
+    """Refresh every active supplier, counting successes and failures on job."""
+    db = await get_pool()
+    suppliers = await db.fetch(
+        """
+        SELECT supplier_id, supplier_name, description
+        FROM supplier
+        WHERE deleted_at IS NULL
+        ORDER BY supplier_id
+        """
+    )
+    job.total = len(suppliers)
+    semaphore = asyncio.Semaphore(config.bedrock_max_concurrency)
+    # Spread calls out so the batch doesn't starve interactive Bedrock traffic
+    limiter = RateLimiter(rate=config.insights_job_rps, burst=1)
+
+    async def regenerate(supplier: asyncpg.Record) -> None:
+        async with semaphore:
+            while (wait := limiter.acquire("insights")) > 0:
+                await asyncio.sleep(wait)
+            supplier_id = str(supplier["supplier_id"])
+            try:
+                await _regenerate_insights(db, supplier_id, supplier)
+            except Exception as e:
+                logger.warning(f"Insights job {job.job_id}: {supplier_id} failed: {e}")
+                job.failed += 1
+            else:
+                job.succeeded += 1
+
+    await asyncio.gather(*(regenerate(supplier) for supplier in suppliers))
+
+
+@app.post("/admin/insights/regenerate", status_code=202)
+async def regenerate_all_insights(response: Response) -> dict[str, Any]:
+    job = jobs.start("insights_regeneration", _regenerate_all_insights)
+    response.headers["Location"] = f"/admin/jobs/{job.job_id}"
+    return job.to_dict()
+
+
+@app.get("/admin/jobs/{job_id}")
+async def get_job(job_id: str) -> dict[str, Any]:
+    job = jobs.get(job_id.strip())
+    if job is None:
+        raise HTTPException(status_code=404, detail="job not found")
+    return job.to_dict()
+
+
+def require_pprof() -> None:
+    """Profiling routes answer like missing ones unless ENABLE_PPROF is on."""
+    if not config.enable_pprof:
+        raise HTTPException(status_code=404)
+
+
+MAX_HEAP_PROFILE_ENTRIES = 500
+
+
+@app.get(
+    "/debug/pprof",
+    include_in_schema=False,
+    dependencies=[Depends(require_pprof)],
+)
+async def list_profiles() -> dict[str, Any]:
+    return {
+        "profiles": {
+            name: f"/debug/pprof/{name}" for name in ("heap", "tasks", "threads")
+        }
+    }
+
+
+@app.get(
+    "/debug/pprof/heap",
+    include_in_schema=False,
+    dependencies=[Depends(require_pprof)],
+)
+async def get_heap_profile(limit: int = 25) -> dict[str, Any]:
+    """Allocations still held, by call site, traced since startup."""
+    if not 1 <= limit <= MAX_HEAP_PROFILE_ENTRIES:
+        raise HTTPException(
+            status_code=400,
+            detail=f"limit must be between 1 and {MAX_HEAP_PROFILE_ENTRIES}",
+        )
+    # Snapshotting walks every traced block; keep it off the event loop
+    return await asyncio.to_thread(heap_profile, limit)
+
+
+@app.get(
+    "/debug/pprof/tasks",
+    include_in_schema=False,
+    dependencies=[Depends(require_pprof)],
+)
+async def get_task_dump() -> dict[str, Any]:
+    return task_dump()
+
+
+@app.get(
+    "/debug/pprof/threads",
+    include_in_schema=False,
+    dependencies=[Depends(require_pprof)],
+)
+async def get_thread_dump() -> dict[str, Any]:
+    return thread_dump()
+
+
+# FIXED SYNTAX ERROR HERE
+async def crate_negotiation_agent(supplier_id: str, tactics: str, product: str) -> str:
+    db = await get_pool()
+    row = await db.fetch(
+        "SELECT * FROM supplier WHERE supplier_name = $1 LIMIT 1", supplier_id
+    )
+    if not row:
+        return ""
+    insights = row[0]["insights"]
+    prompt = f"""
+    Negotiate for {product} with tactics {tactics}. Insights: {insights}
+    """
+    return prompt
+
+
+# --- NEW EMAIL ENDPOINTS ---
+
+
+class LoginRequest(BaseModel):
+    email: str
+    password: str
+
+
+@app.post("/email/login")
+async def email_login_endpoint(creds: LoginRequest):
+    """
+    Exposed endpoint for frontend to log in the email client.
+    """
+    try:
+        await email_client.email_login(creds.email, creds.password)
+        return {"status": "success", "message": "Logged in successfully"}
+    except Exception as e:
+        raise APIError(400, "email login failed", "email_login_failed", str(e))
+
+
+class SendEmailRequest(BaseModel):
+    to_email: str
+    subject: str
+    body: str
+
+
+@app.post("/email/send")
+async def email_send_endpoint(req: SendEmailRequest):
+    """
+    Exposed endpoint to send emails using logged in credentials.
+    """
+    try:
+        await email_client.email_send(req.to_email, req.subject, req.body)
+        return {"status": "success"}
+    except Exception as e:
+        raise APIError(502, "failed to send email", "email_send_failed", str(e))
+
+
+# ---------------------------
+
+
+def _uuid_key(value: str) -> str | None:
+    """Canonical string form of a UUID, or None if value isn't one."""
+    try:
+        return str(uuid.UUID(value.strip()))
+    except ValueError:
+        return None
+
+
+def _normalize_id(value: str) -> str:
+    """
+    IDs are UUIDs and are not case-sensitive: surrounding whitespace is
+    dropped and UUIDs are lowercased to their canonical form, as Postgres
+    prints them. Anything else is passed on trimmed and fails the lookup.
+    """
+    return _uuid_key(value) or value.strip()
+
+
+# Each supplier fans out to its own Bedrock conversation, so cap the fan-out
+MAX_SUPPLIERS_PER_NEGOTIATION = 20
+# Prior turns are resent with every supplier's opening call; keep them well
+# inside the model's context window
+MAX_HISTORY_MESSAGES = 20
+MAX_HISTORY_CHARS = 20_000
+
+
+class BedrockMessage(BaseModel):
+    role: Literal["user", "assistant"]
+    content: str = Field(min_length=1)
+
+
+class NegotiationRequest(BaseModel):
+    product: str = Field(min_length=1)
+    # Both may be left out when template_id supplies them
+    prompt: str | None = Field(default=None, min_length=1)
+    tactics: str | None = None
+    template_id: str | None = None
+    suppliers: list[str] = Field(min_length=1, max_length=MAX_SUPPLIERS_PER_NEGOTIATION)
+    model: str | None = None
+    system_prompt: str | None = None
+    max_tokens: int = DEFAULT_MAX_TOKENS
+    temperature: float = DEFAULT_TEMPERATURE
+    # Skip Bedrock and persistence; return the prompts that would be sent
+    dry_run: bool = False
+    # Return the full messages sent to Bedrock alongside each supplier's reply
+    include_prompt: bool = False
+    # Prior turns placed ahead of the opening prompt, oldest first
+    history: list[BedrockMessage] = Field(
+        default_factory=list, max_length=MAX_HISTORY_MESSAGES
+    )
+
+    @field_validator("suppliers")
+    @classmethod
+    def normalize_suppliers(cls, suppliers: list[str]) -> list[str]:
+        # Results and agent rows are keyed by these, so normalize them up front
+        return [_normalize_id(supplier) for supplier in suppliers]
+
+    @field_validator("history")
+    @classmethod
+    def check_history(cls, history: list[BedrockMessage]) -> list[BedrockMessage]:
+        for previous, message in zip(history, history[1:]):
+            if previous.role == message.role:
+                raise ValueError("roles must alternate between user and assistant")
+        # The opening prompt is a user turn, so the history has to hand back to it
+        if history and history[-1].role != "assistant":
+            raise ValueError("must end with an assistant message")
+        if sum(len(message.content) for message in history) > MAX_HISTORY_CHARS:
+            raise ValueError(
+                f"must be at most {MAX_HISTORY_CHARS} characters in total"
+            )
+        return history
+
+
+class NegotiationTemplate(BaseModel):
+    name: str = Field(min_length=1, max_length=200)
+    prompt: str = Field(min_length=1)
+    tactics: str = ""
+
+
+def _template_fields(template: NegotiationTemplate) -> NegotiationTemplate:
+    name = " ".join(template.name.split())
+    if not name:
+        raise HTTPException(status_code=400, detail="name must not be empty")
+    if not template.prompt.strip():
+        raise HTTPException(status_code=400, detail="prompt must not be empty")
+    return template.model_copy(update={"name": name})
+
+
+@app.get("/templates", responses={200: {"model": Page[NegotiationTemplate]}})
+async def list_templates(
+    request: Request,
+    response: Response,
+    limit: Optional[str] = None,
+    offset: Optional[str] = None,
+) -> dict[str, Any]:
+    page_limit, page_offset, warning = _parse_pagination(limit, offset)
+    db = await get_pool()
+    total = await db.fetchval("SELECT COUNT(*) FROM negotiation_template")
+    rows = await db.fetch(
+        """
+        SELECT * FROM negotiation_template
+        ORDER BY name, template_id
+        LIMIT $1 OFFSET $2
+        """,
+        page_limit,
+        page_offset,
+    )
+    _set_link_header(request, response, page_limit, page_offset, total)
+    return {
+        "data": [dict(row) for row in rows],
+        "limit": page_limit,
+        **({"warning": warning} if warning else {}),
+        "offset": page_offset,
+        "total": total,
+    }
+
+
+@app.get("/templates/{template_id}")
+async def get_template(template_id: str) -> dict[str, Any]:
+    db = await get_pool()
+    try:
+        row = await db.fetchrow(
+            "SELECT * FROM negotiation_template WHERE template_id = $1",
+            _normalize_id(template_id),
+        )
+    except asyncpg.DataError:
+        row = None
+    if not row:
+        raise HTTPException(status_code=404, detail="template not found")
+    return dict(row)
+
+
+@app.post("/templates", status_code=201)
+async def create_template(template: NegotiationTemplate) -> dict[str, Any]:
+    template = _template_fields(template)
+    db = await get_pool()
+    try:
+        row = await db.fetchrow(
+            """
+            INSERT INTO negotiation_template (name, prompt, tactics)
+            VALUES ($1, $2, $3)
+            RETURNING *
+            """,
+            template.name,
+            template.prompt,
+            template.tactics,
+        )
+    except asyncpg.UniqueViolationError:
+        raise HTTPException(status_code=409, detail="template name already exists")
+    return dict(row)
+
+
+@app.put("/templates/{template_id}")
+async def replace_template(
+    template_id: str, template: NegotiationTemplate
+) -> dict[str, Any]:
+    template = _template_fields(template)
+    db = await get_pool()
+    try:
+        row = await db.fetchrow(
+            """
+            UPDATE negotiation_template
+            SET name = $1, prompt = $2, tactics = $3, updated_at = now()
+            WHERE template_id = $4
+            RETURNING *
+            """,
+            template.name,
+            template.prompt,
+            template.tactics,
+            _normalize_id(template_id),
+        )
+    except asyncpg.UniqueViolationError:
+        raise HTTPException(status_code=409, detail="template name already exists")
+    except asyncpg.DataError:
+        row = None
+    if not row:
+        raise HTTPException(status_code=404, detail="template not found")
+    return dict(row)
+
+
+@app.delete("/templates/{template_id}", status_code=204)
+async def delete_template(template_id: str) -> Response:
+    db = await get_pool()
+    try:
+        deleted = await db.fetchval(
+            """
+            DELETE FROM negotiation_template WHERE template_id = $1
+            RETURNING template_id
+            """,
+            _normalize_id(template_id),
+        )
+    except asyncpg.DataError:
+        deleted = None
+    if deleted is None:
+        raise HTTPException(status_code=404, detail="template not found")
+    return Response(status_code=204)
+
+
+async def _apply_template(
+    db: asyncpg.Pool, request: NegotiationRequest
+) -> NegotiationRequest:
+    """
+    Fill in the prompt and tactics a request leaves out from its template;
+    fields given in the request win.
+    """
+    if request.template_id is not None:
+        try:
+            row = await db.fetchrow(
+                """
+                SELECT prompt, tactics FROM negotiation_template
+                WHERE template_id = $1
+                """,
+                _normalize_id(request.template_id),
+            )
+        except asyncpg.DataError:
+            row = None
+        if not row:
+            raise HTTPException(status_code=404, detail="template not found")
+        defaults = {
+            field: row[field]
+            for field in ("prompt", "tactics")
+            if getattr(request, field) is None
+        }
+        request = request.model_copy(update=defaults)
+    missing = [
+        field for field in ("prompt", "tactics") if getattr(request, field) is None
+    ]
+    if missing:
+        raise HTTPException(
+            status_code=400,
+            detail=f"{' and '.join(missing)} required unless template_id is given",
+        )
+    return request
+
+
+async def _resolve_tactics(db: asyncpg.Pool, tactics: str) -> str:
+    """Expand a tactic template ID into its text; anything else is used verbatim."""
+    tactic_id = _uuid_key(tactics.strip())
+    if not tactic_id:
+        return tactics
+    tactic_text = await db.fetchval(
+        "SELECT tactic_text FROM tactic WHERE tactic_id = $1", tactic_id
+    )
+    return tactic_text if tactic_text is not None else tactics
+
+
+async def _resolve_product(db: asyncpg.Pool, product: str) -> asyncpg.Record:
+    """
+    Look up the product by ID or (case-insensitive) name and return its
+    catalog name and price, so agents never negotiate over a product we
+    don't carry. A name shared by several products is rejected rather than
+    picking one of them.
+    """
+    product_id = _uuid_key(product)
+    if product_id:
+        row = await db.fetchrow(
+            """
+            SELECT product_id, product_name, price, currency FROM product
+            WHERE product_id = $1
+            """,
+            product_id,
+        )
+    else:
+        row = await db.fetchrow(
+            """
+            SELECT product_id, product_name, price, currency,
+                COUNT(*) OVER () AS matches
+            FROM product
+            WHERE lower(product_name) = lower($1)
+            ORDER BY product_id
+            LIMIT 1
+            """,
+            product.strip(),
+        )
+        if row and row["matches"] > 1:
+            raise HTTPException(
+                status_code=409,
+                detail="product name matches several products; use its product_id",
+            )
+    if not row:
+        raise HTTPException(status_code=404, detail="product not found")
+    return row
+
+
+def _product_price(product: asyncpg.Record) -> str | None:
+    if product["price"] is None:
+        return None
+    return f"{product['price']} {product['currency']}"
+
+
+async def _fetch_suppliers(
+    db: asyncpg.Pool, supplier_ids: list[str]
+) -> dict[str, asyncpg.Record]:
+    """Load the requested suppliers in one round trip, keyed by canonical UUID."""
+    rows = await db.fetch(
+        """
+        SELECT supplier_id, supplier_name, supplier_email, description, insights
+        FROM supplier
+        WHERE supplier_id = ANY($1::uuid[]) AND deleted_at IS NULL
+        """,
+        [supplier_key for supplier_key in map(_uuid_key, supplier_ids) if supplier_key],
+    )
+    return {str(row["supplier_id"]): row for row in rows}
+
+
+async def _dry_run_negotiation(
+    db: asyncpg.Pool,
+    request: NegotiationRequest,
+    negotiator_prompt: str,
+    product_price: str | None = None,
+) -> dict[str, Any]:
+    """
+    Build the opening conversation for each supplier without calling Bedrock
+    or persisting anything, and return it with a canned reply.
+    """
+    suppliers_by_id = await _fetch_suppliers(db, request.suppliers)
+    results: dict[str, Any] = {}
+    for supplier in request.suppliers:
+        supplier_row = suppliers_by_id.get(_uuid_key(supplier) or "")
+        if not supplier_row:
+            results[supplier] = {"error": "not found"}
+            continue
+        supplier_name = supplier_row["supplier_name"] or "Supplier"
+        agent = NegotiationAgent(
+            db_pool=db,
+            client=None,
+            sys_prompt=negotiator_prompt,
+            ng_id="dry-run",
+            sup_id=supplier,
+            product=request.product,
+            supplier_name=supplier_name,
+            supplier_insights=supplier_row["insights"] or "",
+            history=[message.model_dump() for message in request.history],
+            product_price=product_price,
+        )
+        results[supplier] = {
+            "generated_text": f"[dry run] Opening message to {supplier_name}",
+            "prompt": agent.build_initial_messages(context=request.prompt),
+        }
+    return {
+        "negotiation_id": None,
+        "status": "dry_run",
+        "suppliers": request.suppliers,
+        "results": results,
+        "usage": asdict(TokenUsage()),
+    }
+
+
+@app.post("/negotiate")
+async def trigger_negotiations(
+    request: NegotiationRequest, idempotency_key: Optional[str] = Header(default=None)
+) -> Any:
+    """
+    Start a negotiation with every requested supplier. With an
+    Idempotency-Key header, a repeated request within the TTL replays the
+    first response (marked Idempotent-Replayed) instead of calling Bedrock again.
+    """
+    if idempotency_key is None:
+        return await _start_negotiation(request)
+    if not idempotency_key or len(idempotency_key) > MAX_KEY_LENGTH:
+        raise HTTPException(
+            status_code=400,
+            detail=f"Idempotency-Key must be 1-{MAX_KEY_LENGTH} characters",
+        )
+
+    db = await get_pool()
+    request_fingerprint = fingerprint(request.model_dump(mode="json"))
+    existing = await claim_key(
+        db, idempotency_key, request_fingerprint, config.idempotency_ttl_seconds
+    )
+    if existing is not None:
+        if existing["fingerprint"] != request_fingerprint:
+            raise HTTPException(
+                status_code=422,
+                detail="Idempotency-Key was already used for a different request",
+            )
+        if existing["response"] is None:
+            raise HTTPException(
+                status_code=409,
+                detail="a request with this Idempotency-Key is still in progress",
+            )
+        return JSONResponse(
+            content=json.loads(existing["response"]),
+            headers={"Idempotent-Replayed": "true"},
+        )
+
+    try:
+        response = await _start_negotiation(request)
+    except BaseException:
+        # Also on client disconnect, or the key would read "in progress" until expiry
+        await asyncio.shield(release_key(db, idempotency_key))
+        raise
+    try:
+        await store_response(db, idempotency_key, response)
+    except Exception as e:
+        # The suppliers have been contacted, so answer anyway. The key stays
+        # claimed until it expires, keeping a retry from contacting them twice.
+        logger.error(
+            f"Failed to store response for Idempotency-Key {idempotency_key}: {e}",
+            exc_info=True,
+        )
+    return response
+
+
+async def _save_negotiation_results(
+    db: asyncpg.Pool, ng_id: str, product_id: uuid.UUID, results: dict[str, Any]
+) -> None:
+    """
+    Record each supplier's entry in the /negotiate response for
+    GET /negotiations/{id}. Messages have already gone out by now, so a
+    failure here is logged rather than failing the request.
+    """
+    rows = []
+    for position, (supplier, result) in enumerate(results.items()):
+        if isinstance(result, str):
+            text, error, code = result, None, None
+        elif "error" in result:
+            text, error, code = None, result["error"], result.get("code")
+        else:
+            text, error, code = result["generated_text"], None, None
+        rows.append((ng_id, supplier, product_id, position, text, error, code))
+    try:
+        await db.executemany(
+            """
+            INSERT INTO negotiation_result (
+                ng_id, supplier_id, product_id, position,
+                generated_text, error, error_code
+            )
+            VALUES ($1, $2, $3, $4, $5, $6, $7)
+            """,
+            rows,
+        )
+    except (asyncpg.PostgresError, asyncpg.InterfaceError) as e:
+        logger.error(f"Failed to save results for negotiation {ng_id}: {e}")
+
+
+def _supplier_error(exc: Exception) -> dict[str, str]:
+    """
+    What /negotiate reports for a supplier that failed to start. Raw
+    asyncpg and botocore messages stay in the logs.
+    """
+    if isinstance(exc, (asyncpg.PostgresError, asyncpg.InterfaceError)):
+        error = from_db_error(exc)
+        return {"error": error.message, "code": error.code}
+    if isinstance(exc, BedrockTimeoutError):
+        # Our own message, naming only the configured timeout
+        return {"error": str(exc), "code": "timeout"}
+    if isinstance(exc, BedrockUnavailableError):
+        return {
+            "error": "Bedrock service is currently unavailable",
+            "code": "unavailable",
+        }
+    return {"error": "generation failed", "code": "upstream_error"}
+
+
+async def _start_negotiation(request: NegotiationRequest) -> dict[str, Any]:
+    logger.info(f"Starting negotiation for product: {request.product}")
+    logger.info(f"Suppliers: {request.suppliers}")
+    logger.info(f"Tactics: {request.tactics}")
+    model = resolve_model(request.model)
+    if request.system_prompt and len(request.system_prompt) > MAX_SYSTEM_PROMPT_LENGTH:
+        raise HTTPException(
+            status_code=422,
+            detail=f"system_prompt must be at most {MAX_SYSTEM_PROMPT_LENGTH} characters",
+        )
+    negotiator_prompt = request.system_prompt or NEGOTIATOR_AGENT_SYSTEM_PROMPT
+    try:
+        validate_generation_params(request.max_tokens, request.temperature)
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+
+    db = await get_pool()
+    request = await _apply_template(db, request)
+    product = await _resolve_product(db, request.product)
+    product_price = _product_price(product)
+    request = request.model_copy(update={"product": product["product_name"]})
+    if request.dry_run:
+        return await _dry_run_negotiation(
+            db, request, negotiator_prompt, product_price
+        )
+    # Fail before creating the negotiation rather than once per supplier
+    bedrock_breaker.check()
+    tactics = await _resolve_tactics(db, request.tactics)
+
+    ng_id = str(uuid.uuid4())
+    logger.info(f"Created negotiation ID: {ng_id}")
+
+    # Save negotiation to DB
+    await db.execute(
+        """
+        INSERT INTO negotiation (ng_id, product_id, product, strategy, prompt, status)
+        VALUES ($1, $2, $3, $4, $5, 'active')
+        """,
+        ng_id,
+        product["product_id"],
+        request.product,
+        tactics,
+        request.prompt,
+    )
+    logger.info("Negotiation saved to database")
+
+    orchestrator = OrchestratorAgent(
+        client=bedrock_client,
+        strategy=tactics,
+        product=request.product,
+        sys_promt=OCHESTRATOR_AGENT_SYSTEM_PROMPT,
+        db_pool=db,
+        ng_id=ng_id,
+        model_id=model,
+        timeout=config.bedrock_timeout_seconds,
+    )
+    logger.info("Orchestrator agent created")
+
+    # Create a session to manage this negotiation
+    session = NegotiationSession(
+        db_pool=db,
+        client=bedrock_client,
+        ng_id=ng_id,
+        orchestrator=orchestrator,
+        router=email_router,
+    )
+    logger.info("Negotiation session created")
+
+    suppliers_by_id = await _fetch_suppliers(db, request.suppliers)
+
+    # Bound how many of the supplier conversations call Bedrock at once
+    semaphore = asyncio.Semaphore(config.bedrock_max_concurrency)
+    agents: list[NegotiationAgent] = []
+
+    async def start_supplier(supplier: str, supplier_row: asyncpg.Record) -> Any:
+        supplier_name = supplier_row["supplier_name"] or "Supplier"
+        supplier_email = supplier_row["supplier_email"]
+        supplier_insights = supplier_row["insights"] or ""
+
+        logger.info(f"Supplier: {supplier_name}, email: {supplier_email or 'NOT SET'}")
+
+        # Save negotiator agent to DB
+        await db.execute(
+            """
+            INSERT INTO agent (ng_id, sup_id, sys_prompt, role)
+            VALUES ($1, $2, $3, 'negotiator')
+            """,
+            ng_id,
+            supplier,
+            negotiator_prompt,
+        )
+        logger.info(f"Agent saved to database for supplier {supplier}")
+
+        agent = NegotiationAgent(
+            db_pool=db,
+            sys_prompt=negotiator_prompt,
+            ng_id=ng_id,
+            sup_id=supplier,
+            client=bedrock_client,
+            product=request.product,
+            email_client=email_client,
+            supplier_email=supplier_email,
+            supplier_name=supplier_name,
+            supplier_insights=supplier_insights,
+            model_id=model,
+            max_tokens=request.max_tokens,
+            temperature=request.temperature,
+            timeout=config.bedrock_timeout_seconds,
+            history=[message.model_dump() for message in request.history],
+            product_price=product_price,
+            moderator=functools.partial(_moderate_output, model=model)
+            if config.moderate_output
+            else None,
+        )
+        agents.append(agent)
+        logger.info(f"NegotiationAgent created for supplier {supplier}")
+
+        # Register agent with session - this sets up the email handler
         session.add_agent(supplier, agent)
         logger.info(f"Agent registered with session for supplier {supplier}")
 
         # Send initial message to supplier asking about offers
-        logger.info(f"Sending initial message to supplier {supplier}...")
-        reply = await agent.send_initial_message(context=request.prompt)
+        async with semaphore:
+            logger.info(f"Sending initial message to supplier {supplier}...")
+            reply = await agent.send_initial_message(context=request.prompt)
         logger.info(f"Initial message sent to supplier {supplier}")
         logger.debug(
             f"Message content: {reply[:100]}..."
             if len(reply) > 100
             else f"Message content: {reply}"
         )
+        if request.include_prompt:
+            return {
+                "generated_text": reply,
+                "prompt": agent.build_initial_messages(context=request.prompt),
+            }
+        return reply
+
+    results: dict[str, Any] = {}
+    pending: dict[str, Any] = {}
+    for supplier in request.suppliers:
+        logger.info(f"Processing supplier: {supplier}")
+
+        supplier_row = suppliers_by_id.get(_uuid_key(supplier) or "")
+        if not supplier_row:
+            logger.warning(f"Supplier {supplier} not found in database, skipping")
+            results[supplier] = {"error": "not found"}
+            continue
+        pending[supplier] = start_supplier(supplier, supplier_row)
+
+    # Suppliers run concurrently; one failing doesn't cancel the others
+    outcomes = await asyncio.gather(*pending.values(), return_exceptions=True)
+    for supplier, outcome in zip(pending, outcomes):
+        if isinstance(outcome, Exception):
+            logger.error(
+                f"Failed to start negotiation with supplier {supplier}: {outcome}"
+            )
+            results[supplier] = _supplier_error(outcome)
+        else:
+            results[supplier] = outcome
+
+    # Unknown suppliers were filled in first; report in request order
+    results = {supplier: results[supplier] for supplier in request.suppliers}
+    await _save_negotiation_results(db, ng_id, product["product_id"], results)
+
+    usage = sum((agent.usage for agent in agents), TokenUsage())
+    log_token_usage(usage, model)
 
     # Store session for later reference
     active_sessions[ng_id] = session
@@ -641,15 +3455,555 @@ async def trigger_negotiations(request: NegotiationRequest) -> dict[str, Any]:
         f"Negotiation {ng_id} started successfully with {len(request.suppliers)} suppliers"
     )
 
-    return {
+    response: dict[str, Any] = {
         "negotiation_id": ng_id,
         "status": "started",
         "suppliers": request.suppliers,
+        "results": results,
+        "usage": asdict(usage),
+    }
+    if config.moderate_output:
+        # None for suppliers whose reply never reached moderation
+        response["moderation"] = {
+            supplier: None for supplier in request.suppliers
+        } | {agent.sup_id: agent.moderation for agent in agents}
+    return response
+
+
+@app.get("/negotiations")
+async def list_negotiations(
+    request: Request,
+    response: Response,
+    limit: Optional[str] = None,
+    offset: Optional[str] = None,
+    product_id: Optional[str] = None,
+    supplier_id: Optional[str] = None,
+) -> dict[str, Any]:
+    page_limit, page_offset, warning = _parse_pagination(limit, offset)
+
+    params: list[Any] = []
+    conditions = []
+    if product_id:
+        product_id = _normalize_id(product_id)
+        if not _uuid_key(product_id):
+            raise HTTPException(status_code=400, detail="product_id must be a UUID")
+        params.append(product_id)
+        conditions.append(f"n.product_id = ${len(params)}::uuid")
+    if supplier_id:
+        # Results are stored per supplier, failed and withheld ones included
+        params.append(_normalize_id(supplier_id))
+        conditions.append(
+            "EXISTS (SELECT 1 FROM negotiation_result r "
+            f"WHERE r.ng_id = n.ng_id AND r.supplier_id = ${len(params)})"
+        )
+    where = f"WHERE {' AND '.join(conditions)}" if conditions else ""
+
+    db = await get_pool()
+    total = await db.fetchval(f"SELECT COUNT(*) FROM negotiation n {where}", *params)
+    rows = await db.fetch(
+        f"""
+        SELECT n.ng_id, n.product_id, n.product, n.strategy, n.prompt, n.status,
+               n.created_at
+        FROM negotiation n
+        {where}
+        ORDER BY n.created_at DESC
+        LIMIT ${len(params) + 1} OFFSET ${len(params) + 2}
+        """,
+        *params,
+        page_limit,
+        page_offset,
+    )
+
+    _set_link_header(request, response, page_limit, page_offset, total)
+    return {
+        "data": [
+            {
+                "negotiation_id": str(row["ng_id"]),
+                "product_id": str(row["product_id"]) if row["product_id"] else None,
+                "product": row["product"],
+                "strategy": row["strategy"],
+                "prompt": row["prompt"],
+                "status": row["status"],
+                "created_at": row["created_at"].isoformat()
+                if row["created_at"]
+                else None,
+            }
+            for row in rows
+        ],
+        "limit": page_limit,
+        **({"warning": warning} if warning else {}),
+        "offset": page_offset,
+        "total": total,
+    }
+
+
+class SupplierResponse(BaseModel):
+    supplier_id: str = Field(min_length=1)
+    supplier_name: str | None = None
+    text: str = Field(min_length=1)
+
+
+class CompareRequest(BaseModel):
+    # Either a stored negotiation or the responses themselves
+    negotiation_id: str | None = None
+    responses: list[SupplierResponse] | None = Field(
+        default=None, max_length=MAX_SUPPLIERS_PER_NEGOTIATION
+    )
+    product: str | None = None
+    model: str | None = None
+
+
+COMPARE_SYSTEM_PROMPT = (
+    "You are a procurement analyst comparing supplier replies for a buyer. "
+    "Answer with a JSON array only, no prose and no markdown."
+)
+
+
+def _parse_ranking(
+    text: str, responses: list[SupplierResponse]
+) -> list[dict[str, Any]]:
+    """
+    Turn the model's JSON ranking into ordered entries. Unknown supplier IDs
+    are dropped and suppliers the model left out are appended unscored, so
+    every response appears exactly once.
+    """
+    match = re.search(r"\[.*\]", strip_reasoning_tokens(text), re.DOTALL)
+    try:
+        entries = json.loads(match.group(0)) if match else None
+    except ValueError:
+        entries = None
+    if not isinstance(entries, list):
+        raise BedrockResponseError("ranking is not a JSON array")
+
+    by_id = {response.supplier_id: response for response in responses}
+    ranked: list[dict[str, Any]] = []
+    for entry in entries:
+        if not isinstance(entry, dict):
+            continue
+        response = by_id.pop(str(entry.get("supplier_id")), None)
+        if response is None:
+            continue
+        score = entry.get("score")
+        ranked.append(
+            {
+                "supplier_id": response.supplier_id,
+                "supplier_name": response.supplier_name,
+                "score": score if isinstance(score, (int, float)) else None,
+                "rationale": str(entry.get("rationale") or ""),
+            }
+        )
+    ranked.sort(key=lambda entry: -(entry["score"] or 0))
+    for response in by_id.values():
+        ranked.append(
+            {
+                "supplier_id": response.supplier_id,
+                "supplier_name": response.supplier_name,
+                "score": None,
+                "rationale": "not ranked by the model",
+            }
+        )
+    return [{"rank": rank, **entry} for rank, entry in enumerate(ranked, start=1)]
+
+
+async def _stored_supplier_responses(
+    negotiation_id: str,
+) -> tuple[str, list[SupplierResponse]]:
+    """Product and each supplier's latest reply for a stored negotiation."""
+    db = await get_pool()
+    try:
+        product = await db.fetchval(
+            "SELECT product FROM negotiation WHERE ng_id = $1", negotiation_id
+        )
+    except asyncpg.DataError:
+        product = None
+    if product is None:
+        raise HTTPException(status_code=404, detail="Negotiation not found")
+    rows = await db.fetch(
+        """
+        SELECT DISTINCT ON (m.supplier_id)
+               m.supplier_id, s.supplier_name, m.message_text
+        FROM message m
+        LEFT JOIN supplier s ON s.supplier_id = m.supplier_id
+        WHERE m.ng_id = $1 AND m.role = 'supplier'
+        ORDER BY m.supplier_id, m.message_timestamp DESC
+        """,
+        negotiation_id,
+    )
+    return product, [
+        SupplierResponse(
+            supplier_id=str(row["supplier_id"]),
+            supplier_name=row["supplier_name"],
+            text=row["message_text"],
+        )
+        for row in rows
+        if row["message_text"]
+    ]
+
+
+@app.post(
+    "/negotiations/compare", dependencies=[Depends(require_feature("compare"))]
+)
+async def compare_negotiation_responses(request: CompareRequest) -> dict[str, Any]:
+    """Rank supplier replies from most to least favorable for the buyer."""
+    if (request.negotiation_id is None) == (request.responses is None):
+        raise HTTPException(
+            status_code=400,
+            detail="provide exactly one of negotiation_id or responses",
+        )
+    model = resolve_model(request.model)
+    product = request.product
+    responses = request.responses or []
+    if request.negotiation_id is not None:
+        stored_product, responses = await _stored_supplier_responses(
+            request.negotiation_id
+        )
+        product = product or stored_product
+    if not responses:
+        raise HTTPException(status_code=409, detail="no supplier responses to compare")
+    if len({response.supplier_id for response in responses}) != len(responses):
+        raise HTTPException(
+            status_code=400, detail="supplier_id values must be unique"
+        )
+
+    result: dict[str, Any] = {"negotiation_id": request.negotiation_id}
+    if len(responses) == 1:
+        # Nothing to compare against, so don't spend a Bedrock call on it
+        only = responses[0]
+        result["ranking"] = [
+            {
+                "rank": 1,
+                "supplier_id": only.supplier_id,
+                "supplier_name": only.supplier_name,
+                "score": None,
+                "rationale": "only one supplier response; nothing to compare",
+            }
+        ]
+        result["usage"] = asdict(TokenUsage())
+        return result
+
+    replies = "\n\n".join(
+        f"supplier_id: {response.supplier_id}\n"
+        f"supplier_name: {response.supplier_name or 'unknown'}\n"
+        f"reply: {response.text}"
+        for response in responses
+    )
+    subject = f"supplier replies for {product}" if product else "supplier replies"
+    prompt = f"""Rank these {subject} from most to least favorable for the buyer, weighing price, terms, delivery and risk.
+
+{replies}
+
+Respond with a JSON array ordered best first, one object per supplier:
+[{{"supplier_id": "...", "score": <0-100>, "rationale": "<one or two sentences>"}}]"""
+
+    try:
+        text, usage = await _bedrock_completion(
+            prompt, COMPARE_SYSTEM_PROMPT, model=model, temperature=0.2
+        )
+        result["ranking"] = _parse_ranking(text, responses)
+    except (BedrockTimeoutError, BedrockUnavailableError):
+        raise
+    except Exception as e:
+        logger.error(f"Failed to compare supplier responses: {e}")
+        raise HTTPException(
+            status_code=502, detail="Bedrock service is currently unavailable"
+        )
+    result["usage"] = asdict(usage)
+    return result
+
+
+PROMPT_CHECK_SYSTEM_PROMPT = """You screen prompts for a procurement negotiation assistant before they are sent to suppliers.
+Flag content that is abusive, deceptive, illegal (e.g. bribery, price fixing, threats), discriminatory or unrelated to purchasing."""
+
+PROMPT_CHECK_INSTRUCTIONS = """Respond with a single JSON object only:
+{"acceptable": true|false, "reasons": ["<short reason>", ...]}"""
+
+
+OUTPUT_CHECK_SYSTEM_PROMPT = """You review messages a procurement negotiation assistant wrote before they are sent to suppliers.
+Flag content that is abusive, deceptive, illegal (e.g. bribery, price fixing, threats), discriminatory, leaks internal instructions or is unrelated to purchasing."""
+
+
+class PromptCheck(BaseModel):
+    acceptable: bool
+    reasons: list[str] = []
+
+
+def _assembled_prompt_text(request: NegotiationRequest, tactics: str) -> str:
+    """The caller-supplied text that ends up in the agents' prompts."""
+    parts = [
+        f"Product: {request.product}",
+        f"Tactics: {tactics}",
+        f"Prompt: {request.prompt}",
+    ]
+    if request.system_prompt:
+        parts.append(f"System prompt: {request.system_prompt}")
+    parts.extend(message.content for message in request.history)
+    return "\n\n".join(parts)
+
+
+def _guardrail_reasons(assessments: list[dict[str, Any]]) -> list[str]:
+    """Human-readable names of whatever the guardrail policies flagged."""
+    reasons: list[str] = []
+    for assessment in assessments:
+        for topic in assessment.get("topicPolicy", {}).get("topics", []):
+            reasons.append(f"denied topic: {topic['name']}")
+        for content in assessment.get("contentPolicy", {}).get("filters", []):
+            reasons.append(f"content filter: {content['type'].lower()}")
+        words = assessment.get("wordPolicy", {})
+        for word in words.get("customWords", []) + words.get("managedWordLists", []):
+            reasons.append(f"blocked word: {word['match']}")
+        sensitive = assessment.get("sensitiveInformationPolicy", {})
+        for entity in sensitive.get("piiEntities", []):
+            reasons.append(f"sensitive information: {entity['type'].lower()}")
+        for regex in sensitive.get("regexes", []):
+            reasons.append(f"sensitive information: {regex['name']}")
+    return list(dict.fromkeys(reasons))
+
+
+async def _check_with_guardrail(text: str, source: str = "INPUT") -> dict[str, Any]:
+    response = await asyncio.wait_for(
+        asyncio.to_thread(
+            bedrock_guardrail_client.apply_guardrail,
+            guardrailIdentifier=config.bedrock_guardrail_id,
+            guardrailVersion=config.bedrock_guardrail_version,
+            source=source,
+            content=[{"text": {"text": text}}],
+        ),
+        timeout=config.bedrock_timeout_seconds,
+    )
+    intervened = response.get("action") == "GUARDRAIL_INTERVENED"
+    return {
+        "acceptable": not intervened,
+        "reasons": _guardrail_reasons(response.get("assessments", []))
+        if intervened
+        else [],
+        "method": "guardrail",
+    }
+
+
+async def _check_with_classifier(
+    text: str, model: str, system_prompt: str = PROMPT_CHECK_SYSTEM_PROMPT
+) -> dict[str, Any]:
+    reply, usage = await _bedrock_completion(
+        f"{text}\n\n{PROMPT_CHECK_INSTRUCTIONS}",
+        system_prompt,
+        model=model,
+        max_tokens=256,
+        temperature=0,
+    )
+    match = re.search(r"\{.*\}", strip_reasoning_tokens(reply), re.DOTALL)
+    if not match:
+        raise BedrockResponseError("prompt check reply contained no JSON object")
+    try:
+        check = PromptCheck.model_validate_json(match.group(0))
+    except ValidationError as e:
+        raise BedrockResponseError(f"prompt check reply was malformed: {e}")
+    return {**check.model_dump(), "method": "classifier", "usage": asdict(usage)}
+
+
+async def _moderate_output(text: str, model: str) -> dict[str, Any]:
+    """
+    Check generated negotiation text before it goes to a supplier. Fails
+    closed: if the check itself errors, the text is flagged.
+    """
+    method = "guardrail" if config.bedrock_guardrail_id else "classifier"
+    try:
+        if config.bedrock_guardrail_id:
+            check = await _check_with_guardrail(text, source="OUTPUT")
+        else:
+            check = await _check_with_classifier(
+                text, model, OUTPUT_CHECK_SYSTEM_PROMPT
+            )
+    except Exception as e:
+        logger.error(f"Output moderation failed: {e}")
+        return {
+            "status": "flagged",
+            "reasons": ["moderation check failed"],
+            "method": method,
+        }
+    return {
+        "status": "pass" if check["acceptable"] else "flagged",
+        "reasons": check["reasons"],
+        "method": method,
+    }
+
+
+@app.post("/negotiations/validate")
+async def validate_negotiation_prompt(request: NegotiationRequest) -> dict[str, Any]:
+    """
+    Check whether a negotiation's prompt would be blocked before running it.
+    Uses the configured Bedrock guardrail, or else a short classification
+    call; nothing is generated for suppliers and nothing is stored.
+    """
+    model = resolve_model(request.model)
+    db = await get_pool()
+    request = await _apply_template(db, request)
+    tactics = await _resolve_tactics(db, request.tactics)
+    text = _assembled_prompt_text(request, tactics)
+    try:
+        if config.bedrock_guardrail_id:
+            return await _check_with_guardrail(text)
+        return await _check_with_classifier(text, model)
+    except (BedrockTimeoutError, BedrockUnavailableError, asyncio.TimeoutError):
+        raise
+    except Exception as e:
+        logger.error(f"Failed to validate negotiation prompt: {e}")
+        raise HTTPException(
+            status_code=502, detail="Bedrock service is currently unavailable"
+        )
+
+
+@app.get("/negotiations/{negotiation_id}")
+async def get_negotiation(negotiation_id: str) -> dict[str, Any]:
+    db = await get_pool()
+    try:
+        negotiation = await db.fetchrow(
+            "SELECT * FROM negotiation WHERE ng_id = $1", negotiation_id
+        )
+    except asyncpg.DataError:
+        negotiation = None
+    if not negotiation:
+        raise HTTPException(status_code=404, detail="Negotiation not found")
+
+    # What /negotiate returned per supplier, failures included
+    rows = await db.fetch(
+        """
+        SELECT r.supplier_id, s.supplier_name, r.product_id, r.generated_text,
+               r.error, r.error_code, r.created_at
+        FROM negotiation_result r
+        LEFT JOIN supplier s ON s.supplier_id::text = r.supplier_id
+        WHERE r.ng_id = $1
+        ORDER BY r.position
+        """,
+        negotiation_id,
+    )
+    results = [
+        {
+            "supplier_id": row["supplier_id"],
+            "supplier_name": row["supplier_name"],
+            "product_id": str(row["product_id"]) if row["product_id"] else None,
+            "generated_text": row["generated_text"],
+            "error": row["error"],
+            "error_code": row["error_code"],
+            "created_at": row["created_at"].isoformat()
+            if row["created_at"]
+            else None,
+        }
+        for row in rows
+    ]
+
+    return {
+        "negotiation_id": str(negotiation["ng_id"]),
+        "product_id": str(negotiation["product_id"])
+        if negotiation["product_id"]
+        else None,
+        "product": negotiation["product"],
+        "strategy": negotiation["strategy"],
+        "prompt": negotiation["prompt"],
+        "status": negotiation["status"],
+        "created_at": negotiation["created_at"].isoformat()
+        if negotiation["created_at"]
+        else None,
+        "results": results,
     }
 
 
+EXPORT_FORMATS = {"markdown": ("text/markdown; charset=utf-8", "md")}
+
+
+def _negotiation_markdown(
+    negotiation: asyncpg.Record, messages: list[asyncpg.Record]
+) -> str:
+    """Render a negotiation with each supplier's opening offer and latest reply."""
+    suppliers: dict[str, dict[str, Any]] = {}
+    for row in messages:
+        supplier = suppliers.setdefault(
+            str(row["supplier_id"]),
+            {"name": row["supplier_name"], "opening": None, "reply": None},
+        )
+        if row["role"] == "negotiator" and supplier["opening"] is None:
+            supplier["opening"] = row["message_text"]
+        elif row["role"] == "supplier":
+            # Rows are oldest first, so the last one wins
+            supplier["reply"] = row["message_text"]
+
+    created_at = negotiation["created_at"]
+    lines = [
+        f"# Negotiation: {negotiation['product']}",
+        "",
+        f"- **Negotiation ID:** {negotiation['ng_id']}",
+        f"- **Status:** {negotiation['status']}",
+        f"- **Started:** {created_at.isoformat() if created_at else 'unknown'}",
+        "",
+        "## Tactics",
+        "",
+        negotiation["strategy"] or "_None_",
+        "",
+        "## Brief",
+        "",
+        negotiation["prompt"] or "_None_",
+    ]
+    for supplier_id, supplier in suppliers.items():
+        lines += [
+            "",
+            f"## {supplier['name'] or 'Supplier'} ({supplier_id})",
+            "",
+            "### Opening message",
+            "",
+            supplier["opening"] or "_Not sent_",
+            "",
+            "### Supplier response",
+            "",
+            supplier["reply"] or "_No response yet_",
+        ]
+    if not suppliers:
+        lines += ["", "_No supplier messages recorded._"]
+    return "\n".join(lines) + "\n"
+
+
+@app.get("/negotiations/{negotiation_id}/export")
+async def export_negotiation(
+    negotiation_id: str, format: str = "markdown"
+) -> Response:
+    if format not in EXPORT_FORMATS:
+        raise HTTPException(
+            status_code=400,
+            detail=f"format must be one of: {', '.join(EXPORT_FORMATS)}",
+        )
+    db = await get_pool()
+    try:
+        negotiation = await db.fetchrow(
+            "SELECT * FROM negotiation WHERE ng_id = $1", negotiation_id
+        )
+    except asyncpg.DataError:
+        negotiation = None
+    if not negotiation:
+        raise HTTPException(status_code=404, detail="Negotiation not found")
+
+    messages = await db.fetch(
+        """
+        SELECT m.supplier_id, s.supplier_name, m.role, m.message_text
+        FROM message m
+        LEFT JOIN supplier s ON s.supplier_id = m.supplier_id
+        WHERE m.ng_id = $1 AND m.role IN ('negotiator', 'supplier')
+        ORDER BY s.supplier_name NULLS LAST, m.supplier_id, m.message_timestamp
+        """,
+        negotiation_id,
+    )
+    media_type, extension = EXPORT_FORMATS[format]
+    return Response(
+        content=_negotiation_markdown(negotiation, messages),
+        media_type=media_type,
+        headers={
+            "Content-Disposition": (
+                f"attachment; filename=negotiation-{negotiation['ng_id']}.{extension}"
+            )
+        },
+    )
+
+
 @app.get("/conversation/{negotiation_id}/{supplier_id}")
 async def get_conversation(negotiation_id: str, supplier_id: str) -> dict[str, Any]:
+    supplier_id = _normalize_id(supplier_id)
     db = await get_pool()
     messages = await db.fetch(
         "SELECT * FROM message WHERE ng_id = $1 AND supplier_id = $2",
@@ -770,7 +4124,7 @@ async def get_negotiation_summary(
     """
     if supplier_id:
         query += " AND ns.supplier_id = $2"
-        params.append(supplier_id)
+        params.append(_normalize_id(supplier_id))
     query += " ORDER BY ns.created_at DESC"
 
     rows = await db.fetch(query, *params)
@@ -841,8 +4195,19 @@ async def get_negotations() -> dict[str, Any]:
 def main() -> None:
     import uvicorn
 
-    port = int(os.environ.get("PORT", "8000"))
-    uvicorn.run("main:app", host="0.0.0.0", port=port, reload=False)
+    # uvicorn handles SIGINT/SIGTERM itself: it stops accepting connections, lets
+    # in-flight requests (e.g. Bedrock calls) finish within the timeout, then runs
+    # the lifespan shutdown which closes the DB pool.
+    uvicorn.run(
+        "main:app",
+        host="0.0.0.0",
+        port=config.port,
+        reload=False,
+        timeout_graceful_shutdown=config.shutdown_timeout,
+        # ProxyHeadersMiddleware applies TRUSTED_PROXIES; uvicorn's own handling
+        # would also trust 127.0.0.1 regardless
+        proxy_headers=False,
+    )
 
 
 if __name__ == "__main__":
@@ -0,0 +1,52 @@
+from typing import Awaitable, Callable
+import time
+
+from fastapi import Request, Response
+from prometheus_client import CONTENT_TYPE_LATEST, Counter, Histogram, generate_latest
+
+HTTP_REQUESTS = Counter(
+    "http_requests_total",
+    "HTTP requests handled, by route template and status",
+    ["method", "path", "status"],
+)
+HTTP_REQUEST_DURATION = Histogram(
+    "http_request_duration_seconds",
+    "HTTP request latency, by route template",
+    ["method", "path"],
+)
+BEDROCK_CALL_DURATION = Histogram(
+    "bedrock_call_duration_seconds",
+    "Latency of Bedrock invoke_model calls, including retries",
+)
+BEDROCK_CALL_ERRORS = Counter(
+    "bedrock_call_errors_total",
+    "Bedrock invoke_model calls that failed after retries",
+)
+
+
+def _route_label(request: Request) -> str:
+    # Use the route template (/suppliers/{supplier_id}) rather than the raw
+    # path so IDs don't explode label cardinality.
+    route = request.scope.get("route")
+    return getattr(route, "path", None) or "unmatched"
+
+
+async def metrics_middleware(
+    request: Request, call_next: Callable[[Request], Awaitable[Response]]
+) -> Response:
+    start = time.perf_counter()
+    status = 500
+    try:
+        response = await call_next(request)
+        status = response.status_code
+        return response
+    finally:
+        path = _route_label(request)
+        HTTP_REQUESTS.labels(request.method, path, str(status)).inc()
+        HTTP_REQUEST_DURATION.labels(request.method, path).observe(
+            time.perf_counter() - start
+        )
+
+
+def metrics_response() -> Response:
+    return Response(generate_latest(), media_type=CONTENT_TYPE_LATEST)
@@ -0,0 +1,494 @@
+from contextvars import ContextVar
+from typing import Any, Awaitable, Callable, Sequence
+import ipaddress
+import json
+import logging
+import math
+import re
+import time
+import uuid
+import zlib
+
+from fastapi import Request, Response
+from fastapi.responses import JSONResponse
+from starlette.datastructures import Headers
+from starlette.types import ASGIApp, Message, Receive, Scope, Send
+
+from errors import error_body
+
+logger = logging.getLogger("negotiation.middleware")
+access_logger = logging.getLogger("negotiation.access")
+
+CallNext = Callable[[Request], Awaitable[Response]]
+
+# Set per request by request_context_middleware; visible to every log record
+# emitted while handling the request, including in worker threads.
+request_id_var: ContextVar[str | None] = ContextVar("request_id", default=None)
+
+
+class RequestIdFilter(logging.Filter):
+    """Attach the current request ID to every log record."""
+
+    def filter(self, record: logging.LogRecord) -> bool:
+        record.request_id = request_id_var.get()
+        return True
+
+
+class JsonFormatter(logging.Formatter):
+    """Render log records as single-line JSON objects."""
+
+    def format(self, record: logging.LogRecord) -> str:
+        entry: dict[str, Any] = {
+            "time": self.formatTime(record),
+            "level": record.levelname,
+            "logger": record.name,
+            "message": record.getMessage(),
+        }
+        request_id = getattr(record, "request_id", None)
+        if request_id:
+            entry["request_id"] = request_id
+        entry.update(getattr(record, "fields", None) or {})
+        if record.exc_info:
+            entry["exc_info"] = self.formatException(record.exc_info)
+        return json.dumps(entry, default=str)
+
+
+def configure_logging(level: int = logging.INFO) -> None:
+    handler = logging.StreamHandler()
+    handler.setFormatter(JsonFormatter())
+    handler.addFilter(RequestIdFilter())
+    # force=True replaces handlers other modules installed via basicConfig
+    logging.basicConfig(level=level, handlers=[handler], force=True)
+
+
+async def request_context_middleware(request: Request, call_next: CallNext) -> Response:
+    """Assign a request ID, echo it as X-Request-ID and log one line per request."""
+    request_id = str(uuid.uuid4())
+    token = request_id_var.set(request_id)
+    start = time.perf_counter()
+    status = 500
+    try:
+        response = await call_next(request)
+        status = response.status_code
+    finally:
+        latency_ms = round((time.perf_counter() - start) * 1000, 2)
+        access_logger.info(
+            f"{request.method} {request.url.path} {status}",
+            extra={
+                "fields": {
+                    "method": request.method,
+                    "path": request.url.path,
+                    "status": status,
+                    "latency_ms": latency_ms,
+                }
+            },
+        )
+        request_id_var.reset(token)
+    response.headers["X-Request-ID"] = request_id
+    return response
+
+
+async def recovery_middleware(request: Request, call_next: CallNext) -> Response:
+    """
+    Turn unhandled exceptions into a JSON 500 carrying the request ID. The
+    stack trace is logged, never sent to the client.
+    """
+    try:
+        return await call_next(request)
+    except Exception:
+        request_id = request_id_var.get()
+        logger.exception(f"Unhandled error in {request.method} {request.url.path}")
+        return JSONResponse(
+            status_code=500,
+            content={
+                **error_body(500, "internal server error"),
+                "request_id": request_id,
+            },
+        )
+
+
+class RateLimiter:
+    """Token bucket per key: refills `rate` tokens per second up to `burst`."""
+
+    def __init__(
+        self, rate: float, burst: int, clock: Callable[[], float] = time.monotonic
+    ) -> None:
+        self.rate = rate
+        self.burst = burst
+        self._clock = clock
+        self._buckets: dict[str, tuple[float, float]] = {}  # key -> (tokens, updated)
+
+    def acquire(self, key: str) -> float:
+        """Take one token for key. Returns 0 on success, else seconds until retry."""
+        now = self._clock()
+        tokens, updated = self._buckets.get(key, (float(self.burst), now))
+        tokens = min(float(self.burst), tokens + (now - updated) * self.rate)
+        if tokens >= 1:
+            self._buckets[key] = (tokens - 1, now)
+            return 0.0
+        self._buckets[key] = (tokens, now)
+        return (1 - tokens) / self.rate
+
+    def prune(self) -> None:
+        """Forget keys whose buckets have refilled completely."""
+        now = self._clock()
+        refill_time = self.burst / self.rate
+        self._buckets = {
+            key: bucket
+            for key, bucket in self._buckets.items()
+            if now - bucket[1] < refill_time
+        }
+
+
+def make_rate_limit_middleware(
+    limiter: RateLimiter,
+    llm_limiter: RateLimiter,
+    is_llm_route: Callable[[Request], bool],
+) -> Callable[[Request, CallNext], Awaitable[Response]]:
+    """
+    Build middleware limiting requests per client IP. Routes matching
+    is_llm_route draw from the (tighter) llm_limiter instead.
+    """
+    calls = 0
+
+    async def rate_limit_middleware(request: Request, call_next: CallNext) -> Response:
+        nonlocal calls
+        active = llm_limiter if is_llm_route(request) else limiter
+        client_ip = request.client.host if request.client else "unknown"
+        wait = active.acquire(client_ip)
+
+        calls += 1
+        if calls % 1000 == 0:
+            limiter.prune()
+            llm_limiter.prune()
+
+        if wait > 0:
+            return JSONResponse(
+                status_code=429,
+                content=error_body(429, "rate limit exceeded"),
+                headers={"Retry-After": str(math.ceil(wait))},
+            )
+        return await call_next(request)
+
+    return rate_limit_middleware
+
+
+class _BodyTooLarge(Exception):
+    pass
+
+
+class BodySizeLimitMiddleware:
+    """
+    Reject request bodies larger than max_bytes with 413. Declared
+    Content-Length is checked up front; chunked bodies are counted as they
+    are read, so oversized uploads are never buffered in full.
+    """
+
+    def __init__(
+        self,
+        app: ASGIApp,
+        max_bytes: int,
+        route_limits: Sequence[tuple[re.Pattern[str], int]] = (),
+    ) -> None:
+        self.app = app
+        self.max_bytes = max_bytes
+        # Per-path overrides, e.g. a larger cap for file uploads
+        self.route_limits = route_limits
+
+    def _limit_for(self, path: str) -> int:
+        for pattern, max_bytes in self.route_limits:
+            if pattern.match(path):
+                return max_bytes
+        return self.max_bytes
+
+    async def __call__(self, scope: Scope, receive: Receive, send: Send) -> None:
+        if scope["type"] != "http":
+            await self.app(scope, receive, send)
+            return
+
+        max_bytes = self._limit_for(scope["path"])
+        content_length = Headers(scope=scope).get("content-length", "")
+        if content_length.isdigit() and int(content_length) > max_bytes:
+            await self._reject(scope, receive, send, max_bytes)
+            return
+
+        received = 0
+        response_started = False
+
+        async def limited_receive() -> Message:
+            nonlocal received
+            message = await receive()
+            if message["type"] == "http.request":
+                received += len(message.get("body", b""))
+                if received > max_bytes:
+                    raise _BodyTooLarge()
+            return message
+
+        async def tracking_send(message: Message) -> None:
+            nonlocal response_started
+            if message["type"] == "http.response.start":
+                response_started = True
+            await send(message)
+
+        try:
+            await self.app(scope, limited_receive, tracking_send)
+        except _BodyTooLarge:
+            if response_started:
+                raise
+            await self._reject(scope, receive, send, max_bytes)
+
+    async def _reject(
+        self, scope: Scope, receive: Receive, send: Send, max_bytes: int
+    ) -> None:
+        response = JSONResponse(
+            status_code=413,
+            content=error_body(413, f"request body exceeds {max_bytes} bytes"),
+        )
+        await response(scope, receive, send)
+
+
+IPNetwork = ipaddress.IPv4Network | ipaddress.IPv6Network
+
+
+class ProxyHeadersMiddleware:
+    """
+    Take the client address from X-Forwarded-For when the connection comes
+    from a trusted proxy. Hops are read right to left and trusted ones
+    skipped, so a client can't pick its own IP by sending the header itself.
+    With no trusted proxies the peer address is always used.
+    """
+
+    def __init__(self, app: ASGIApp, trusted: Sequence[IPNetwork] = ()) -> None:
+        self.app = app
+        self.trusted = trusted
+
+    def _is_trusted(self, host: str) -> bool:
+        try:
+            address = ipaddress.ip_address(host)
+        except ValueError:
+            return False
+        return any(address in network for network in self.trusted)
+
+    async def __call__(self, scope: Scope, receive: Receive, send: Send) -> None:
+        client = scope.get("client")
+        if scope["type"] in ("http", "websocket") and client and self.trusted:
+            host = client[0]
+            if self._is_trusted(host):
+                forwarded = Headers(scope=scope).get("x-forwarded-for", "")
+                hops = [hop.strip() for hop in forwarded.split(",") if hop.strip()]
+                for hop in reversed(hops):
+                    host = hop
+                    if not self._is_trusted(hop):
+                        break
+                scope = {**scope, "client": (host, 0)}
+        await self.app(scope, receive, send)
+
+
+WRITE_METHODS = frozenset({"POST", "PUT", "PATCH"})
+
+
+class JSONContentTypeMiddleware:
+    """
+    Reject write requests whose body isn't declared as application/json with
+    415, before a handler tries to parse it. Requests without a body (most
+    action endpoints) pass through, and route_types lists the media types
+    accepted by routes that take something else, such as file uploads.
+    """
+
+    def __init__(
+        self,
+        app: ASGIApp,
+        route_types: Sequence[tuple[re.Pattern[str], frozenset[str]]] = (),
+    ) -> None:
+        self.app = app
+        self.route_types = route_types
+
+    def _types_for(self, path: str) -> frozenset[str]:
+        for pattern, media_types in self.route_types:
+            if pattern.match(path):
+                return media_types
+        return frozenset({"application/json"})
+
+    async def __call__(self, scope: Scope, receive: Receive, send: Send) -> None:
+        if scope["type"] != "http" or scope["method"] not in WRITE_METHODS:
+            await self.app(scope, receive, send)
+            return
+
+        headers = Headers(scope=scope)
+        has_body = (
+            headers.get("content-length", "0") not in ("", "0")
+            or "transfer-encoding" in headers
+        )
+        media_type = headers.get("content-type", "").split(";")[0].strip().lower()
+        allowed = self._types_for(scope["path"])
+        if not has_body or media_type in allowed:
+            await self.app(scope, receive, send)
+            return
+
+        expected = " or ".join(sorted(allowed))
+        response = JSONResponse(
+            status_code=415,
+            content=error_body(
+                415,
+                f"Content-Type must be {expected}, "
+                f"got {media_type or 'no Content-Type'}",
+            ),
+        )
+        await response(scope, receive, send)
+
+
+class GZipMiddleware:
+    """
+    Gzip response bodies of at least minimum_size bytes for clients that send
+    Accept-Encoding: gzip. Streamed bodies are compressed chunk by chunk and
+    flushed as they go, so nothing is held back; excluded media types (server
+    sent events by default) are passed through untouched.
+    """
+
+    def __init__(
+        self,
+        app: ASGIApp,
+        minimum_size: int = 1024,
+        compresslevel: int = 6,
+        excluded_media_types: Sequence[str] = ("text/event-stream",),
+    ) -> None:
+        self.app = app
+        self.minimum_size = minimum_size
+        self.compresslevel = compresslevel
+        self.excluded_media_types = set(excluded_media_types)
+
+    async def __call__(self, scope: Scope, receive: Receive, send: Send) -> None:
+        if scope["type"] != "http" or "gzip" not in Headers(scope=scope).get(
+            "accept-encoding", ""
+        ):
+            await self.app(scope, receive, send)
+            return
+
+        start: Message = {}
+        passthrough = False
+        compressor: Any = None
+
+        async def compressing_send(message: Message) -> None:
+            nonlocal start, passthrough, compressor
+            if message["type"] == "http.response.start":
+                headers = Headers(raw=message["headers"])
+                media_type = headers.get("content-type", "").split(";")[0].strip()
+                excluded = media_type in self.excluded_media_types
+                if excluded or "content-encoding" in headers:
+                    passthrough = True
+                    await send(message)
+                else:
+                    # Held back until the first body chunk shows whether it's worth it
+                    start = message
+                return
+            if passthrough or message["type"] != "http.response.body":
+                await send(message)
+                return
+
+            body = message.get("body", b"")
+            more_body = message.get("more_body", False)
+            if compressor is None:
+                if not more_body and len(body) < self.minimum_size:
+                    passthrough = True
+                    await send(start)
+                    await send(message)
+                    return
+                compressor = zlib.compressobj(self.compresslevel, zlib.DEFLATED, 31)
+                headers = [
+                    (name, value)
+                    for name, value in start["headers"]
+                    if name.lower() != b"content-length"
+                ]
+                headers.append((b"content-encoding", b"gzip"))
+                headers.append((b"vary", b"Accept-Encoding"))
+                if not more_body:
+                    data = compressor.compress(body) + compressor.flush()
+                    headers.append((b"content-length", str(len(data)).encode()))
+                    await send({**start, "headers": headers})
+                    await send({"type": "http.response.body", "body": data})
+                    return
+                await send({**start, "headers": headers})
+
+            data = compressor.compress(body)
+            data += compressor.flush(zlib.Z_SYNC_FLUSH if more_body else zlib.Z_FINISH)
+            await send(
+                {"type": "http.response.body", "body": data, "more_body": more_body}
+            )
+
+        await self.app(scope, receive, compressing_send)
+
+
+# Never written to the debug log, whatever the log level
+REDACTED_HEADERS = {"authorization", "proxy-authorization", "x-api-key", "cookie"}
+# Values cut off by truncation are still matched, up to the end of the text
+SECRET_FIELD_PATTERN = re.compile(
+    r'("(?:password|secret|token|api_key)"\s*:\s*)"(?:[^"\\]|\\.)*("|$)',
+    re.IGNORECASE,
+)
+
+
+class DebugBodyLogMiddleware:
+    """
+    Log each request's headers and body alongside the response status and
+    size, for chasing bad Bedrock inputs and outputs. Only install it at
+    debug level: bodies carry prompts and supplier details. Credentials are
+    redacted and bodies are truncated to max_body_bytes. The body is copied
+    as the handler reads it, so the handler still sees every byte.
+    """
+
+    def __init__(self, app: ASGIApp, max_body_bytes: int = 4096) -> None:
+        self.app = app
+        self.max_body_bytes = max_body_bytes
+
+    async def __call__(self, scope: Scope, receive: Receive, send: Send) -> None:
+        if scope["type"] != "http":
+            await self.app(scope, receive, send)
+            return
+
+        body = bytearray()
+        body_size = 0
+        status = 500
+        response_size = 0
+
+        async def copying_receive() -> Message:
+            nonlocal body_size
+            message = await receive()
+            if message["type"] == "http.request":
+                chunk = message.get("body", b"")
+                body_size += len(chunk)
+                body.extend(chunk[: self.max_body_bytes - len(body)])
+            return message
+
+        async def measuring_send(message: Message) -> None:
+            nonlocal status, response_size
+            if message["type"] == "http.response.start":
+                status = message["status"]
+            elif message["type"] == "http.response.body":
+                response_size += len(message.get("body", b""))
+            await send(message)
+
+        try:
+            await self.app(scope, copying_receive, measuring_send)
+        finally:
+            headers = {
+                name: "[redacted]" if name in REDACTED_HEADERS else value
+                for name, value in Headers(scope=scope).items()
+            }
+            text = SECRET_FIELD_PATTERN.sub(
+                r'\1"[redacted]"', body.decode("utf-8", errors="replace")
+            )
+            logger.debug(
+                f"{scope['method']} {scope['path']} {status} body: {text}",
+                extra={
+                    "fields": {
+                        "method": scope["method"],
+                        "path": scope["path"],
+                        "request_headers": headers,
+                        "request_body": text,
+                        "request_bytes": body_size,
+                        "request_truncated": body_size > len(body),
+                        "status": status,
+                        "response_bytes": response_size,
+                    }
+                },
+            )
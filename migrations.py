@@ -0,0 +1,59 @@
+from pathlib import Path
+from typing import Any
+import logging
+
+logger = logging.getLogger("negotiation.migrations")
+
+MIGRATIONS_DIR = Path(__file__).parent / "sql" / "migrations"
+
+# Arbitrary key so concurrently starting instances apply migrations one at a time
+MIGRATION_LOCK_KEY = 72_411_730
+
+
+class MigrationError(RuntimeError):
+    pass
+
+
+async def apply_migrations(db_pool: Any, directory: Path = MIGRATIONS_DIR) -> list[str]:
+    """
+    Apply pending sql/migrations/*.sql files in filename order.
+    Applied versions are recorded in schema_migrations, so restarts are no-ops.
+    Everything runs in one transaction: a failing migration leaves the schema
+    untouched and raises MigrationError.
+    """
+    files = sorted(directory.glob("*.sql"))
+    applied_now: list[str] = []
+
+    async with db_pool.acquire() as conn:
+        async with conn.transaction():
+            await conn.execute("SELECT pg_advisory_xact_lock($1)", MIGRATION_LOCK_KEY)
+            await conn.execute(
+                """
+                CREATE TABLE IF NOT EXISTS schema_migrations (
+                    version TEXT PRIMARY KEY,
+                    applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+                )
+                """
+            )
+            rows = await conn.fetch("SELECT version FROM schema_migrations")
+            applied = {row["version"] for row in rows}
+
+            for path in files:
+                version = path.stem
+                if version in applied:
+                    continue
+                logger.info(f"Applying migration {version}...")
+                try:
+                    await conn.execute(path.read_text())
+                except Exception as e:
+                    raise MigrationError(f"Migration {version} failed: {e}") from e
+                await conn.execute(
+                    "INSERT INTO schema_migrations (version) VALUES ($1)", version
+                )
+                applied_now.append(version)
+
+    if applied_now:
+        logger.info(f"Applied migrations: {', '.join(applied_now)}")
+    else:
+        logger.info("Database schema is up to date")
+    return applied_now
@@ -0,0 +1,87 @@
+from typing import Any
+import asyncio
+import sys
+import threading
+import traceback
+import tracemalloc
+
+# Frames kept per allocation; more makes heap profiles clearer and slower
+TRACEBACK_FRAMES = 10
+
+
+def start_heap_tracing() -> None:
+    """
+    Record allocations from now on. Only allocations made after this call
+    show up in heap profiles, so it runs at startup rather than on demand.
+    """
+    if not tracemalloc.is_tracing():
+        tracemalloc.start(TRACEBACK_FRAMES)
+
+
+def heap_profile(limit: int = 25) -> dict[str, Any]:
+    """The `limit` call sites holding the most memory, largest first."""
+    if not tracemalloc.is_tracing():
+        return {"tracing": False, "current_bytes": 0, "peak_bytes": 0, "top": []}
+    current, peak = tracemalloc.get_traced_memory()
+    stats = tracemalloc.take_snapshot().statistics("traceback")
+    return {
+        "tracing": True,
+        "current_bytes": current,
+        "peak_bytes": peak,
+        "top": [
+            {
+                "size_bytes": stat.size,
+                "count": stat.count,
+                # Innermost frame last, as in a Python traceback
+                "traceback": stat.traceback.format(most_recent_first=False),
+            }
+            for stat in stats[:limit]
+        ],
+    }
+
+
+def _await_chain(coro: Any) -> list[str]:
+    """
+    Where a suspended coroutine is waiting, outermost call first. Follows
+    cr_await down the chain, which Task.get_stack() doesn't.
+    """
+    stack = []
+    while coro is not None:
+        frame = getattr(coro, "cr_frame", None) or getattr(coro, "gi_frame", None)
+        if frame is not None:
+            code = frame.f_code
+            stack.append(f"{code.co_filename}:{frame.f_lineno} in {code.co_name}")
+        coro = getattr(coro, "cr_await", None) or getattr(coro, "gi_yieldfrom", None)
+    return stack
+
+
+def task_dump() -> dict[str, Any]:
+    """Every asyncio task on the running loop and where it's waiting."""
+    tasks = sorted(asyncio.all_tasks(), key=lambda task: task.get_name())
+    return {
+        "count": len(tasks),
+        "tasks": [
+            {
+                "name": task.get_name(),
+                "coro": getattr(task.get_coro(), "__qualname__", None),
+                "stack": _await_chain(task.get_coro()),
+            }
+            for task in tasks
+        ],
+    }
+
+
+def thread_dump() -> dict[str, Any]:
+    """Every thread's current stack, e.g. blocking Bedrock calls in to_thread."""
+    names = {thread.ident: thread.name for thread in threading.enumerate()}
+    frames = sys._current_frames()
+    return {
+        "count": len(frames),
+        "threads": [
+            {
+                "name": names.get(ident, str(ident)),
+                "stack": [line.rstrip("\n") for line in traceback.format_stack(frame)],
+            }
+            for ident, frame in sorted(frames.items())
+        ],
+    }
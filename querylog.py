@@ -0,0 +1,37 @@
+from typing import Any
+import logging
+
+logger = logging.getLogger("negotiation.db")
+
+
+class SlowQueryLogger:
+    """
+    asyncpg query logger that reports statements slower than `threshold_ms`.
+    Register it on every pooled connection via `install`. Log records pick up
+    the request ID from RequestIdFilter like any other record.
+    """
+
+    def __init__(self, threshold_ms: float) -> None:
+        self.threshold_ms = threshold_ms
+
+    def __call__(self, record: Any) -> None:
+        duration_ms = record.elapsed * 1000
+        if duration_ms < self.threshold_ms:
+            return
+        # Collapse whitespace so multi-line SQL stays on one log line; arguments
+        # are left out because they can carry supplier emails and prompts
+        query = " ".join(record.query.split())
+        logger.warning(
+            f"Slow query ({duration_ms:.0f}ms): {query}",
+            extra={
+                "fields": {
+                    "query": query,
+                    "duration_ms": round(duration_ms, 2),
+                    "failed": record.exception is not None,
+                }
+            },
+        )
+
+    async def install(self, conn: Any) -> None:
+        """Pool `init` hook; runs once for every new connection."""
+        conn.add_query_logger(self)
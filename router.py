@@ -4,6 +4,7 @@ import asyncio
 import logging
 
 from agents import NegotiationAgent, OrchestratorAgent
+from bedrock import BedrockInvoker
 
 logger = logging.getLogger("negotiation.router")
 
@@ -111,7 +112,7 @@ class NegotiationSession:
     def __init__(
         self,
         db_pool: Any,
-        client: Any,
+        client: BedrockInvoker,
         ng_id: str,
         orchestrator: OrchestratorAgent,
         router: EmailEventRouter,
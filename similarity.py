@@ -0,0 +1,64 @@
+from typing import Sequence
+import hashlib
+import math
+
+
+def embedding_key(model_id: str, text: str) -> str:
+    """Identifies an embedding by what produced it, to tell when it's stale."""
+    return hashlib.sha256(f"{model_id}\0{text}".encode()).hexdigest()
+
+
+def cosine_similarity(a: Sequence[float], b: Sequence[float]) -> float:
+    """Cosine of the angle between two vectors; 0.0 if either is all zeros."""
+    if len(a) != len(b):
+        raise ValueError(f"vector lengths differ: {len(a)} != {len(b)}")
+    norms = math.sqrt(sum(x * x for x in a)) * math.sqrt(sum(y * y for y in b))
+    if not norms:
+        return 0.0
+    return sum(x * y for x, y in zip(a, b)) / norms
+
+
+def cluster_by_similarity(
+    vectors: dict[str, Sequence[float]], threshold: float
+) -> list[tuple[list[str], float]]:
+    """
+    Group ids whose vectors are at least `threshold` similar, directly or
+    through a chain of similar pairs. Each group comes with its weakest link:
+    the lowest similarity needed to hold it together. Ids without a match are
+    left out; groups and the ids within them keep input order.
+    """
+    ids = list(vectors)
+    parent = {id_: id_ for id_ in ids}
+    weakest: dict[str, float] = {}
+
+    def root(id_: str) -> str:
+        while parent[id_] != id_:
+            parent[id_] = parent[parent[id_]]
+            id_ = parent[id_]
+        return id_
+
+    pairs = [
+        (cosine_similarity(vectors[a], vectors[b]), a, b)
+        for i, a in enumerate(ids)
+        for b in ids[i + 1 :]
+    ]
+    # Strongest pairs first, so a group's weakest link doesn't depend on order
+    pairs.sort(key=lambda pair: pair[0], reverse=True)
+    for score, a, b in pairs:
+        if score < threshold:
+            break
+        root_a, root_b = root(a), root(b)
+        if root_a == root_b:
+            continue
+        links = [score, weakest.pop(root_a, 1.0), weakest.pop(root_b, 1.0)]
+        parent[root_b] = root_a
+        weakest[root_a] = min(links)
+
+    groups: dict[str, list[str]] = {}
+    for id_ in ids:
+        groups.setdefault(root(id_), []).append(id_)
+    return [
+        (members, weakest[group_root])
+        for group_root, members in groups.items()
+        if len(members) > 1
+    ]
@@ -0,0 +1,2 @@
+-- Keep the user's negotiation prompt alongside the stored negotiation
+ALTER TABLE negotiation ADD COLUMN IF NOT EXISTS prompt TEXT;
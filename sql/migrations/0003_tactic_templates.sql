@@ -0,0 +1,7 @@
+-- Reusable negotiation tactics; NegotiationRequest.tactics may name one by ID
+CREATE TABLE IF NOT EXISTS tactic (
+    tactic_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    name TEXT NOT NULL UNIQUE,
+    tactic_text TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
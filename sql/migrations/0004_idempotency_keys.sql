@@ -0,0 +1,11 @@
+-- Responses to POST /negotiate keyed by the client's Idempotency-Key header.
+-- A NULL response marks a request that is still running.
+CREATE TABLE IF NOT EXISTS idempotency_key (
+    key TEXT PRIMARY KEY,
+    fingerprint TEXT NOT NULL,
+    response JSONB,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_key_created_at_idx
+    ON idempotency_key (created_at);
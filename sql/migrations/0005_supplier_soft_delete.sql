@@ -0,0 +1,2 @@
+-- Suppliers are hidden rather than removed, since products reference them
+ALTER TABLE supplier ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
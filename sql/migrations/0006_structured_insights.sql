@@ -0,0 +1,3 @@
+-- Insights parsed into strengths/risks/recommended_approach; NULL when the
+-- model's output couldn't be parsed and only the text in `insights` is kept
+ALTER TABLE supplier ADD COLUMN IF NOT EXISTS insights_structured JSONB;
@@ -0,0 +1,4 @@
+-- Free-form categories (e.g. logistics, raw materials) for filtering suppliers
+ALTER TABLE supplier ADD COLUMN IF NOT EXISTS tags TEXT[] NOT NULL DEFAULT '{}';
+
+CREATE INDEX IF NOT EXISTS supplier_tags_idx ON supplier USING GIN (tags);
@@ -0,0 +1,9 @@
+-- Current unit price, given to the negotiator as an anchor. Both are NULL
+-- for products nobody has priced yet.
+ALTER TABLE product ADD COLUMN IF NOT EXISTS price NUMERIC(12, 2)
+    CHECK (price >= 0);
+ALTER TABLE product ADD COLUMN IF NOT EXISTS currency CHAR(3);
+
+ALTER TABLE product DROP CONSTRAINT IF EXISTS product_price_currency_check;
+ALTER TABLE product ADD CONSTRAINT product_price_currency_check
+    CHECK ((price IS NULL) = (currency IS NULL));
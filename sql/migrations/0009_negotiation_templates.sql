@@ -0,0 +1,10 @@
+-- Saved prompts and tactics; NegotiationRequest.template_id fills in the
+-- fields a request leaves out
+CREATE TABLE IF NOT EXISTS negotiation_template (
+    template_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    name TEXT NOT NULL UNIQUE,
+    prompt TEXT NOT NULL,
+    tactics TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
@@ -0,0 +1,10 @@
+-- Description embeddings for GET /suppliers/duplicates, kept off the supplier
+-- table so its SELECT * responses don't carry a thousand floats each.
+-- embedding_key hashes the model and the text embedded; a changed description
+-- or model is re-embedded on the next call and everything else is reused.
+CREATE TABLE IF NOT EXISTS supplier_embedding (
+    supplier_id UUID PRIMARY KEY REFERENCES supplier(supplier_id) ON DELETE CASCADE,
+    embedding REAL[] NOT NULL,
+    embedding_key TEXT NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
@@ -0,0 +1,26 @@
+-- When suppliers and products were created and last changed, for sorting
+-- and filtering by recency. Existing rows get the time this migration ran.
+ALTER TABLE supplier ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+ALTER TABLE supplier ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+ALTER TABLE product ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+ALTER TABLE product ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+CREATE INDEX IF NOT EXISTS supplier_created_at_idx ON supplier (created_at);
+CREATE INDEX IF NOT EXISTS product_created_at_idx ON product (created_at);
+
+-- A trigger rather than SET updated_at = now() in each handler, so every
+-- write (tags, images, insights, soft deletes) keeps it current
+CREATE OR REPLACE FUNCTION set_updated_at() RETURNS trigger AS $$
+BEGIN
+    NEW.updated_at = now();
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS supplier_set_updated_at ON supplier;
+CREATE TRIGGER supplier_set_updated_at BEFORE UPDATE ON supplier
+    FOR EACH ROW EXECUTE FUNCTION set_updated_at();
+
+DROP TRIGGER IF EXISTS product_set_updated_at ON product;
+CREATE TRIGGER product_set_updated_at BEFORE UPDATE ON product
+    FOR EACH ROW EXECUTE FUNCTION set_updated_at();
@@ -0,0 +1,32 @@
+-- What POST /negotiate returned for each supplier, errors included, so
+-- GET /negotiations/{id} shows failed and withheld suppliers too.
+-- supplier_id is the ID as requested and may not name a real supplier.
+CREATE TABLE IF NOT EXISTS negotiation_result (
+    ng_id UUID NOT NULL REFERENCES negotiation(ng_id) ON DELETE CASCADE,
+    supplier_id TEXT NOT NULL,
+    -- Order of the supplier in the request
+    position INTEGER NOT NULL,
+    generated_text TEXT,
+    error TEXT,
+    error_code TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (ng_id, supplier_id),
+    CHECK ((generated_text IS NULL) <> (error IS NULL))
+);
+
+-- Earlier negotiations only have their opening messages; the first
+-- negotiator message per supplier is what /negotiate returned for it
+INSERT INTO negotiation_result (ng_id, supplier_id, position, generated_text, created_at)
+SELECT ng_id, supplier_id::text,
+       row_number() OVER (PARTITION BY ng_id ORDER BY supplier_id) - 1,
+       message_text, message_timestamp
+FROM (
+    SELECT DISTINCT ON (ng_id, supplier_id)
+           ng_id, supplier_id, message_text, message_timestamp
+    FROM message
+    WHERE role = 'negotiator'
+      AND supplier_id IS NOT NULL
+      AND ng_id IN (SELECT ng_id FROM negotiation)
+    ORDER BY ng_id, supplier_id, message_timestamp
+) first_messages
+ON CONFLICT DO NOTHING;
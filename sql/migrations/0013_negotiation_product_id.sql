@@ -0,0 +1,22 @@
+-- The catalog product a negotiation ran for. The product column only holds
+-- its name, which isn't unique and changes on rename. Earlier negotiations
+-- get an ID where their name matches exactly one product; the rest stay NULL.
+ALTER TABLE negotiation ADD COLUMN IF NOT EXISTS product_id UUID
+    REFERENCES product(product_id);
+ALTER TABLE negotiation_result ADD COLUMN IF NOT EXISTS product_id UUID
+    REFERENCES product(product_id);
+CREATE INDEX IF NOT EXISTS negotiation_product_id_idx ON negotiation (product_id);
+CREATE INDEX IF NOT EXISTS negotiation_result_product_id_idx
+    ON negotiation_result (product_id);
+CREATE INDEX IF NOT EXISTS negotiation_result_supplier_id_idx
+    ON negotiation_result (supplier_id);
+
+UPDATE negotiation n
+SET product_id = (SELECT p.product_id FROM product p WHERE p.product_name = n.product)
+WHERE n.product_id IS NULL
+  AND (SELECT COUNT(*) FROM product p WHERE p.product_name = n.product) = 1;
+
+UPDATE negotiation_result r
+SET product_id = n.product_id
+FROM negotiation n
+WHERE n.ng_id = r.ng_id AND r.product_id IS NULL;
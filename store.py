@@ -0,0 +1,161 @@
+from datetime import datetime
+from typing import Any, Protocol
+
+import asyncpg
+
+from dbretry import with_db_retry
+
+SUPPLIER_SORT_COLUMNS = {"supplier_id", "supplier_name", "created_at"}
+
+
+def _supplier_order_by(sort: str) -> str:
+    """
+    ORDER BY for "col" / "-col", ending in supplier_id so rows with equal
+    sort values keep a fixed order and pages don't skip or repeat them.
+    """
+    column = sort.removeprefix("-")
+    if column not in SUPPLIER_SORT_COLUMNS:
+        raise ValueError(
+            f"sort must be one of: {', '.join(sorted(SUPPLIER_SORT_COLUMNS))}"
+        )
+    direction = "DESC" if sort.startswith("-") else "ASC"
+    if column == "supplier_id":
+        return f"ORDER BY supplier_id {direction}"
+    return f"ORDER BY {column} {direction}, supplier_id ASC"
+
+
+class Store(Protocol):
+    """
+    Data access used by the HTTP handlers. Rows come back as plain dicts so
+    handlers don't depend on asyncpg; lookups return None (or False) when
+    nothing matches, including for IDs that aren't valid UUIDs.
+    """
+
+    async def list_suppliers(
+        self,
+        limit: int,
+        offset: int,
+        include_deleted: bool = False,
+        tag: str | None = None,
+        sort: str = "supplier_id",
+        created_after: datetime | None = None,
+    ) -> tuple[list[dict[str, Any]], int]:
+        """
+        One page of suppliers and the total number matching the filters.
+        sort is a column, "-" prefixed for descending; raises ValueError for
+        columns that can't be sorted on. created_after is exclusive.
+        """
+        ...
+
+    async def get_supplier(
+        self, supplier_id: str, include_deleted: bool = False
+    ) -> dict[str, Any] | None: ...
+
+    async def delete_supplier(self, supplier_id: str) -> bool:
+        """Soft-delete an active supplier; False if there was none."""
+        ...
+
+    async def get_product(self, product_id: str) -> dict[str, Any] | None:
+        """
+        The product and its price, joined with its supplier's name,
+        description and image.
+        """
+        ...
+
+
+class PgStore:
+    """Store backed by the asyncpg pool. Reads retry transient failures."""
+
+    def __init__(self, pool: asyncpg.Pool) -> None:
+        self.pool = pool
+
+    async def list_suppliers(
+        self,
+        limit: int,
+        offset: int,
+        include_deleted: bool = False,
+        tag: str | None = None,
+        sort: str = "supplier_id",
+        created_after: datetime | None = None,
+    ) -> tuple[list[dict[str, Any]], int]:
+        order_by = _supplier_order_by(sort)
+        conditions = [] if include_deleted else ["deleted_at IS NULL"]
+        args: list[Any] = []
+        if tag is not None:
+            args.append(tag)
+            # Containment rather than ANY() so the GIN index on tags is used
+            conditions.append(f"tags @> ARRAY[${len(args)}]::text[]")
+        if created_after is not None:
+            args.append(created_after)
+            conditions.append(f"created_at > ${len(args)}")
+        where = f"WHERE {' AND '.join(conditions)}" if conditions else ""
+        total = await with_db_retry(
+            lambda: self.pool.fetchval(f"SELECT COUNT(*) FROM supplier {where}", *args)
+        )
+        rows = await with_db_retry(
+            lambda: self.pool.fetch(
+                f"SELECT * FROM supplier {where} {order_by} "
+                f"LIMIT ${len(args) + 1} OFFSET ${len(args) + 2}",
+                *args,
+                limit,
+                offset,
+            )
+        )
+        return [dict(row) for row in rows], total
+
+    async def get_supplier(
+        self, supplier_id: str, include_deleted: bool = False
+    ) -> dict[str, Any] | None:
+        try:
+            row = await with_db_retry(
+                lambda: self.pool.fetchrow(
+                    "SELECT * FROM supplier WHERE supplier_id = $1"
+                    + ("" if include_deleted else " AND deleted_at IS NULL"),
+                    supplier_id,
+                )
+            )
+        except asyncpg.DataError:
+            # Malformed UUIDs can't match any supplier
+            return None
+        return dict(row) if row else None
+
+    async def delete_supplier(self, supplier_id: str) -> bool:
+        # Soft delete: products still reference the row, so it is only hidden
+        try:
+            deleted = await self.pool.fetchval(
+                """
+                UPDATE supplier SET deleted_at = now()
+                WHERE supplier_id = $1 AND deleted_at IS NULL
+                RETURNING supplier_id
+                """,
+                supplier_id,
+            )
+        except asyncpg.DataError:
+            return False
+        return deleted is not None
+
+    async def get_product(self, product_id: str) -> dict[str, Any] | None:
+        try:
+            row = await with_db_retry(
+                lambda: self.pool.fetchrow(
+                    """
+                    SELECT p.product_id,
+                           p.product_name,
+                           p.price,
+                           p.currency,
+                           p.created_at,
+                           p.updated_at,
+                           p.supplier_id,
+                           s.supplier_name,
+                           s.description,
+                           s.image_url
+                    FROM product p
+                    JOIN supplier s ON s.supplier_id = p.supplier_id
+                    WHERE p.product_id = $1
+                    """,
+                    product_id,
+                )
+            )
+        except asyncpg.DataError:
+            return None
+        return dict(row) if row else None
@@ -1,6 +1,9 @@
+import io
+import json
 import pytest
 import asyncio
 from unittest.mock import MagicMock, AsyncMock
+from bedrock import breaker
 
 
 # Mock record class to simulate asyncpg.Record
@@ -14,7 +17,9 @@ def mock_db_pool():
     pool = AsyncMock()
     connection = AsyncMock()
 
-    # Setup connection context manager
+    # Setup connection context manager (acquire()/transaction() are sync in asyncpg)
+    pool.acquire = MagicMock()
+    connection.transaction = MagicMock()
     pool.acquire.return_value.__aenter__.return_value = connection
     pool.acquire.return_value.__aexit__.return_value = None
 
@@ -32,4 +37,31 @@ def mock_db_pool():
 @pytest.fixture
 def mock_bedrock_client():
     client = MagicMock()
-    return client
\ No newline at end of file
+    return client
+
+
+class FakeBedrockClient:
+    """BedrockInvoker returning canned completions in order; records request bodies."""
+
+    def __init__(self, *replies):
+        self.replies = list(replies)
+        self.requests = []
+
+    def invoke_model(self, **kwargs):
+        self.requests.append(json.loads(kwargs["body"]))
+        completion = {
+            "choices": [{"message": {"content": self.replies.pop(0)}}],
+            "usage": {"prompt_tokens": 10, "completion_tokens": 5, "total_tokens": 15},
+        }
+        return {"body": io.BytesIO(json.dumps(completion).encode())}
+
+    def invoke_model_with_response_stream(self, **kwargs):
+        raise NotImplementedError("streaming isn't faked")
+
+@pytest.fixture(autouse=True)
+def reset_bedrock_breaker():
+    # The breaker is process-wide; keep failures in one test from tripping it
+    # for the next
+    breaker.record_success()
+    yield
+    breaker.record_success()
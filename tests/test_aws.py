@@ -0,0 +1,43 @@
+from datetime import datetime, timezone
+from unittest.mock import MagicMock, patch
+
+import pytest
+from aws import AssumeRoleError, aws_session
+
+
+def test_session_without_role_uses_profile():
+    with patch("aws.boto3.Session") as mock_session:
+        session = aws_session("eu-west-1", profile="procurement")
+
+    mock_session.assert_called_once_with(
+        profile_name="procurement", region_name="eu-west-1"
+    )
+    assert session is mock_session.return_value
+
+
+def test_session_assumes_role():
+    sts = MagicMock()
+    sts.assume_role.return_value = {
+        "Credentials": {
+            "AccessKeyId": "AKIA",
+            "SecretAccessKey": "secret",
+            "SessionToken": "token",
+            "Expiration": datetime(2030, 1, 1, tzinfo=timezone.utc),
+        }
+    }
+    with patch("aws.boto3.Session") as mock_session:
+        mock_session.return_value.client.return_value = sts
+        aws_session("eu-west-1", role_arn="arn:aws:iam::123:role/bedrock")
+
+    assert sts.assume_role.call_args[1]["RoleArn"] == "arn:aws:iam::123:role/bedrock"
+    credentials = mock_session.call_args[1]["botocore_session"].get_credentials()
+    assert credentials.access_key == "AKIA"
+
+
+def test_session_fails_clearly_when_role_cannot_be_assumed():
+    with patch("aws.boto3.Session") as mock_session:
+        mock_session.return_value.client.return_value.assume_role.side_effect = (
+            RuntimeError("AccessDenied")
+        )
+        with pytest.raises(AssumeRoleError, match="could not assume role arn:aws"):
+            aws_session("eu-west-1", role_arn="arn:aws:iam::123:role/bedrock")
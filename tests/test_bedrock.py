@@ -0,0 +1,331 @@
+import json
+import pytest
+import time
+from unittest.mock import patch, MagicMock, AsyncMock
+from botocore.exceptions import (
+    EndpointConnectionError,
+    NoCredentialsError,
+    ReadTimeoutError,
+)
+from bedrock import (
+    BedrockResponseError,
+    BedrockTimeoutError,
+    BedrockUnavailableError,
+    CircuitBreaker,
+    RegionalBedrockClient,
+    TokenUsage,
+    invoke_model_with_retry,
+    is_retryable_error,
+    open_response_stream,
+    parse_completion,
+    parse_embedding,
+    validate_generation_params,
+)
+
+
+class FakeClientError(Exception):
+    """Mimics botocore's ClientError, which exposes the parsed error as .response"""
+
+    def __init__(self, code, status=400):
+        super().__init__(code)
+        self.response = {
+            "Error": {"Code": code},
+            "ResponseMetadata": {"HTTPStatusCode": status},
+        }
+
+
+def test_is_retryable_error():
+    assert is_retryable_error(FakeClientError("ThrottlingException", 429))
+    assert is_retryable_error(FakeClientError("SomethingElse", 503))
+    assert not is_retryable_error(FakeClientError("ValidationException", 400))
+    assert not is_retryable_error(ValueError("boom"))
+
+
+def test_is_retryable_error_connection_failures():
+    endpoint = "https://bedrock-runtime.eu-central-1.amazonaws.com"
+    assert is_retryable_error(EndpointConnectionError(endpoint_url=endpoint))
+    assert is_retryable_error(ReadTimeoutError(endpoint_url=endpoint))
+    assert not is_retryable_error(NoCredentialsError())
+
+
+@pytest.mark.parametrize(
+    "max_tokens, temperature, valid",
+    [
+        (1, 0.0, True),
+        (4096, 1.0, True),
+        (0, 0.5, False),
+        (4097, 0.5, False),
+        (1024, -0.1, False),
+        (1024, 1.1, False),
+    ],
+)
+def test_validate_generation_params(max_tokens, temperature, valid):
+    if valid:
+        validate_generation_params(max_tokens, temperature)
+    else:
+        with pytest.raises(ValueError):
+            validate_generation_params(max_tokens, temperature)
+
+
+def test_token_usage_from_response():
+    usage = TokenUsage.from_response(
+        {"usage": {"prompt_tokens": 12, "completion_tokens": 30, "total_tokens": 42}}
+    )
+
+    assert usage == TokenUsage(12, 30, 42)
+    assert usage + TokenUsage(1, 2, 3) == TokenUsage(13, 32, 45)
+    # Responses without a usage block count as zero
+    assert TokenUsage.from_response({"choices": []}) == TokenUsage()
+
+
+def test_parse_completion():
+    body = json.dumps(
+        {
+            "choices": [{"message": {"role": "assistant", "content": "Hello"}}],
+            "usage": {"prompt_tokens": 3, "completion_tokens": 1, "total_tokens": 4},
+        }
+    )
+
+    assert parse_completion(body.encode()) == ("Hello", TokenUsage(3, 1, 4))
+
+
+@pytest.mark.parametrize(
+    "body",
+    [
+        b"not json",
+        b"[]",
+        b"{}",
+        b'{"choices": []}',
+        b'{"choices": [{"text": "Hello"}]}',
+        b'{"choices": [{"message": {"content": null}}]}',
+        b'{"choices": [{"message": "Hello"}]}',
+        # Anthropic-style body from a model we don't parse
+        b'{"content": [{"type": "text", "text": "Hello"}]}',
+    ],
+)
+def test_parse_completion_rejects_unexpected_shapes(body):
+    with pytest.raises(BedrockResponseError, match="unexpected Bedrock response"):
+        parse_completion(body)
+
+
+def test_parse_embedding():
+    body = json.dumps({"embedding": [0.5, -1, 0.25], "inputTextTokenCount": 4})
+
+    assert parse_embedding(body.encode()) == [0.5, -1.0, 0.25]
+
+
+@pytest.mark.parametrize(
+    "body",
+    [b"not json", b"{}", b'{"embedding": []}', b'{"embedding": ["a", "b"]}'],
+)
+def test_parse_embedding_rejects_unexpected_shapes(body):
+    with pytest.raises(BedrockResponseError, match="unexpected Bedrock embedding"):
+        parse_embedding(body)
+
+
+@pytest.mark.asyncio
+async def test_invoke_retries_throttling_then_succeeds():
+    client = MagicMock()
+    client.invoke_model.side_effect = [
+        FakeClientError("ThrottlingException", 429),
+        FakeClientError("ServiceUnavailableException", 503),
+        {"body": "ok"},
+    ]
+
+    with patch("bedrock.asyncio.sleep", new_callable=AsyncMock) as mock_sleep:
+        result = await invoke_model_with_retry(client, modelId="m")
+
+    assert result == {"body": "ok"}
+    assert client.invoke_model.call_count == 3
+    assert mock_sleep.call_count == 2
+
+
+@pytest.mark.asyncio
+async def test_invoke_does_not_retry_validation_errors():
+    client = MagicMock()
+    client.invoke_model.side_effect = FakeClientError("ValidationException", 400)
+
+    with patch("bedrock.asyncio.sleep", new_callable=AsyncMock) as mock_sleep:
+        with pytest.raises(FakeClientError):
+            await invoke_model_with_retry(client, modelId="m")
+
+    assert client.invoke_model.call_count == 1
+    mock_sleep.assert_not_called()
+
+
+@pytest.mark.asyncio
+async def test_invoke_retries_connection_errors():
+    client = MagicMock()
+    client.invoke_model.side_effect = [
+        EndpointConnectionError(endpoint_url="https://bedrock-runtime"),
+        {"body": "ok"},
+    ]
+
+    with patch("bedrock.asyncio.sleep", new_callable=AsyncMock):
+        response = await invoke_model_with_retry(client, modelId="m")
+
+    assert response == {"body": "ok"}
+    assert client.invoke_model.call_count == 2
+
+
+@pytest.mark.asyncio
+async def test_invoke_gives_up_after_max_retries():
+    client = MagicMock()
+    client.invoke_model.side_effect = FakeClientError("ThrottlingException", 429)
+
+    with patch("bedrock.asyncio.sleep", new_callable=AsyncMock):
+        with pytest.raises(FakeClientError):
+            await invoke_model_with_retry(client, modelId="m")
+
+    assert client.invoke_model.call_count == 4
+
+
+@pytest.mark.asyncio
+async def test_invoke_times_out():
+    client = MagicMock()
+    client.invoke_model.side_effect = lambda **kwargs: time.sleep(0.5)
+
+    with pytest.raises(BedrockTimeoutError, match="within 0.05 seconds"):
+        await invoke_model_with_retry(client, timeout=0.05, modelId="m")
+
+
+class FakeClock:
+    def __init__(self):
+        self.now = 0.0
+
+    def __call__(self):
+        return self.now
+
+
+def test_breaker_opens_after_consecutive_failures():
+    clock = FakeClock()
+    breaker = CircuitBreaker(failure_threshold=3, reset_timeout=30, clock=clock)
+
+    for _ in range(2):
+        breaker.before_call()
+        breaker.record_failure()
+    breaker.record_success()
+    for _ in range(3):
+        breaker.before_call()
+        breaker.record_failure()
+
+    assert breaker.state == "open"
+    clock.now = 10
+    with pytest.raises(BedrockUnavailableError) as exc_info:
+        breaker.before_call()
+    assert exc_info.value.retry_after == 20
+
+
+def test_breaker_half_open_allows_one_probe():
+    clock = FakeClock()
+    breaker = CircuitBreaker(failure_threshold=1, reset_timeout=30, clock=clock)
+    breaker.record_failure()
+
+    clock.now = 30
+    assert breaker.state == "half_open"
+    breaker.before_call()
+    with pytest.raises(BedrockUnavailableError):
+        breaker.before_call()
+
+    breaker.record_failure()
+    assert breaker.state == "open"
+
+    clock.now = 60
+    breaker.before_call()
+    breaker.record_success()
+    assert breaker.state == "closed"
+
+
+@pytest.mark.asyncio
+async def test_invoke_short_circuits_when_breaker_open():
+    client = MagicMock()
+    client.invoke_model.side_effect = FakeClientError("ThrottlingException", 429)
+
+    with patch("bedrock.asyncio.sleep", new_callable=AsyncMock), patch(
+        "bedrock.breaker", CircuitBreaker(failure_threshold=1)
+    ):
+        with pytest.raises(FakeClientError):
+            await invoke_model_with_retry(client, modelId="m")
+        with pytest.raises(BedrockUnavailableError):
+            await invoke_model_with_retry(client, modelId="m")
+
+    assert client.invoke_model.call_count == 4
+
+
+@pytest.mark.asyncio
+async def test_invoke_client_errors_do_not_trip_breaker():
+    client = MagicMock()
+    client.invoke_model.side_effect = FakeClientError("ValidationException", 400)
+
+    with patch("bedrock.breaker", CircuitBreaker(failure_threshold=1)) as breaker:
+        with pytest.raises(FakeClientError):
+            await invoke_model_with_retry(client, modelId="m")
+
+    assert breaker.state == "closed"
+
+
+@pytest.mark.asyncio
+async def test_invoke_connection_errors_trip_breaker():
+    client = MagicMock()
+    # botocore's EndpointConnectionError and friends carry no .response
+    client.invoke_model.side_effect = OSError("Could not connect to the endpoint")
+
+    with patch("bedrock.asyncio.sleep", new_callable=AsyncMock), patch(
+        "bedrock.breaker", CircuitBreaker(failure_threshold=1)
+    ) as breaker:
+        with pytest.raises(OSError):
+            await invoke_model_with_retry(client, modelId="m")
+
+    assert breaker.state == "open"
+
+
+def test_open_response_stream_counts_failures():
+    client = MagicMock()
+    client.invoke_model_with_response_stream.side_effect = FakeClientError(
+        "InternalServerException", 500
+    )
+
+    with patch("bedrock.breaker", CircuitBreaker(failure_threshold=1)):
+        with pytest.raises(FakeClientError):
+            open_response_stream(client, modelId="m")
+        with pytest.raises(BedrockUnavailableError):
+            open_response_stream(client, modelId="m")
+
+    assert client.invoke_model_with_response_stream.call_count == 1
+
+
+def test_regional_client_fails_over_on_region_errors(caplog):
+    primary, fallback = MagicMock(), MagicMock()
+    primary.invoke_model.side_effect = FakeClientError("ResourceNotFoundException")
+    fallback.invoke_model.return_value = {"body": "ok"}
+    client = RegionalBedrockClient([("us-east-1", primary), ("us-west-2", fallback)])
+
+    with caplog.at_level("INFO", logger="negotiation.bedrock"):
+        assert client.invoke_model(modelId="m") == {"body": "ok"}
+
+    fallback.invoke_model.assert_called_once_with(modelId="m")
+    assert "failing over to us-west-2" in caplog.text
+    assert "served from us-west-2" in caplog.text
+
+
+def test_regional_client_raises_other_errors_from_primary():
+    primary, fallback = MagicMock(), MagicMock()
+    primary.invoke_model_with_response_stream.side_effect = FakeClientError(
+        "ThrottlingException", 429
+    )
+    client = RegionalBedrockClient([("us-east-1", primary), ("us-west-2", fallback)])
+
+    with pytest.raises(FakeClientError):
+        client.invoke_model_with_response_stream(modelId="m")
+
+    fallback.invoke_model_with_response_stream.assert_not_called()
+
+
+def test_regional_client_raises_when_last_region_fails():
+    primary = MagicMock()
+    primary.invoke_model.side_effect = FakeClientError(
+        "ServiceUnavailableException", 503
+    )
+
+    with pytest.raises(FakeClientError):
+        RegionalBedrockClient([("us-east-1", primary)]).invoke_model(modelId="m")
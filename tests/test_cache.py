@@ -0,0 +1,61 @@
+import pytest
+from cache import ListCache, etag_for, etag_matches
+
+
+class FakeClock:
+    def __init__(self):
+        self.now = 0.0
+
+    def __call__(self):
+        return self.now
+
+
+def test_entries_expire_after_ttl():
+    clock = FakeClock()
+    cache = ListCache(30, clock=clock)
+    cache.set("/suppliers?[]", {"data": []})
+
+    clock.now = 29.9
+    assert cache.get("/suppliers?[]").body == {"data": []}
+    clock.now = 30
+    assert cache.get("/suppliers?[]") is None
+
+
+def test_zero_ttl_never_stores():
+    cache = ListCache(0)
+
+    entry = cache.set("key", {"data": [1]})
+
+    assert entry.etag == etag_for({"data": [1]})
+    assert cache.get("key") is None
+
+
+def test_clear():
+    cache = ListCache(30)
+    cache.set("a", {})
+    cache.set("b", {})
+
+    cache.clear()
+
+    assert cache.get("a") is None and cache.get("b") is None
+
+
+def test_etag_is_stable_across_key_order():
+    assert etag_for({"a": 1, "b": 2}) == etag_for({"b": 2, "a": 1})
+    assert etag_for({"a": 1}) != etag_for({"a": 2})
+
+
+@pytest.mark.parametrize(
+    "header, expected",
+    [
+        (None, False),
+        ("", False),
+        ('"abc"', True),
+        ('W/"abc"', True),
+        ('"xyz", "abc"', True),
+        ('"xyz"', False),
+        ("*", True),
+    ],
+)
+def test_etag_matches(header, expected):
+    assert etag_matches(header, '"abc"') is expected
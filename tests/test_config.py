@@ -0,0 +1,192 @@
+import logging
+
+import pytest
+from config import ConfigError, env_file_candidates, load_config, load_env_file
+
+
+def test_load_config_defaults():
+    config = load_config({"DB_URL": "postgresql://u@db/app"})
+
+    assert config.database_url == "postgresql://u@db/app"
+    assert config.port == 8000
+    assert config.allowed_origins == ()
+    assert config.run_migrations is True
+    assert config.ready_check_bedrock is False
+    assert config.debug is False
+    assert config.log_level == logging.INFO
+    assert config.features == frozenset()
+    assert (config.version, config.commit, config.build_time) == (
+        "dev",
+        "unknown",
+        "unknown",
+    )
+
+
+def test_load_config_parses_values():
+    config = load_config(
+        {
+            "DB_URL": "postgresql://u@db/app",
+            "PORT": "9000",
+            "APP_ENV": "Development",
+            "FRONTEND_ORIGINS": "https://a.example, https://b.example",
+            "API_KEYS": "k1,k2",
+            "RATE_LIMIT_LLM_RPS": "0.25",
+            "RUN_MIGRATIONS": "false",
+            "LOG_LEVEL": "WARN",
+            "APP_VERSION": "1.4.0",
+            "GIT_COMMIT": "f2937b2",
+            "FEATURE_COMPARE": "True",
+            "FEATURE_STREAMING": "off",
+        }
+    )
+
+    assert config.port == 9000
+    assert config.debug is True
+    assert config.allowed_origins == ("https://a.example", "https://b.example")
+    assert config.api_keys == {"k1", "k2"}
+    assert config.rate_limit_llm_rps == 0.25
+    assert config.run_migrations is False
+    assert config.log_level == logging.WARNING
+    assert config.version == "1.4.0"
+    assert config.commit == "f2937b2"
+    assert config.features == {"compare"}
+
+
+@pytest.mark.parametrize(
+    "environ, expected",
+    [
+        (
+            {"DB_URL": "postgresql://u@db/app", "PGHOST": "ignored"},
+            "postgresql://u@db/app",
+        ),
+        (
+            {"PGHOST": "db", "PGUSER": "app", "PGPASSWORD": "p@ss", "PGDATABASE": "ng"},
+            "postgresql://app:p%40ss@db:5432/ng",
+        ),
+        (
+            {"PGHOST": "db", "PGPORT": "6543", "PGUSER": "app", "PGDATABASE": "neg"},
+            "postgresql://app@db:6543/neg",
+        ),
+    ],
+)
+def test_database_url_falls_back_to_pg_vars(environ, expected):
+    assert load_config(environ).database_url == expected
+
+
+def test_load_config_reports_every_error():
+    with pytest.raises(ConfigError) as excinfo:
+        load_config(
+            {
+                "PGHOST": "db",
+                "PORT": "eighty",
+                "RATE_LIMIT_RPS": "0",
+                "DB_MIN_CONNS": "20",
+                "LOG_LEVEL": "verbose",
+            }
+        )
+
+    errors = excinfo.value.errors
+    assert errors == [
+        "LOG_LEVEL must be one of debug, info, warn, warning, error, got 'verbose'",
+        "DB_URL is not set and neither are PGUSER, PGDATABASE",
+        "PORT must be a number, got 'eighty'",
+        "RATE_LIMIT_RPS must be greater than 0",
+        "DB_MIN_CONNS must not exceed DB_MAX_CONNS",
+    ]
+
+
+def test_bedrock_fallback_region():
+    environ = {"DB_URL": "postgresql://u@db/app", "AWS_REGION": "us-east-1"}
+
+    assert load_config(environ).bedrock_fallback_region is None
+    assert (
+        load_config({**environ, "BEDROCK_FALLBACK_REGION": "us-west-2"})
+        .bedrock_fallback_region
+        == "us-west-2"
+    )
+    with pytest.raises(ConfigError) as excinfo:
+        load_config({**environ, "BEDROCK_FALLBACK_REGION": "us-east-1"})
+    assert excinfo.value.errors == [
+        "BEDROCK_FALLBACK_REGION must differ from AWS_REGION"
+    ]
+
+
+def test_duplicate_similarity_threshold():
+    environ = {"DB_URL": "postgresql://u@db/app"}
+
+    assert load_config(environ).duplicate_similarity_threshold == 0.9
+    assert (
+        load_config({**environ, "DUPLICATE_SIMILARITY_THRESHOLD": "0.8"})
+        .duplicate_similarity_threshold
+        == 0.8
+    )
+    with pytest.raises(ConfigError) as excinfo:
+        load_config({**environ, "DUPLICATE_SIMILARITY_THRESHOLD": "1.5"})
+    assert excinfo.value.errors == ["DUPLICATE_SIMILARITY_THRESHOLD must be at most 1"]
+
+
+def test_moderate_output():
+    environ = {"DB_URL": "postgresql://u@db/app"}
+
+    assert load_config(environ).moderate_output is False
+    assert load_config({**environ, "MODERATE_OUTPUT": "TRUE"}).moderate_output is True
+
+
+def test_enable_pprof_requires_api_keys():
+    environ = {"DB_URL": "postgresql://u@db/app", "ENABLE_PPROF": "true"}
+
+    assert load_config({**environ, "API_KEYS": "secret"}).enable_pprof is True
+    with pytest.raises(ConfigError) as excinfo:
+        load_config(environ)
+    assert excinfo.value.errors == ["ENABLE_PPROF requires API_KEYS"]
+
+
+def test_admin_api_keys_must_be_api_keys():
+    environ = {"DB_URL": "postgresql://u@db/app", "API_KEYS": "k1,k2"}
+
+    config = load_config({**environ, "ADMIN_API_KEYS": "k2"})
+    assert config.admin_api_keys == {"k2"}
+    with pytest.raises(ConfigError) as excinfo:
+        load_config({**environ, "ADMIN_API_KEYS": "k3"})
+    assert excinfo.value.errors == ["ADMIN_API_KEYS must also be listed in API_KEYS"]
+
+
+def test_trusted_proxies():
+    environ = {"DB_URL": "postgresql://u@db/app"}
+
+    assert load_config(environ).trusted_proxies == ()
+    config = load_config({**environ, "TRUSTED_PROXIES": "10.0.0.0/8, 2001:db8::/32"})
+    assert [str(network) for network in config.trusted_proxies] == [
+        "10.0.0.0/8",
+        "2001:db8::/32",
+    ]
+    with pytest.raises(ConfigError) as excinfo:
+        load_config({**environ, "TRUSTED_PROXIES": "10.0.0.0/8,alb"})
+    assert excinfo.value.errors == ["TRUSTED_PROXIES has an invalid CIDR: 'alb'"]
+
+
+def test_env_file_real_environment_wins(tmp_path):
+    env_file = tmp_path / "custom.env"
+    env_file.write_text("DB_URL=postgresql://file@db/app\nPORT=9000\n")
+    environ = {"ENV_FILE": str(env_file), "PORT": "8080"}
+
+    assert load_env_file(environ) == env_file
+    assert environ["DB_URL"] == "postgresql://file@db/app"
+    assert environ["PORT"] == "8080"
+
+
+def test_env_file_defaults_to_working_directory(tmp_path, monkeypatch):
+    monkeypatch.chdir(tmp_path)
+    (tmp_path / ".env").write_text("LOG_LEVEL=debug\n")
+    environ = {}
+
+    assert load_env_file(environ) == tmp_path / ".env"
+    assert environ == {"LOG_LEVEL": "debug"}
+
+
+def test_missing_env_file_is_not_an_error(tmp_path):
+    environ = {"ENV_FILE": str(tmp_path / "missing.env")}
+
+    assert load_env_file(environ) is None
+    assert env_file_candidates(environ) == [tmp_path / "missing.env"]
+    assert environ == {"ENV_FILE": str(tmp_path / "missing.env")}
@@ -0,0 +1,62 @@
+from unittest.mock import AsyncMock, patch
+
+import asyncpg
+import pytest
+from dbretry import MAX_DB_RETRIES, is_retryable_db_error, with_db_retry
+
+
+@pytest.mark.parametrize(
+    "exc, retryable",
+    [
+        (asyncpg.SerializationError("could not serialize access"), True),
+        (asyncpg.DeadlockDetectedError("deadlock detected"), True),
+        (asyncpg.AdminShutdownError("terminating connection"), True),
+        (asyncpg.CannotConnectNowError("the database system is starting up"), True),
+        (asyncpg.ConnectionFailureError("connection failure"), True),
+        (asyncpg.ConnectionDoesNotExistError("connection was closed"), True),
+        (ConnectionResetError("reset by peer"), True),
+        (asyncpg.DataError("invalid input syntax for type uuid"), False),
+        (asyncpg.UniqueViolationError("duplicate key"), False),
+        (asyncpg.QueryCanceledError("statement timeout"), False),
+        (asyncpg.InterfaceError("another operation is in progress"), False),
+        (ValueError("not a database error"), False),
+    ],
+)
+def test_is_retryable_db_error(exc, retryable):
+    assert is_retryable_db_error(exc) is retryable
+
+
+@pytest.mark.asyncio
+async def test_with_db_retry_recovers_from_transient_errors():
+    query = AsyncMock(
+        side_effect=[asyncpg.AdminShutdownError("terminating connection"), 7]
+    )
+
+    with patch("dbretry.asyncio.sleep", new_callable=AsyncMock) as sleep:
+        assert await with_db_retry(query) == 7
+
+    assert query.await_count == 2
+    sleep.assert_awaited_once()
+
+
+@pytest.mark.asyncio
+async def test_with_db_retry_gives_up_after_max_retries():
+    query = AsyncMock(side_effect=asyncpg.SerializationError("serialize"))
+
+    with patch("dbretry.asyncio.sleep", new_callable=AsyncMock):
+        with pytest.raises(asyncpg.SerializationError):
+            await with_db_retry(query)
+
+    assert query.await_count == MAX_DB_RETRIES + 1
+
+
+@pytest.mark.asyncio
+async def test_with_db_retry_raises_permanent_errors_immediately():
+    query = AsyncMock(side_effect=asyncpg.DataError("bad uuid"))
+
+    with patch("dbretry.asyncio.sleep", new_callable=AsyncMock) as sleep:
+        with pytest.raises(asyncpg.DataError):
+            await with_db_retry(query)
+
+    assert query.await_count == 1
+    sleep.assert_not_awaited()
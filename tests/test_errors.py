@@ -0,0 +1,34 @@
+import asyncpg
+import pytest
+from errors import APIError, error_body, from_db_error
+
+
+@pytest.mark.parametrize(
+    "exc, status, code",
+    [
+        (asyncpg.UniqueViolationError("dup"), 409, "already_exists"),
+        (asyncpg.ForeignKeyViolationError("fk"), 409, "conflict"),
+        (asyncpg.DataError("bad uuid"), 400, "invalid_request"),
+        (asyncpg.NotNullViolationError("null"), 400, "invalid_request"),
+        (asyncpg.QueryCanceledError("statement timeout"), 504, "timeout"),
+        (asyncpg.InterfaceError("pool is closed"), 503, "unavailable"),
+        (ConnectionRefusedError("refused"), 503, "unavailable"),
+        (asyncpg.PostgresError("boom"), 500, "internal_error"),
+    ],
+)
+def test_from_db_error(exc, status, code):
+    error = from_db_error(exc)
+
+    assert (error.status_code, error.code) == (status, code)
+    assert str(exc) not in error.message
+    assert str(exc) in error.internal
+
+
+def test_api_error_body_defaults_code_from_status():
+    error = APIError(404, "supplier not found")
+
+    assert error.body() == {"detail": "supplier not found", "code": "not_found"}
+
+
+def test_error_body_unknown_status():
+    assert error_body(418, "teapot") == {"detail": "teapot", "code": "error"}
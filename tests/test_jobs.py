@@ -0,0 +1,70 @@
+import asyncio
+
+import pytest
+from jobs import JobRegistry
+
+
+@pytest.mark.asyncio
+async def test_job_runs_to_completion():
+    registry = JobRegistry()
+
+    async def work(job):
+        job.total = 2
+        job.succeeded = 2
+
+    job = registry.start("test", work)
+    assert registry.get(job.job_id) is job
+    await asyncio.sleep(0)
+    await asyncio.sleep(0)
+
+    assert job.status == "done"
+    assert job.to_dict()["succeeded"] == 2
+    assert job.finished_at is not None
+
+
+@pytest.mark.asyncio
+async def test_job_failure_is_recorded():
+    registry = JobRegistry()
+
+    async def work(job):
+        raise RuntimeError("no suppliers table")
+
+    job = registry.start("test", work)
+    await asyncio.sleep(0)
+    await asyncio.sleep(0)
+
+    assert job.status == "failed"
+    assert job.error == "no suppliers table"
+
+
+@pytest.mark.asyncio
+async def test_registry_forgets_oldest_finished_jobs():
+    registry = JobRegistry(max_jobs=2)
+
+    async def work(job):
+        pass
+
+    first = registry.start("test", work)
+    await asyncio.sleep(0)
+    await asyncio.sleep(0)
+    second = registry.start("test", work)
+    third = registry.start("test", work)
+
+    assert registry.get(first.job_id) is None
+    assert registry.get(second.job_id) is second
+    assert registry.get(third.job_id) is third
+
+
+@pytest.mark.asyncio
+async def test_shutdown_cancels_running_jobs():
+    registry = JobRegistry()
+
+    async def work(job):
+        await asyncio.sleep(60)
+
+    job = registry.start("test", work)
+    await asyncio.sleep(0)
+    await registry.shutdown()
+
+    assert job.status == "failed"
+    assert job.error == "cancelled"
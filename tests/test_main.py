@@ -1,15 +1,46 @@
+import asyncio
+import json
+import re
+import time
 import pytest
+import asyncpg
+import idempotency
 from fastapi.testclient import TestClient
-from unittest.mock import patch, AsyncMock
-from main import app
-from tests.conftest import MockRecord
+from dataclasses import replace
+from datetime import datetime, timezone
+from decimal import Decimal
+from urllib.parse import parse_qs, urlsplit
+from unittest.mock import call, patch, AsyncMock, MagicMock
+from agents import WITHHELD_REPLY
+from bedrock import BedrockTimeoutError, TokenUsage, breaker as bedrock_breaker
+from fastapi import HTTPException
+from similarity import embedding_key
+from main import (
+    MAX_SYSTEM_PROMPT_LENGTH,
+    NegotiationRequest,
+    allowed_origins,
+    app,
+    _connect_db_with_retry,
+    api_key_auth,
+    config,
+    _iter_stream_events,
+    _like_pattern,
+    _moderate_output,
+    get_store,
+    list_cache,
+    llm_rate_limiter,
+    rate_limiter,
+)
+from tests.conftest import FakeBedrockClient, MockRecord
 
 
 @pytest.fixture
 def client(mock_db_pool):
     # Patch 'main.get_pool' so direct calls in endpoints return our mock pool
     # Patch 'asyncpg.create_pool' so the lifespan startup doesn't try to connect to real DB
+    # Patch 'main.apply_migrations' so startup doesn't run schema SQL against the mock
     with patch("main.get_pool", new_callable=AsyncMock) as mock_get_pool, \
+            patch("main.apply_migrations", new_callable=AsyncMock), \
             patch("asyncpg.create_pool", new_callable=AsyncMock) as mock_create_pool:
         mock_get_pool.return_value = mock_db_pool
         mock_create_pool.return_value = mock_db_pool  # Lifespan will get this mock
@@ -18,10 +49,324 @@ def client(mock_db_pool):
             yield test_client
 
 
+@pytest.fixture(autouse=True)
+def reset_rate_limits():
+    # The limiters and list cache are module-level; without this the LLM
+    # routes' small burst runs out partway through the suite, and list tests
+    # see each other's cached pages
+    rate_limiter._buckets.clear()
+    llm_rate_limiter._buckets.clear()
+    list_cache.clear()
+
+
 def test_health(client):
     response = client.get("/health")
     assert response.status_code == 200
     assert response.json() == {"status": "ok"}
+    assert response.headers["X-Request-ID"]
+
+
+@pytest.mark.parametrize(
+    "headers, status",
+    [
+        ({}, 401),
+        ({"Authorization": "Bearer wrong"}, 401),
+        ({"Authorization": "Bearer secret"}, 200),
+        ({"X-API-Key": "secret"}, 200),
+    ],
+)
+def test_api_key_required(client, mock_db_pool, headers, status):
+    mock_db_pool.fetchval.return_value = 0
+    with patch.object(api_key_auth, "keys", {"secret"}):
+        response = client.get("/suppliers", headers=headers)
+
+    assert response.status_code == status
+
+
+def test_health_exempt_from_api_key(client):
+    with patch.object(api_key_auth, "keys", {"secret"}):
+        response = client.get("/health")
+
+    assert response.status_code == 200
+
+
+def test_cors_preflight(client):
+    origin = "https://app.example"
+    if allowed_origins != ["*"]:
+        origin = allowed_origins[0]
+
+    with patch.object(api_key_auth, "keys", {"secret"}):
+        response = client.options(
+            "/suppliers",
+            headers={
+                "Origin": origin,
+                "Access-Control-Request-Method": "GET",
+                "Access-Control-Request-Headers": "X-API-Key",
+            },
+        )
+
+    # Answered by the middleware, before API key auth
+    assert response.status_code == 200
+    assert response.headers["Access-Control-Allow-Origin"] == origin
+    assert "GET" in response.headers["Access-Control-Allow-Methods"]
+    assert "x-api-key" in response.headers["Access-Control-Allow-Headers"].lower()
+
+
+def test_version(client):
+    build = replace(config, version="1.4.0", commit="abc123", build_time="2026-10-01")
+    with patch("main.config", build), patch.object(api_key_auth, "keys", {"secret"}):
+        response = client.get("/version")
+
+    assert response.status_code == 200
+    assert response.json() == {
+        "version": "1.4.0",
+        "commit": "abc123",
+        "build_time": "2026-10-01",
+    }
+
+
+def test_openapi_spec_documents_routes_and_models(client):
+    response = client.get("/openapi.json")
+
+    assert response.status_code == 200
+    spec = response.json()
+    assert {"/suppliers", "/products", "/negotiate"} <= spec["paths"].keys()
+    assert {"Supplier", "Product", "NegotiationRequest"} <= spec["components"][
+        "schemas"
+    ].keys()
+    params = {p["name"] for p in spec["paths"]["/products"]["get"]["parameters"]}
+    assert params == {"limit", "offset", "sort", "supplier_id", "cursor"}
+
+
+def test_swagger_ui_served(client):
+    response = client.get("/swagger")
+
+    assert response.status_code == 200
+    assert "swagger-ui" in response.text
+
+
+def test_metrics_exposes_request_counts(client):
+    client.get("/health")
+
+    response = client.get("/metrics")
+
+    assert response.status_code == 200
+    assert 'http_requests_total{method="GET",path="/health",status="200"}' in response.text
+
+
+def test_unknown_route_returns_json(client):
+    response = client.get("/does-not-exist")
+
+    assert response.status_code == 404
+    assert response.json() == {
+        "detail": "not found",
+        "code": "not_found",
+        "path": "/does-not-exist",
+    }
+
+
+def test_wrong_method_returns_json(client):
+    response = client.delete("/health")
+
+    assert response.status_code == 405
+    assert response.json() == {
+        "detail": "method not allowed",
+        "code": "method_not_allowed",
+    }
+
+
+def test_unhandled_error_returns_json(client):
+    with patch("main._check_database", side_effect=RuntimeError("pool is None")):
+        response = client.get("/ready")
+
+    assert response.status_code == 500
+    assert response.json() == {
+        "detail": "internal server error",
+        "code": "internal_error",
+        "request_id": response.headers["X-Request-ID"],
+    }
+    assert "pool is None" not in response.text
+
+
+@pytest.mark.parametrize(
+    "app_env, debug",
+    [("production", False), ("staging", False), ("development", True), ("debug", True)],
+)
+def test_debug_mode_follows_app_env(app_env, debug):
+    assert replace(config, app_env=app_env).debug is debug
+    # Set when the app is built, before any route is registered
+    assert app.debug is config.debug
+
+
+@pytest.mark.asyncio
+async def test_connect_db_retries_until_database_is_up(mock_db_pool):
+    retrying = replace(config, db_connect_retries=3, db_connect_retry_delay=2.0)
+    refused = ConnectionRefusedError("connection refused")
+
+    with patch("main.asyncpg.create_pool", new_callable=AsyncMock) as mock_create, \
+            patch("main.asyncio.sleep", new_callable=AsyncMock) as mock_sleep:
+        mock_create.side_effect = [refused, refused, mock_db_pool]
+        db = await _connect_db_with_retry(retrying)
+
+    assert db is mock_db_pool
+    assert mock_create.call_count == 3
+    assert mock_sleep.await_args_list == [call(2.0), call(2.0)]
+    mock_db_pool.fetchval.assert_awaited_once_with("SELECT 1")
+
+
+@pytest.mark.asyncio
+async def test_connect_db_gives_up_after_retries():
+    retrying = replace(config, db_connect_retries=2, db_connect_retry_delay=0.5)
+
+    with patch("main.asyncpg.create_pool", new_callable=AsyncMock) as mock_create, \
+            patch("main.asyncio.sleep", new_callable=AsyncMock) as mock_sleep:
+        mock_create.side_effect = ConnectionRefusedError("connection refused")
+        with pytest.raises(RuntimeError) as excinfo:
+            await _connect_db_with_retry(retrying)
+
+    assert str(excinfo.value) == (
+        "Could not connect to database after 2 attempts: connection refused"
+    )
+    assert isinstance(excinfo.value.__cause__, ConnectionRefusedError)
+    assert mock_create.call_count == 2
+    # No pointless wait after the last attempt
+    mock_sleep.assert_awaited_once_with(0.5)
+
+
+@pytest.mark.asyncio
+async def test_connect_db_applies_pool_settings(mock_db_pool):
+    sized = replace(
+        config,
+        db_min_conns=5,
+        db_max_conns=40,
+        db_max_conn_idle_time=60.0,
+        db_max_queries=1000,
+        db_command_timeout=7.5,
+    )
+
+    with patch("main.asyncpg.create_pool", new_callable=AsyncMock) as mock_create:
+        mock_create.return_value = mock_db_pool
+        await _connect_db_with_retry(sized)
+
+    kwargs = mock_create.call_args[1]
+    assert mock_create.call_args[0] == (sized.database_url,)
+    assert kwargs["min_size"] == 5
+    assert kwargs["max_size"] == 40
+    assert kwargs["max_inactive_connection_lifetime"] == 60.0
+    assert kwargs["max_queries"] == 1000
+    assert kwargs["command_timeout"] == 7.5
+
+
+def test_shutdown_closes_pool(mock_db_pool):
+    with patch("main._connect_db_with_retry", new_callable=AsyncMock) as connect, \
+            patch("main.apply_migrations", new_callable=AsyncMock):
+        connect.return_value = mock_db_pool
+        with TestClient(app):
+            mock_db_pool.close.assert_not_called()
+
+    # Closed only once the lifespan shutdown runs, after in-flight requests
+    mock_db_pool.close.assert_awaited_once()
+
+
+def test_query_timeout_returns_504(client, mock_db_pool):
+    # What asyncpg raises once DB_COMMAND_TIMEOUT elapses
+    mock_db_pool.fetch.side_effect = asyncio.TimeoutError()
+    mock_db_pool.fetchval.side_effect = asyncio.TimeoutError()
+
+    response = client.get("/suppliers")
+
+    assert response.status_code == 504
+    assert response.json() == {"detail": "Request timed out", "code": "timeout"}
+
+
+def test_ready(client, mock_db_pool):
+    mock_db_pool.fetchval.return_value = 1
+
+    response = client.get("/ready")
+
+    assert response.status_code == 200
+    assert response.json()["checks"]["database"]["status"] == "ok"
+
+
+def test_ready_database_down(client, mock_db_pool):
+    mock_db_pool.fetchval.side_effect = ConnectionError("connection refused")
+
+    response = client.get("/ready")
+
+    assert response.status_code == 503
+    database = response.json()["checks"]["database"]
+    assert database["status"] == "error"
+    # The cause is logged, not shown on the unauthenticated endpoint
+    assert "connection refused" not in response.text
+
+
+def test_ready_skips_bedrock_model_by_default(client, mock_db_pool):
+    mock_db_pool.fetchval.return_value = 1
+
+    with patch("main.bedrock_catalog_client") as mock_catalog:
+        response = client.get("/ready")
+
+    assert "bedrock_model" not in response.json()["checks"]
+    mock_catalog.get_foundation_model.assert_not_called()
+
+
+@pytest.mark.parametrize(
+    "error, status", [(None, 200), (RuntimeError("AccessDeniedException"), 503)]
+)
+def test_ready_checks_bedrock_model(client, mock_db_pool, error, status):
+    mock_db_pool.fetchval.return_value = 1
+
+    with patch("main.config", replace(config, ready_check_bedrock=True)), patch(
+        "main.bedrock_catalog_client"
+    ) as mock_catalog:
+        mock_catalog.get_foundation_model.side_effect = error
+        response = client.get("/ready")
+
+    assert response.status_code == status
+    check = response.json()["checks"]["bedrock_model"]
+    assert check["status"] == ("ok" if error is None else "error")
+    assert "error" not in check
+    mock_catalog.get_foundation_model.assert_called_once_with(
+        modelIdentifier=config.default_bedrock_model
+    )
+
+
+def test_ready_reports_open_bedrock_breaker(client, mock_db_pool):
+    mock_db_pool.fetchval.return_value = 1
+    for _ in range(config.bedrock_breaker_failures):
+        bedrock_breaker.record_failure()
+
+    response = client.get("/ready")
+
+    assert response.status_code == 200
+    assert response.json()["checks"]["bedrock"] == {
+        "status": "degraded",
+        "state": "open",
+    }
+
+
+def test_negotiate_fails_fast_while_breaker_open(client, mock_db_pool):
+    for _ in range(config.bedrock_breaker_failures):
+        bedrock_breaker.record_failure()
+
+    response = client.post("/negotiate", json=NEGOTIATION_PAYLOAD)
+
+    assert response.status_code == 503
+    assert int(response.headers["Retry-After"]) > 0
+    mock_db_pool.execute.assert_not_called()
+
+
+def test_stream_fails_fast_while_breaker_open(client):
+    for _ in range(config.bedrock_breaker_failures):
+        bedrock_breaker.record_failure()
+    fake = MagicMock()
+
+    streaming = replace(config, features=frozenset({"streaming"}))
+    with patch("main.config", streaming), patch("main.bedrock_client", fake):
+        response = client.get("/test/stream")
+
+    assert response.status_code == 503
+    fake.invoke_model_with_response_stream.assert_not_called()
 
 
 @pytest.mark.asyncio
@@ -30,33 +375,2726 @@ async def test_suppliers_endpoint(client, mock_db_pool):
     mock_db_pool.fetch.return_value = [
         MockRecord(supplier_id="1", supplier_name="ACME", description="desc")
     ]
+    mock_db_pool.fetchval.return_value = 1
 
     response = client.get("/suppliers")
 
     assert response.status_code == 200
     data = response.json()
-    assert len(data) == 1
-    assert data[0]["supplier_name"] == "ACME"
+    assert data["total"] == 1
+    assert data["limit"] == 50
+    assert data["offset"] == 0
+    assert len(data["data"]) == 1
+    assert data["data"][0]["supplier_name"] == "ACME"
 
 
-@pytest.mark.asyncio
-async def test_negotiate_start(client, mock_db_pool):
-    with patch("main.OrchestratorAgent") as MockOrch, \
-            patch("main.NegotiationSession") as MockSession, \
-            patch("main.NegotiationAgent") as MockAgent:
-        mock_db_pool.execute.return_value = None
+def _links(response):
+    links = {}
+    for part in response.headers["link"].split(", "):
+        url, rel = re.match(r'<([^>]+)>; rel="(\w+)"', part).groups()
+        links[rel] = parse_qs(urlsplit(url).query)
+    return links
 
-        payload = {
-            "product": "Widgets",
-            "prompt": "Buy cheap",
-            "tactics": "Aggressive",
-            "suppliers": ["sup-1", "sup-2"]
+
+def test_suppliers_link_header(client, mock_db_pool):
+    mock_db_pool.fetch.return_value = []
+    mock_db_pool.fetchval.return_value = 35
+
+    response = client.get("/suppliers?limit=10&offset=10&include_deleted=true")
+
+    links = _links(response)
+    assert {rel: q["offset"] for rel, q in links.items()} == {
+        "first": ["0"],
+        "prev": ["0"],
+        "next": ["20"],
+        "last": ["30"],
+    }
+    assert all(q["limit"] == ["10"] for q in links.values())
+    assert links["next"]["include_deleted"] == ["true"]
+
+
+def test_link_header_omits_prev_and_next_at_edges(client, mock_db_pool):
+    mock_db_pool.fetch.return_value = []
+    mock_db_pool.fetchval.return_value = 5
+
+    response = client.get("/suppliers?limit=10")
+
+    assert set(_links(response)) == {"first", "last"}
+
+
+@pytest.mark.parametrize(
+    "path",
+    [
+        "/suppliers",
+        "/suppliers/search?q=anvils",
+        "/products",
+        "/products?cursor=",
+        "/search?q=anvils",
+    ],
+)
+def test_empty_lists_serialize_as_arrays(client, mock_db_pool, path):
+    mock_db_pool.fetchval.return_value = 0
+    mock_db_pool.fetch.return_value = []
+
+    response = client.get(path)
+
+    assert response.status_code == 200
+    assert '"data":[]' in response.text.replace(" ", "")
+
+
+@pytest.mark.parametrize("query", ["limit=-1", "offset=-5", "limit=abc", "offset=1.5"])
+def test_suppliers_rejects_bad_pagination(client, query):
+    response = client.get(f"/suppliers?{query}")
+    assert response.status_code == 400
+
+
+@pytest.mark.parametrize(
+    "query, limit, warning",
+    [
+        ("", 50, None),
+        ("limit=0", 50, None),
+        ("limit=1", 1, None),
+        ("limit=500", 500, None),
+        ("limit=501", 500, "limit 501 exceeds the maximum, using 500"),
+        ("limit=999999", 500, "limit 999999 exceeds the maximum, using 500"),
+    ],
+)
+@pytest.mark.parametrize("path", ["/suppliers", "/products", "/products?cursor="])
+def test_pagination_limit_defaults_and_clamps(
+    client, mock_db_pool, path, query, limit, warning
+):
+    mock_db_pool.fetchval.return_value = 0
+    mock_db_pool.fetch.return_value = []
+
+    separator = "&" if "?" in path else "?"
+    response = client.get(f"{path}{separator}{query}")
+
+    assert response.status_code == 200
+    data = response.json()
+    assert data["limit"] == limit
+    assert data.get("warning") == warning
+
+
+def test_suppliers_hide_soft_deleted(client, mock_db_pool):
+    mock_db_pool.fetchval.return_value = 0
+
+    client.get("/suppliers")
+    assert "deleted_at IS NULL" in mock_db_pool.fetch.call_args[0][0]
+
+    client.get("/suppliers?include_deleted=true")
+    assert "deleted_at" not in mock_db_pool.fetch.call_args[0][0]
+
+
+@pytest.mark.parametrize(
+    "path", ["/suppliers", f"/suppliers/{SUPPLIER_UUID}"]
+)
+@pytest.mark.parametrize("key, status", [("user", 403), ("admin", 200)])
+def test_include_deleted_requires_admin_key(client, mock_db_pool, path, key, status):
+    mock_db_pool.fetchval.return_value = 0
+    mock_db_pool.fetchrow.return_value = MockRecord(supplier_id=SUPPLIER_UUID)
+
+    with patch.object(api_key_auth, "keys", {"user", "admin"}), \
+            patch.object(api_key_auth, "admin_keys", {"admin"}):
+        response = client.get(
+            f"{path}?include_deleted=true", headers={"X-API-Key": key}
+        )
+        plain = client.get(path, headers={"X-API-Key": "user"})
+
+    assert response.status_code == status
+    if status == 403:
+        assert response.json() == {
+            "detail": "include_deleted requires an admin API key",
+            "code": "forbidden",
         }
+    assert plain.status_code == 200
 
-        response = client.post("/negotiate", json=payload)
 
-        assert response.status_code == 200
-        data = response.json()
-        assert data["status"] == "started"
-        assert "negotiation_id" in data
-        assert MockAgent.call_count == 2
\ No newline at end of file
+def test_suppliers_filter_by_tag(client, mock_db_pool):
+    mock_db_pool.fetchval.return_value = 1
+    mock_db_pool.fetch.return_value = [
+        MockRecord(supplier_id="s-1", description="d", tags=["logistics"])
+    ]
+
+    response = client.get("/suppliers?tag=%20Logistics&limit=10")
+
+    assert response.status_code == 200
+    assert response.json()["data"][0]["tags"] == ["logistics"]
+    query, *args = mock_db_pool.fetch.call_args[0]
+    assert "deleted_at IS NULL AND tags @> ARRAY[$1]::text[]" in query
+    assert "LIMIT $2 OFFSET $3" in query
+    assert args == ["logistics", 10, 0]
+    assert mock_db_pool.fetchval.call_args[0][1:] == ("logistics",)
+
+
+def test_suppliers_sorted_by_id_by_default(client, mock_db_pool):
+    mock_db_pool.fetchval.return_value = 0
+
+    client.get("/suppliers")
+    assert "ORDER BY supplier_id ASC" in mock_db_pool.fetch.call_args[0][0]
+
+    client.get("/suppliers?sort=-supplier_name")
+    assert (
+        "ORDER BY supplier_name DESC, supplier_id ASC"
+        in mock_db_pool.fetch.call_args[0][0]
+    )
+
+
+def test_suppliers_sort_rejects_unknown_column(client, mock_db_pool):
+    response = client.get("/suppliers?sort=insights")
+
+    assert response.status_code == 400
+    assert response.json()["detail"] == (
+        "sort must be one of: created_at, supplier_id, supplier_name"
+    )
+    mock_db_pool.fetch.assert_not_called()
+
+
+def test_suppliers_created_after(client, mock_db_pool):
+    mock_db_pool.fetchval.return_value = 0
+
+    response = client.get("/suppliers?created_after=2026-10-08&sort=-created_at")
+
+    assert response.status_code == 200
+    query, *args = mock_db_pool.fetch.call_args[0]
+    assert "created_at > $1" in query
+    assert "ORDER BY created_at DESC, supplier_id ASC" in query
+    assert args[0] == datetime(2026, 10, 8, tzinfo=timezone.utc)
+
+
+@pytest.mark.parametrize("path", ["/suppliers", "/products"])
+def test_list_rejects_bad_created_after(client, mock_db_pool, path):
+    response = client.get(f"{path}?created_after=last-week")
+
+    assert response.status_code == 400
+    assert response.json()["detail"] == "created_after must be an ISO 8601 timestamp"
+    mock_db_pool.fetch.assert_not_called()
+
+
+def test_suppliers_served_from_cache_until_write(client, mock_db_pool):
+    mock_db_pool.fetchval.return_value = 1
+    mock_db_pool.fetch.return_value = [MockRecord(supplier_id="s-1", description="d")]
+
+    first = client.get("/suppliers?limit=10")
+    second = client.get("/suppliers?limit=10")
+
+    assert second.json() == first.json()
+    assert second.headers["ETag"] == first.headers["ETag"]
+    assert second.headers["Cache-Control"] == "private, no-cache"
+    assert second.headers["Link"] == first.headers["Link"]
+    assert mock_db_pool.fetch.call_count == 1
+
+    mock_db_pool.fetchrow.return_value = MockRecord(supplier_id="s-2")
+    client.post("/suppliers", json={"description": "Anvils"})
+    client.get("/suppliers?limit=10")
+
+    assert mock_db_pool.fetch.call_count == 2
+
+
+def test_products_if_none_match(client, mock_db_pool):
+    mock_db_pool.fetchval.return_value = 1
+    mock_db_pool.fetch.return_value = [MockRecord(product_id="p-1")]
+
+    etag = client.get("/products").headers["ETag"]
+    unchanged = client.get("/products", headers={"If-None-Match": f"W/{etag}"})
+    list_cache.clear()
+    mock_db_pool.fetch.return_value = [MockRecord(product_id="p-2")]
+    changed = client.get("/products", headers={"If-None-Match": etag})
+
+    assert unchanged.status_code == 304
+    assert unchanged.content == b""
+    assert unchanged.headers["ETag"] == etag
+    assert changed.status_code == 200
+    assert changed.headers["ETag"] != etag
+
+
+def test_list_cache_disabled(client, mock_db_pool):
+    mock_db_pool.fetchval.return_value = 0
+    list_cache.ttl = 0
+    try:
+        client.get("/suppliers")
+        response = client.get("/suppliers")
+    finally:
+        list_cache.ttl = config.cache_ttl_seconds
+
+    assert response.headers["ETag"]
+    assert mock_db_pool.fetch.call_count == 2
+
+
+def test_add_supplier_tags(client, mock_db_pool):
+    mock_db_pool.fetchrow.return_value = MockRecord(
+        tags=["logistics", "raw materials"]
+    )
+
+    response = client.post(
+        "/suppliers/s-1/tags", json={"tags": ["Raw  Materials", "logistics"]}
+    )
+
+    assert response.status_code == 200
+    assert response.json() == {
+        "supplier_id": "s-1",
+        "tags": ["logistics", "raw materials"],
+    }
+    assert mock_db_pool.fetchrow.call_args[0][1] == ["raw materials", "logistics"]
+
+
+@pytest.mark.parametrize(
+    "body", [{"tags": []}, {"tags": [" "]}, {"tags": ["x" * 51]}]
+)
+def test_add_supplier_tags_rejects_bad_tags(client, mock_db_pool, body):
+    response = client.post("/suppliers/s-1/tags", json=body)
+
+    assert response.status_code == 400
+    mock_db_pool.fetchrow.assert_not_called()
+
+
+def test_remove_supplier_tag(client, mock_db_pool):
+    mock_db_pool.fetchrow.return_value = MockRecord(tags=[])
+
+    response = client.delete("/suppliers/s-1/tags/Logistics")
+
+    assert response.status_code == 200
+    assert response.json() == {"supplier_id": "s-1", "tags": []}
+    assert "array_remove" in mock_db_pool.fetchrow.call_args[0][0]
+    assert mock_db_pool.fetchrow.call_args[0][1] == "logistics"
+
+
+def test_tag_unknown_supplier(client, mock_db_pool):
+    mock_db_pool.fetchrow.return_value = None
+
+    response = client.post("/suppliers/s-1/tags", json={"tags": ["logistics"]})
+
+    assert response.status_code == 404
+
+
+class FakeStore:
+    def __init__(self, suppliers):
+        self.suppliers = suppliers
+
+    async def get_supplier(self, supplier_id, include_deleted=False):
+        return self.suppliers.get(supplier_id)
+
+    async def delete_supplier(self, supplier_id):
+        return self.suppliers.pop(supplier_id, None) is not None
+
+
+def test_supplier_handlers_use_injected_store(client, mock_db_pool):
+    sup = "00000000-0000-4000-8000-000000000001"
+    store = FakeStore({sup: {"supplier_id": sup, "description": "Anvils"}})
+    app.dependency_overrides[get_store] = lambda: store
+    try:
+        found = client.get(f"/suppliers/{sup.upper()}")
+        deleted = client.delete(f"/suppliers/{sup}")
+        missing = client.get(f"/suppliers/{sup}")
+    finally:
+        app.dependency_overrides.clear()
+
+    assert found.json() == {"supplier_id": sup, "description": "Anvils"}
+    assert deleted.status_code == 204
+    assert missing.status_code == 404
+    mock_db_pool.fetchrow.assert_not_called()
+
+
+def test_head_supplier(client, mock_db_pool):
+    mock_db_pool.fetchrow.return_value = MockRecord(supplier_id="s-1", description="d")
+
+    found = client.head("/suppliers/s-1")
+    get = client.get("/suppliers/s-1")
+    mock_db_pool.fetchrow.return_value = None
+    missing = client.head("/suppliers/s-2")
+
+    assert found.status_code == 200
+    assert found.content == b""
+    assert found.headers["Content-Length"] == str(len(get.content))
+    assert missing.status_code == 404
+
+
+def test_head_product(client, mock_db_pool):
+    mock_db_pool.fetchrow.return_value = None
+
+    assert client.head("/products/p-1").status_code == 404
+
+
+def test_get_soft_deleted_supplier(client, mock_db_pool):
+    mock_db_pool.fetchrow.return_value = None
+
+    response = client.get("/suppliers/s-1")
+
+    assert response.status_code == 404
+    assert "deleted_at IS NULL" in mock_db_pool.fetchrow.call_args[0][0]
+
+
+def test_delete_supplier(client, mock_db_pool):
+    mock_db_pool.fetchval.return_value = "s-1"
+
+    response = client.delete("/suppliers/s-1")
+
+    assert response.status_code == 204
+    query = mock_db_pool.fetchval.call_args[0][0]
+    assert "SET deleted_at = now()" in query
+    assert "DELETE" not in query
+
+
+def test_delete_supplier_not_found(client, mock_db_pool):
+    mock_db_pool.fetchval.return_value = None
+
+    response = client.delete("/suppliers/s-1")
+
+    assert response.status_code == 404
+
+
+def test_delete_product(client, mock_db_pool):
+    conn = mock_db_pool.acquire.return_value.__aenter__.return_value
+    conn.fetchrow.return_value = MockRecord(product_name="Rubber Ducks", supplier_id="s-1")
+    conn.fetchval.return_value = 0
+
+    response = client.delete("/products/p-1")
+
+    assert response.status_code == 204
+    assert "DELETE FROM product" in conn.execute.call_args[0][0]
+
+
+def test_delete_product_normalizes_id(client, mock_db_pool):
+    conn = mock_db_pool.acquire.return_value.__aenter__.return_value
+    conn.fetchrow.return_value = MockRecord(product_name="Rubber Ducks", supplier_id="s-1")
+    conn.fetchval.return_value = 0
+
+    response = client.delete(f"/products/%20{PRODUCT_ID.upper()}%20")
+
+    assert response.status_code == 204
+    assert conn.fetchrow.call_args[0][1] == PRODUCT_ID
+    assert conn.execute.call_args[0][1] == PRODUCT_ID
+
+
+def test_delete_product_in_use(client, mock_db_pool):
+    conn = mock_db_pool.acquire.return_value.__aenter__.return_value
+    conn.fetchrow.return_value = MockRecord(product_name="Rubber Ducks", supplier_id="s-1")
+    conn.fetchval.return_value = 2
+
+    response = client.delete(f"/products/{PRODUCT_ID}")
+
+    assert response.status_code == 409
+    assert response.json()["detail"] == "product is referenced by 2 negotiation(s)"
+    query, *args = conn.fetchval.call_args[0]
+    assert "WHERE product_id = $1" in query
+    assert "product_name" not in query
+    assert args == [PRODUCT_ID]
+    conn.execute.assert_not_called()
+
+
+SUPPLIER_UUID = "00000000-0000-4000-8000-00000000000a"
+
+
+def test_bulk_import_skips_bad_rows(client, mock_db_pool):
+    conn = mock_db_pool.acquire.return_value.__aenter__.return_value
+    conn.fetch.return_value = [
+        MockRecord(supplier_id=SUPPLIER_UUID, supplier_name="ACME")
+    ]
+
+    response = client.post(
+        "/products/bulk",
+        json=[
+            {"product_name": "Anvils", "supplier_id": SUPPLIER_UUID},
+            {"product_name": "  ", "supplier_id": SUPPLIER_UUID},
+            {"product_name": "Rockets"},
+            {"product_name": "Magnets", "supplier_id": "not-a-uuid"},
+            {"product_name": "Glue", "supplier_id": SUPPLIER_UUID[:-1] + "f"},
+        ],
+    )
+
+    assert response.status_code == 200
+    assert response.json() == {
+        "inserted": 1,
+        "failed": [
+            {"row": 2, "error": "product_name must not be empty"},
+            {"row": 3, "error": "supplier_id is required"},
+            {"row": 4, "error": "supplier_id must be a UUID"},
+            {"row": 5, "error": "supplier not found"},
+        ],
+    }
+    query, *args = conn.execute.call_args[0]
+    assert "unnest" in query
+    assert args == [[None], [SUPPLIER_UUID], ["Anvils"], ["ACME"], [None], [None]]
+
+
+@pytest.mark.parametrize(
+    "row, error",
+    [
+        ({"price": "9.99"}, "price and currency must be set together"),
+        (
+            {"price": "9.99", "currency": "EURO"},
+            "'EURO' is not an ISO 4217 currency code",
+        ),
+        (
+            {"price": "-1", "currency": "EUR"},
+            "price Input should be greater than or equal to 0",
+        ),
+    ],
+)
+def test_bulk_import_validates_price(client, mock_db_pool, row, error):
+    conn = mock_db_pool.acquire.return_value.__aenter__.return_value
+    conn.fetch.return_value = [
+        MockRecord(supplier_id=SUPPLIER_UUID, supplier_name="ACME")
+    ]
+
+    response = client.post(
+        "/products/bulk",
+        json=[
+            {"product_name": "Anvils", "supplier_id": SUPPLIER_UUID},
+            {"product_name": "Rockets", "supplier_id": SUPPLIER_UUID, **row},
+        ],
+    )
+
+    assert response.json()["failed"] == [{"row": 2, "error": error}]
+
+
+def test_bulk_import_strict_rejects_batch(client, mock_db_pool):
+    conn = mock_db_pool.acquire.return_value.__aenter__.return_value
+    conn.fetch.return_value = [
+        MockRecord(supplier_id=SUPPLIER_UUID, supplier_name="ACME")
+    ]
+
+    response = client.post(
+        "/products/bulk?strict=true",
+        json=[
+            {"product_name": "Anvils", "supplier_id": SUPPLIER_UUID},
+            {"product_name": "Rockets", "supplier_id": "nope"},
+        ],
+    )
+
+    assert response.status_code == 422
+    assert response.json()["failed"] == [
+        {"row": 2, "error": "supplier_id must be a UUID"}
+    ]
+    conn.execute.assert_not_called()
+
+
+def test_bulk_import_csv(client, mock_db_pool):
+    conn = mock_db_pool.acquire.return_value.__aenter__.return_value
+    conn.fetch.return_value = [
+        MockRecord(supplier_id=SUPPLIER_UUID, supplier_name="ACME")
+    ]
+    body = (
+        "product_name,supplier_id,product_id,price,currency\n"
+        f"Anvils,{SUPPLIER_UUID},,12.50,eur\n"
+    )
+
+    response = client.post(
+        "/products/bulk", content=body, headers={"Content-Type": "text/csv"}
+    )
+
+    assert response.status_code == 200
+    assert response.json() == {"inserted": 1, "failed": []}
+    assert conn.execute.call_args[0][5:] == ([Decimal("12.50")], ["EUR"])
+
+
+@pytest.mark.parametrize("body", ["[]", "{}", "not json"])
+def test_bulk_import_rejects_bad_body(client, body):
+    response = client.post(
+        "/products/bulk", content=body, headers={"Content-Type": "application/json"}
+    )
+
+    assert response.status_code == 400
+
+
+def test_create_product(client, mock_db_pool):
+    mock_db_pool.fetchrow.return_value = MockRecord(
+        product_id="p-1", product_name="Anvils", supplier_id=SUPPLIER_UUID
+    )
+
+    response = client.post(
+        "/products",
+        json={
+            "product_name": " Anvils ",
+            "supplier_id": SUPPLIER_UUID.upper(),
+            "price": "12.5",
+            "currency": "eur",
+        },
+    )
+
+    assert response.status_code == 201
+    assert response.json()["product_id"] == "p-1"
+    query, *args = mock_db_pool.fetchrow.call_args[0]
+    assert "FROM supplier" in query and "deleted_at IS NULL" in query
+    assert args == [None, SUPPLIER_UUID, "Anvils", Decimal("12.5"), "EUR"]
+
+
+def test_create_product_unknown_supplier(client, mock_db_pool):
+    mock_db_pool.fetchrow.return_value = None
+
+    response = client.post(
+        "/products", json={"product_name": "Anvils", "supplier_id": SUPPLIER_UUID}
+    )
+
+    assert response.status_code == 422
+    assert response.json() == {"detail": "supplier not found", "code": "unprocessable"}
+
+
+@pytest.mark.parametrize(
+    "body",
+    [
+        {"supplier_id": SUPPLIER_UUID},
+        {"product_name": "  ", "supplier_id": SUPPLIER_UUID},
+        {"product_name": "Anvils", "supplier_id": "acme"},
+        {"product_name": "Anvils", "supplier_id": SUPPLIER_UUID, "price": "1"},
+    ],
+)
+def test_create_product_rejects_malformed_body(client, mock_db_pool, body):
+    response = client.post("/products", json=body)
+
+    assert response.status_code == 400
+    mock_db_pool.fetchrow.assert_not_called()
+
+
+def test_create_product_conflict(client, mock_db_pool):
+    mock_db_pool.fetchrow.side_effect = asyncpg.UniqueViolationError("duplicate key")
+
+    response = client.post(
+        "/products",
+        json={
+            "product_id": PRODUCT_ID,
+            "product_name": "Anvils",
+            "supplier_id": SUPPLIER_UUID,
+        },
+    )
+
+    assert response.status_code == 409
+
+
+def test_update_product_price(client, mock_db_pool):
+    mock_db_pool.fetchrow.return_value = MockRecord(
+        product_id="p-1", price=Decimal("9.99"), currency="GBP"
+    )
+
+    response = client.patch(
+        "/products/p-1", json={"price": "9.99", "currency": " gbp"}
+    )
+
+    assert response.status_code == 200
+    query, *args = mock_db_pool.fetchrow.call_args[0]
+    assert "SET price = $1, currency = $2 WHERE product_id = $3" in query
+    assert args == [Decimal("9.99"), "GBP", "p-1"]
+
+
+@pytest.mark.parametrize(
+    "body, detail",
+    [
+        ({}, "no fields to update"),
+        ({"product_name": " "}, "product_name must not be empty"),
+        ({"currency": "USD"}, "price and currency must be set together"),
+        ({"price": "1", "currency": "ABC"}, "'ABC' is not an ISO 4217 currency code"),
+    ],
+)
+def test_update_product_rejects_bad_fields(client, mock_db_pool, body, detail):
+    response = client.patch("/products/p-1", json=body)
+
+    assert response.status_code == 400
+    assert response.json()["detail"] == detail
+    mock_db_pool.fetchrow.assert_not_called()
+
+
+def test_update_unknown_product(client, mock_db_pool):
+    mock_db_pool.fetchrow.return_value = None
+
+    response = client.patch("/products/p-1", json={"product_name": "Anvils"})
+
+    assert response.status_code == 404
+
+
+def test_writes_require_json_content_type(client, mock_db_pool):
+    response = client.post(
+        "/suppliers",
+        content="description=Anvils",
+        headers={"Content-Type": "application/x-www-form-urlencoded"},
+    )
+
+    assert response.status_code == 415
+    assert response.json() == {
+        "detail": "Content-Type must be application/json, "
+        "got application/x-www-form-urlencoded",
+        "code": "unsupported_media_type",
+    }
+    mock_db_pool.fetchrow.assert_not_called()
+
+
+def test_search_matches_partial_words(client, mock_db_pool):
+    mock_db_pool.fetch.return_value = [
+        MockRecord(
+            type="product",
+            id="p-1",
+            name="Rubber Ducks",
+            supplier_id="s-1",
+            rank=0.0,
+            total_count=1,
+        )
+    ]
+
+    response = client.get("/search?product=duc")
+
+    assert response.status_code == 200
+    data = response.json()
+    assert data["total"] == 1
+    assert data["data"][0]["name"] == "Rubber Ducks"
+    assert "total_count" not in data["data"][0]
+    query, *args = mock_db_pool.fetch.call_args[0]
+    assert "ILIKE" in query
+    assert "FROM supplier" not in query
+    assert "COUNT(*) OVER ()" in query
+    assert args == ["duc", "%duc%", 50, 0]
+    mock_db_pool.fetchval.assert_not_called()
+
+
+def test_search_all_scopes(client, mock_db_pool):
+    hit = {"supplier_id": "s-1", "total_count": 7}
+    mock_db_pool.fetch.return_value = [
+        MockRecord(type="supplier", id="s-1", name="ACME", rank=0.6, **hit),
+        MockRecord(type="product", id="p-1", name="Anvils", rank=0, **hit),
+    ]
+
+    response = client.get("/search?q=acme&scope=all&limit=10&offset=5")
+
+    assert response.status_code == 200
+    assert [hit["type"] for hit in response.json()["data"]] == ["supplier", "product"]
+    assert response.json()["total"] == 7
+    query, *args = mock_db_pool.fetch.call_args[0]
+    assert "FROM product" in query and "FROM supplier" in query
+    assert "ORDER BY rank DESC" in query
+    assert args[2:] == [10, 5]
+
+
+def test_search_skips_deleted_suppliers(client, mock_db_pool):
+    mock_db_pool.fetch.return_value = []
+
+    client.get("/search?q=acme&scope=suppliers")
+
+    query = mock_db_pool.fetch.call_args[0][0]
+    assert "deleted_at IS NULL" in query
+
+
+@pytest.mark.parametrize(
+    "term, pattern",
+    [
+        ("ducks", "%ducks%"),
+        ("100%", "%100\\%%"),
+        ("a_b", "%a\\_b%"),
+        ("c:\\temp", "%c:\\\\temp%"),
+        ("%_", "%\\%\\_%"),
+    ],
+)
+def test_like_pattern_escapes_wildcards(term, pattern):
+    assert _like_pattern(term) == pattern
+
+
+def test_search_escapes_wildcards_and_trims(client, mock_db_pool):
+    response = client.get("/search", params={"q": "  50%_off  "})
+
+    assert response.status_code == 200
+    _, term, pattern, *_ = mock_db_pool.fetch.call_args[0]
+    assert term == "50%_off"
+    assert pattern == "%50\\%\\_off%"
+
+
+def test_search_counts_matches_past_the_last_page(client, mock_db_pool):
+    mock_db_pool.fetchval.return_value = 3
+
+    response = client.get("/search?q=acme&limit=10&offset=20")
+
+    assert response.status_code == 200
+    assert response.json()["data"] == []
+    assert response.json()["total"] == 3
+    query = mock_db_pool.fetchval.call_args[0][0]
+    assert query.startswith("SELECT COUNT(*)")
+
+
+def test_search_empty_first_page_skips_count(client, mock_db_pool):
+    response = client.get("/search?q=nothing")
+
+    assert response.json()["total"] == 0
+    mock_db_pool.fetchval.assert_not_called()
+
+
+@pytest.mark.parametrize("query", ["", "?q=acme&scope=everything", "?q=" + "a" * 201])
+def test_search_rejects_bad_params(client, mock_db_pool, query):
+    response = client.get(f"/search{query}")
+
+    assert response.status_code == 400
+    mock_db_pool.fetch.assert_not_called()
+
+
+def test_create_supplier(client, mock_db_pool):
+    mock_db_pool.fetchrow.return_value = MockRecord(
+        supplier_id="s-1", supplier_name="ACME", description="Anvils"
+    )
+
+    response = client.post(
+        "/suppliers", json={"supplier_name": "ACME", "description": "Anvils"}
+    )
+
+    assert response.status_code == 201
+    assert response.json()["supplier_id"] == "s-1"
+
+
+def test_create_supplier_requires_description(client, mock_db_pool):
+    response = client.post("/suppliers", json={"description": "   "})
+
+    assert response.status_code == 400
+    mock_db_pool.fetchrow.assert_not_called()
+
+
+def test_create_supplier_conflict(client, mock_db_pool):
+    mock_db_pool.fetchrow.side_effect = asyncpg.UniqueViolationError("duplicate key")
+
+    response = client.post(
+        "/suppliers", json={"supplier_id": "s-1", "description": "Anvils"}
+    )
+
+    assert response.status_code == 409
+
+
+def test_database_error_does_not_leak_internals(client, mock_db_pool):
+    mock_db_pool.fetch.side_effect = asyncpg.CheckViolationError(
+        'new row for relation "supplier" violates check constraint "supplier_name_len"'
+    )
+
+    response = client.get("/suppliers/search?q=anvils")
+
+    assert response.status_code == 400
+    assert response.json() == {"detail": "invalid value", "code": "invalid_request"}
+    assert "supplier_name_len" not in response.text
+
+
+def test_update_supplier_only_sets_provided_fields(client, mock_db_pool):
+    mock_db_pool.fetchrow.return_value = MockRecord(
+        supplier_id="s-1", description="desc", insights=None, image_url="new.png"
+    )
+
+    response = client.patch(
+        "/suppliers/s-1", json={"image_url": "new.png", "insights": None}
+    )
+
+    assert response.status_code == 200
+    query, *args = mock_db_pool.fetchrow.call_args[0]
+    assert "image_url = $1" in query
+    assert "insights = $2" in query
+    assert "description" not in query
+    assert args == ["new.png", None, "s-1"]
+
+
+def test_update_supplier_empty_body(client, mock_db_pool):
+    response = client.patch("/suppliers/s-1", json={})
+
+    assert response.status_code == 400
+
+
+def test_update_supplier_not_found(client, mock_db_pool):
+    mock_db_pool.fetchrow.return_value = None
+
+    response = client.patch("/suppliers/s-1", json={"image_url": "x.png"})
+
+    assert response.status_code == 404
+    # Soft-deleted suppliers can't be edited
+    assert "deleted_at IS NULL" in mock_db_pool.fetchrow.call_args[0][0]
+
+
+def test_search_suppliers(client, mock_db_pool):
+    mock_db_pool.fetch.return_value = [
+        MockRecord(
+            supplier_id="s-1",
+            supplier_name="ACME",
+            description="Anvils",
+            total_count=11,
+        )
+    ]
+
+    response = client.get("/suppliers/search?q=anvils&limit=5&offset=10")
+
+    assert response.status_code == 200
+    data = response.json()
+    assert data["total"] == 11
+    assert data["data"][0]["supplier_name"] == "ACME"
+    assert "total_count" not in data["data"][0]
+    query, *args = mock_db_pool.fetch.call_args[0]
+    assert "ts_rank" in query
+    assert "COUNT(*) OVER ()" in query
+    assert args == ["anvils", 5, 10]
+    mock_db_pool.fetchval.assert_not_called()
+    mock_db_pool.fetchrow.assert_not_called()
+
+
+def test_search_suppliers_counts_matches_past_the_last_page(client, mock_db_pool):
+    mock_db_pool.fetchval.return_value = 3
+
+    response = client.get("/suppliers/search?q=anvils&limit=10&offset=20")
+
+    assert response.status_code == 200
+    assert response.json()["data"] == []
+    assert response.json()["total"] == 3
+    query = mock_db_pool.fetchval.call_args[0][0]
+    assert query.startswith("SELECT COUNT(*) FROM supplier")
+
+
+def test_search_suppliers_empty_first_page_skips_count(client, mock_db_pool):
+    response = client.get("/suppliers/search?q=nothing")
+
+    assert response.json()["total"] == 0
+    mock_db_pool.fetchval.assert_not_called()
+
+
+@pytest.mark.parametrize("query", ["", "?q=", "?q=%20%20"])
+def test_search_suppliers_requires_query(client, mock_db_pool, query):
+    response = client.get(f"/suppliers/search{query}")
+
+    assert response.status_code == 400
+    assert response.json() == {
+        "detail": "q must not be empty",
+        "code": "invalid_request",
+    }
+
+
+def test_duplicate_suppliers_embeds_only_changed_descriptions(client, mock_db_pool):
+    cached_key = embedding_key(config.embedding_model, "Steel anvils")
+    mock_db_pool.fetch.return_value = [
+        MockRecord(
+            supplier_id="s-1",
+            supplier_name="ACME",
+            description="Steel anvils",
+            embedding=[1.0, 0.0],
+            embedding_key=cached_key,
+        ),
+        MockRecord(
+            supplier_id="s-2",
+            supplier_name="ACME Corp",
+            description="Steel anvils, wholesale",
+            embedding=[0.0, 1.0],
+            embedding_key="stale",
+        ),
+        MockRecord(
+            supplier_id="s-3",
+            supplier_name="Globex",
+            description="Rubber ducks",
+            embedding=None,
+            embedding_key=None,
+        ),
+    ]
+    embeddings = {"Steel anvils, wholesale": [0.99, 0.1], "Rubber ducks": [0.0, 1.0]}
+
+    with patch("main._embed_text", new_callable=AsyncMock) as mock_embed:
+        mock_embed.side_effect = embeddings.get
+        response = client.get("/suppliers/duplicates")
+
+    assert response.status_code == 200
+    body = response.json()
+    assert body["threshold"] == config.duplicate_similarity_threshold
+    [group] = body["groups"]
+    assert [s["supplier_id"] for s in group["suppliers"]] == ["s-1", "s-2"]
+    assert 0.99 < group["similarity"] <= 1
+    assert sorted(call.args[0] for call in mock_embed.call_args_list) == sorted(
+        embeddings
+    )
+    stored = {
+        call.args[1]: call.args[2:] for call in mock_db_pool.execute.call_args_list
+    }
+    assert stored["s-2"] == (
+        [0.99, 0.1],
+        embedding_key(config.embedding_model, "Steel anvils, wholesale"),
+    )
+
+
+@pytest.mark.parametrize("threshold", ["0", "1.5", "high"])
+def test_duplicate_suppliers_rejects_bad_threshold(client, mock_db_pool, threshold):
+    response = client.get(f"/suppliers/duplicates?threshold={threshold}")
+
+    assert response.status_code == 400
+    mock_db_pool.fetch.assert_not_called()
+
+
+def test_duplicate_suppliers_embedding_failure(client, mock_db_pool):
+    mock_db_pool.fetch.return_value = [
+        MockRecord(
+            supplier_id="s-1",
+            supplier_name="ACME",
+            description="Steel anvils",
+            embedding=None,
+            embedding_key=None,
+        )
+    ]
+
+    with patch("main._embed_text", new_callable=AsyncMock) as mock_embed:
+        mock_embed.side_effect = RuntimeError("AccessDeniedException")
+        response = client.get("/suppliers/duplicates")
+
+    assert response.status_code == 502
+    assert "AccessDenied" not in response.text
+    mock_db_pool.execute.assert_not_called()
+
+
+def test_get_supplier(client, mock_db_pool):
+    mock_db_pool.fetchrow.return_value = MockRecord(supplier_id="1", supplier_name="ACME")
+
+    response = client.get("/suppliers/1")
+
+    assert response.status_code == 200
+    assert response.json()["supplier_name"] == "ACME"
+
+
+@pytest.mark.parametrize(
+    "raw",
+    [
+        "0A1B2C3D-0000-4000-8000-00000000000F",
+        "%200a1b2c3d-0000-4000-8000-00000000000f%20",
+        "%09{0A1B2C3D-0000-4000-8000-00000000000f}",
+    ],
+)
+def test_get_supplier_normalizes_id(client, mock_db_pool, raw):
+    mock_db_pool.fetchrow.return_value = MockRecord(supplier_id="x", description="d")
+
+    response = client.get(f"/suppliers/{raw}")
+
+    assert response.status_code == 200
+    assert mock_db_pool.fetchrow.call_args[0][1] == (
+        "0a1b2c3d-0000-4000-8000-00000000000f"
+    )
+
+
+@pytest.mark.parametrize(
+    "method, suffix, body",
+    [
+        ("patch", "", {"image_url": "x.png"}),
+        ("post", "/insights", None),
+        ("get", "/products", None),
+    ],
+)
+def test_supplier_routes_normalize_id(client, mock_db_pool, method, suffix, body):
+    mock_db_pool.fetchrow.return_value = None
+
+    client.request(
+        method, f"/suppliers/%200A1B2C3D-0000-4000-8000-00000000000F{suffix}",
+        json=body,
+    )
+
+    assert mock_db_pool.fetchrow.call_args[0][-1] == (
+        "0a1b2c3d-0000-4000-8000-00000000000f"
+    )
+
+
+def test_delete_supplier_normalizes_id(client, mock_db_pool):
+    mock_db_pool.fetchval.return_value = "0a1b2c3d-0000-4000-8000-00000000000f"
+
+    response = client.delete("/suppliers/0A1B2C3D-0000-4000-8000-00000000000F")
+
+    assert response.status_code == 204
+    assert mock_db_pool.fetchval.call_args[0][1] == (
+        "0a1b2c3d-0000-4000-8000-00000000000f"
+    )
+
+
+def test_get_product_normalizes_id(client, mock_db_pool):
+    mock_db_pool.fetchrow.return_value = None
+
+    client.get("/products/%20ABCDEF00-0000-4000-8000-000000000001%20")
+
+    assert mock_db_pool.fetchrow.call_args[0][1] == (
+        "abcdef00-0000-4000-8000-000000000001"
+    )
+
+
+def test_get_supplier_not_found(client, mock_db_pool):
+    mock_db_pool.fetchrow.return_value = None
+
+    response = client.get("/suppliers/missing")
+
+    assert response.status_code == 404
+    assert response.json() == {"detail": "supplier not found", "code": "not_found"}
+
+
+PNG_BYTES = b"\x89PNG\r\n\x1a\n" + b"\x00" * 16
+
+
+def test_upload_supplier_image(client, mock_db_pool):
+    mock_db_pool.fetchrow.return_value = MockRecord(exists=1)
+
+    with patch("main.config", replace(config, s3_bucket="supplier-images")), \
+            patch("main.s3_client") as mock_s3:
+        response = client.post(
+            "/suppliers/s-1/image",
+            files={"file": ("logo.png", PNG_BYTES, "image/png")},
+        )
+
+    assert response.status_code == 200
+    image_url = response.json()["image_url"]
+    assert image_url.startswith("https://supplier-images.s3.")
+    put_kwargs = mock_s3.put_object.call_args[1]
+    assert put_kwargs["Bucket"] == "supplier-images"
+    assert put_kwargs["Key"].startswith("suppliers/s-1/")
+    assert put_kwargs["ContentType"] == "image/png"
+    update_args = mock_db_pool.execute.call_args[0]
+    assert update_args[1:] == (image_url, "s-1")
+
+
+@pytest.mark.parametrize(
+    "upload, status",
+    [
+        (("doc.pdf", b"%PDF-1.7", "application/pdf"), 415),
+        (("fake.png", b"GIF89a", "image/png"), 415),
+        (("big.png", PNG_BYTES + b"\x00" * 1024, "image/png"), 413),
+    ],
+)
+def test_upload_supplier_image_validation(client, mock_db_pool, upload, status):
+    limited = replace(config, s3_bucket="supplier-images", max_image_bytes=512)
+    with patch("main.config", limited), patch("main.s3_client") as mock_s3:
+        response = client.post("/suppliers/s-1/image", files={"file": upload})
+
+    assert response.status_code == status
+    mock_s3.put_object.assert_not_called()
+
+
+def test_upload_supplier_image_not_configured(client, mock_db_pool):
+    with patch("main.config", replace(config, s3_bucket=None)):
+        response = client.post(
+            "/suppliers/s-1/image",
+            files={"file": ("logo.png", PNG_BYTES, "image/png")},
+        )
+
+    assert response.status_code == 503
+
+
+@pytest.mark.parametrize(
+    "sort, expected",
+    [
+        (None, "ORDER BY product_name ASC"),
+        ("-product_name", "ORDER BY product_name DESC"),
+        ("product_id", "ORDER BY product_id ASC"),
+    ],
+)
+def test_products_sort(client, mock_db_pool, sort, expected):
+    mock_db_pool.fetchval.return_value = 0
+    url = "/products" if sort is None else f"/products?sort={sort}"
+
+    response = client.get(url)
+
+    assert response.status_code == 200
+    assert expected in mock_db_pool.fetch.call_args[0][0]
+
+
+def test_products_sort_rejects_unknown_column(client, mock_db_pool):
+    response = client.get("/products?sort=price;DROP TABLE product")
+
+    assert response.status_code == 400
+    mock_db_pool.fetch.assert_not_called()
+
+
+def test_products_filter_by_supplier(client, mock_db_pool):
+    mock_db_pool.fetchval.return_value = 0
+    mock_db_pool.fetch.return_value = []
+
+    response = client.get("/products?supplier_id=s-1&sort=-product_name&limit=10")
+
+    assert response.status_code == 200
+    assert response.json()["data"] == []
+    query, *args = mock_db_pool.fetch.call_args[0]
+    assert "WHERE supplier_id = $1" in query
+    assert "ORDER BY product_name DESC, product_id ASC LIMIT $2 OFFSET $3" in query
+    assert args == ["s-1", 10, 0]
+
+
+def test_products_created_after(client, mock_db_pool):
+    mock_db_pool.fetchval.return_value = 0
+
+    response = client.get(
+        "/products",
+        params={
+            "supplier_id": "s-1",
+            "created_after": "2026-10-08T09:30:00+02:00",
+            "sort": "-created_at",
+        },
+    )
+
+    assert response.status_code == 200
+    query, *args = mock_db_pool.fetch.call_args[0]
+    assert "WHERE supplier_id = $1 AND created_at > $2" in query
+    assert "ORDER BY created_at DESC, product_id ASC LIMIT $3 OFFSET $4" in query
+    assert args[1] == datetime(2026, 10, 8, 7, 30, tzinfo=timezone.utc)
+
+
+def test_supplier_products(client, mock_db_pool):
+    mock_db_pool.fetchrow.return_value = MockRecord(exists=1)
+    mock_db_pool.fetchval.return_value = 1
+    mock_db_pool.fetch.return_value = [
+        MockRecord(product_id="p-1", product_name="Rubber Ducks", supplier_id="s-1")
+    ]
+
+    response = client.get("/suppliers/s-1/products?limit=5")
+
+    assert response.status_code == 200
+    data = response.json()
+    assert data["total"] == 1
+    assert data["limit"] == 5
+    assert data["data"][0]["product_name"] == "Rubber Ducks"
+    query, *args = mock_db_pool.fetch.call_args[0]
+    assert "WHERE supplier_id = $1" in query
+    assert args == ["s-1", 5, 0]
+
+
+def test_supplier_products_empty(client, mock_db_pool):
+    mock_db_pool.fetchrow.return_value = MockRecord(exists=1)
+    mock_db_pool.fetchval.return_value = 0
+    mock_db_pool.fetch.return_value = []
+
+    response = client.get("/suppliers/s-1/products")
+
+    assert response.status_code == 200
+    assert response.json()["data"] == []
+
+
+def test_supplier_products_unknown_supplier(client, mock_db_pool):
+    mock_db_pool.fetchrow.return_value = None
+
+    response = client.get("/suppliers/missing/products")
+
+    assert response.status_code == 404
+    assert response.json() == {"detail": "supplier not found", "code": "not_found"}
+    mock_db_pool.fetch.assert_not_called()
+
+
+def test_export_products_csv(client, mock_db_pool):
+    conn = mock_db_pool.acquire.return_value.__aenter__.return_value
+    cursor = MagicMock()
+    cursor.__aiter__.return_value = [
+        MockRecord(
+            product_id="p-1",
+            product_name="Rubber Ducks, large",
+            supplier_id="s-1",
+            supplier_name="Quacktastic Labs",
+            price=Decimal("4.20"),
+            currency="USD",
+        )
+    ]
+    conn.cursor = MagicMock(return_value=cursor)
+
+    response = client.get("/products.csv?sort=-product_name")
+
+    assert response.status_code == 200
+    assert response.headers["content-type"].startswith("text/csv")
+    assert "filename=products.csv" in response.headers["content-disposition"]
+    assert response.text.splitlines() == [
+        "product_id,product_name,supplier_id,supplier_name,price,currency",
+        'p-1,"Rubber Ducks, large",s-1,Quacktastic Labs,4.20,USD',
+    ]
+    assert "ORDER BY product_name DESC" in conn.cursor.call_args[0][0]
+
+
+def test_export_products_csv_rejects_bad_supplier(client, mock_db_pool):
+    response = client.get("/products.csv?supplier_id=not-a-uuid")
+
+    assert response.status_code == 400
+
+
+def test_products_cursor_pagination(client, mock_db_pool):
+    last = "00000000-0000-4000-8000-000000000002"
+    mock_db_pool.fetch.return_value = [
+        MockRecord(product_id="00000000-0000-4000-8000-000000000001"),
+        MockRecord(product_id=last),
+    ]
+
+    first = client.get("/products?cursor=&limit=2")
+
+    assert first.status_code == 200
+    next_cursor = first.json()["next_cursor"]
+    query, *args = mock_db_pool.fetch.call_args[0]
+    assert "WHERE" not in query
+    assert "ORDER BY product_id LIMIT $1" in query
+    assert args == [2]
+
+    mock_db_pool.fetch.return_value = []
+    second = client.get(f"/products?cursor={next_cursor}&limit=2&supplier_id=s-1")
+
+    assert second.status_code == 200
+    assert second.json()["next_cursor"] is None
+    query, *args = mock_db_pool.fetch.call_args[0]
+    assert "WHERE product_id > $1 AND supplier_id = $2" in query
+    assert args == [last, "s-1", 2]
+    mock_db_pool.fetchval.assert_not_called()
+
+
+@pytest.mark.parametrize(
+    "query",
+    ["cursor=not-base64!", "cursor=&offset=10", "cursor=&sort=product_name"],
+)
+def test_products_cursor_rejects_bad_params(client, mock_db_pool, query):
+    response = client.get(f"/products?{query}")
+
+    assert response.status_code == 400
+    mock_db_pool.fetch.assert_not_called()
+
+
+def test_get_product_includes_supplier(client, mock_db_pool):
+    mock_db_pool.fetchrow.return_value = MockRecord(
+        product_id="p-1",
+        product_name="Rubber Ducks",
+        price=Decimal("4.20"),
+        currency="USD",
+        created_at=datetime(2026, 10, 1, tzinfo=timezone.utc),
+        updated_at=datetime(2026, 10, 9, tzinfo=timezone.utc),
+        supplier_id="s-1",
+        supplier_name="Quacktastic Labs",
+        description="Ducks",
+        image_url=None,
+    )
+
+    response = client.get("/products/p-1")
+
+    assert response.status_code == 200
+    data = response.json()
+    assert data["product_name"] == "Rubber Ducks"
+    assert (data["price"], data["currency"]) == (4.2, "USD")
+    assert datetime.fromisoformat(data["created_at"]) == datetime(
+        2026, 10, 1, tzinfo=timezone.utc
+    )
+    assert datetime.fromisoformat(data["updated_at"]) > datetime.fromisoformat(
+        data["created_at"]
+    )
+    assert data["supplier"]["supplier_id"] == "s-1"
+    assert data["supplier"]["description"] == "Ducks"
+
+
+def test_supplier_insights_cached(client, mock_db_pool):
+    mock_db_pool.fetchrow.return_value = MockRecord(
+        supplier_name="ACME", description="desc", insights="Already known"
+    )
+
+    with patch("main._bedrock_completion", new_callable=AsyncMock) as mock_completion:
+        response = client.post("/suppliers/1/insights")
+
+    assert response.status_code == 200
+    assert response.json()["insights"] == "Already known"
+    assert response.json()["cached"] is True
+    mock_completion.assert_not_called()
+
+
+def test_supplier_insights_refresh(client, mock_db_pool):
+    mock_db_pool.fetchrow.return_value = MockRecord(
+        supplier_name="ACME", description="desc", insights="Stale"
+    )
+    mock_db_pool.fetch.return_value = [MockRecord(product_name="Rubber Ducks")]
+
+    with patch("main._bedrock_completion", new_callable=AsyncMock) as mock_completion:
+        mock_completion.return_value = ("Fresh leverage points", TokenUsage())
+        response = client.post("/suppliers/1/insights?refresh=true")
+
+    assert response.status_code == 200
+    assert response.json()["insights"] == "Fresh leverage points"
+    update_args = mock_db_pool.execute.call_args[0]
+    assert "UPDATE supplier SET insights" in update_args[0]
+
+
+@pytest.mark.parametrize(
+    "completion, structured",
+    [
+        (
+            'Sure: {"strengths": ["High volume"], "risks": ["Single plant"], '
+            '"recommended_approach": "Anchor on volume"}',
+            {
+                "strengths": ["High volume"],
+                "risks": ["Single plant"],
+                "recommended_approach": "Anchor on volume",
+            },
+        ),
+        ("Leverage their volume.", None),
+        ('{"strengths": []}', None),
+    ],
+)
+def test_supplier_insights_structured_mode(
+    client, mock_db_pool, completion, structured
+):
+    mock_db_pool.fetchrow.return_value = MockRecord(
+        supplier_name="ACME", description="desc", insights=None
+    )
+
+    with patch(
+        "main.config", replace(config, structured_insights=True)
+    ), patch("main._bedrock_completion", new_callable=AsyncMock) as mock_completion:
+        mock_completion.return_value = (completion, TokenUsage())
+        response = client.post("/suppliers/1/insights")
+
+    assert response.status_code == 200
+    assert "JSON object" in mock_completion.call_args[0][0]
+    _, text, stored, _ = mock_db_pool.execute.call_args[0]
+    if structured is None:
+        assert text == completion
+        assert stored is None
+    else:
+        assert "Strengths: High volume" in text
+        assert json.loads(stored) == structured
+
+
+def test_get_supplier_insights(client, mock_db_pool):
+    structured = {
+        "strengths": ["High volume"],
+        "risks": [],
+        "recommended_approach": "Anchor on volume",
+    }
+    mock_db_pool.fetchrow.return_value = MockRecord(
+        insights_structured=json.dumps(structured)
+    )
+
+    response = client.get("/suppliers/1/insights")
+
+    assert response.status_code == 200
+    assert response.json() == {"supplier_id": "1", "insights": structured}
+
+
+@pytest.mark.parametrize(
+    "row, detail",
+    [
+        (None, "supplier not found"),
+        (MockRecord(insights_structured=None), "structured insights not available"),
+    ],
+)
+def test_get_supplier_insights_missing(client, mock_db_pool, row, detail):
+    mock_db_pool.fetchrow.return_value = row
+
+    response = client.get("/suppliers/1/insights")
+
+    assert response.status_code == 404
+    assert response.json() == {"detail": detail, "code": "not_found"}
+
+
+def test_supplier_insights_with_fake_bedrock(client, mock_db_pool):
+    mock_db_pool.fetchrow.return_value = MockRecord(
+        supplier_name="ACME", description="Makes anvils", insights=None
+    )
+    fake = FakeBedrockClient("<thinking>hm</thinking>Volume discounts")
+
+    with patch("main.bedrock_client", fake):
+        response = client.post("/suppliers/1/insights")
+
+    assert response.status_code == 200
+    assert response.json()["insights"] == "Volume discounts"
+    assert "Makes anvils" in fake.requests[0]["messages"][-1]["content"]
+
+
+def test_supplier_insights_timeout(client, mock_db_pool):
+    mock_db_pool.fetchrow.return_value = MockRecord(
+        supplier_name="ACME", description="desc", insights=None
+    )
+
+    with patch("main._bedrock_completion", new_callable=AsyncMock) as mock_completion:
+        mock_completion.side_effect = BedrockTimeoutError(
+            "Bedrock did not respond within 30 seconds"
+        )
+        response = client.post("/suppliers/1/insights")
+
+    assert response.status_code == 504
+    assert response.json() == {
+        "detail": "Bedrock did not respond within 30 seconds",
+        "code": "timeout",
+    }
+
+
+def test_stats(client, mock_db_pool):
+    mock_db_pool.fetchrow.return_value = MockRecord(
+        suppliers=3, products=10, negotiations=4
+    )
+
+    with patch("main._stats_cache", None):
+        first = client.get("/stats")
+        second = client.get("/stats")
+
+    assert first.status_code == 200
+    data = first.json()
+    assert data["suppliers"] == 3
+    assert data["products"] == 10
+    assert data["avg_products_per_supplier"] == 3.33
+    assert data["negotiations"] == 4
+    assert second.json() == data
+    assert mock_db_pool.fetchrow.call_count == 1
+    # Deleted suppliers and their products aren't counted
+    assert mock_db_pool.fetchrow.call_args[0][0].count("deleted_at IS NULL") == 2
+
+
+def test_stats_without_suppliers(client, mock_db_pool):
+    mock_db_pool.fetchrow.return_value = MockRecord(
+        suppliers=0, products=0, negotiations=0
+    )
+
+    with patch("main._stats_cache", None), patch(
+        "main.config", replace(config, stats_cache_ttl_seconds=0)
+    ):
+        client.get("/stats")
+        response = client.get("/stats")
+
+    assert response.json()["avg_products_per_supplier"] == 0.0
+    assert mock_db_pool.fetchrow.call_count == 2
+
+
+def test_regenerate_all_insights_returns_job(client):
+    with patch("main._regenerate_all_insights", new_callable=AsyncMock):
+        response = client.post("/admin/insights/regenerate")
+
+        assert response.status_code == 202
+        job = response.json()
+        assert response.headers["Location"] == f"/admin/jobs/{job['job_id']}"
+        assert job["kind"] == "insights_regeneration"
+
+        polled = client.get(f"/admin/jobs/{job['job_id']}")
+
+    assert polled.status_code == 200
+    assert polled.json()["status"] in ("pending", "running", "done")
+
+
+def test_get_unknown_job(client):
+    response = client.get("/admin/jobs/missing")
+
+    assert response.status_code == 404
+
+
+@pytest.mark.asyncio
+async def test_regenerate_all_insights_counts_outcomes(mock_db_pool):
+    from jobs import Job
+    from main import _regenerate_all_insights
+
+    mock_db_pool.fetch.return_value = [
+        MockRecord(supplier_id="s-1", supplier_name="ACME", description="d"),
+        MockRecord(supplier_id="s-2", supplier_name="Globex", description="d"),
+    ]
+    job = Job(kind="insights_regeneration")
+
+    with patch("main.get_pool", new_callable=AsyncMock) as mock_get_pool, patch(
+        "main._regenerate_insights", new_callable=AsyncMock
+    ) as mock_regenerate, patch(
+        "main.config", replace(config, insights_job_rps=1000)
+    ):
+        mock_get_pool.return_value = mock_db_pool
+        mock_regenerate.side_effect = ["Fresh", RuntimeError("throttled")]
+        await _regenerate_all_insights(job)
+
+    assert (job.total, job.succeeded, job.failed) == (2, 1, 1)
+    assert "deleted_at IS NULL" in mock_db_pool.fetch.call_args[0][0]
+
+
+def test_list_models(client):
+    with patch("main._available_model_ids", new_callable=AsyncMock) as mock_available:
+        mock_available.return_value = {"openai.gpt-oss-120b-1:0"}
+        response = client.get("/models")
+
+    assert response.status_code == 200
+    data = response.json()
+    assert data["default"] == "openai.gpt-oss-120b-1:0"
+    models = {model["id"]: model for model in data["models"]}
+    assert models["openai.gpt-oss-120b-1:0"]["label"] == "GPT-OSS 120B"
+    assert models["openai.gpt-oss-120b-1:0"]["available"] is True
+    assert models["openai.gpt-oss-20b-1:0"]["available"] is False
+
+
+def test_list_models_without_availability(client):
+    with patch("main._available_model_ids", new_callable=AsyncMock) as mock_available:
+        mock_available.return_value = None
+        response = client.get("/models")
+
+    assert response.status_code == 200
+    assert all(model["available"] is None for model in response.json()["models"])
+
+
+@pytest.mark.asyncio
+async def test_negotiate_start(client, mock_db_pool):
+    with patch("main.OrchestratorAgent") as MockOrch, \
+            patch("main.NegotiationSession") as MockSession, \
+            patch("main.NegotiationAgent") as MockAgent:
+        mock_db_pool.execute.return_value = None
+        MockAgent.return_value.send_initial_message = AsyncMock(return_value="Hello")
+        MockAgent.return_value.usage = TokenUsage(10, 20, 30)
+        sup_1 = "00000000-0000-4000-8000-000000000001"
+        sup_2 = "00000000-0000-4000-8000-000000000002"
+        mock_db_pool.fetch.return_value = [
+            MockRecord(supplier_id=sup_1, supplier_name="ACME", supplier_email=None,
+                       description="", insights=""),
+            MockRecord(supplier_id=sup_2, supplier_name="Globex", supplier_email=None,
+                       description="", insights=""),
+        ]
+
+        payload = {
+            "product": PRODUCT_ID,
+            "prompt": "Buy cheap",
+            "tactics": "Aggressive",
+            "suppliers": [sup_1, sup_2]
+        }
+
+        response = client.post("/negotiate", json=payload)
+
+        assert response.status_code == 200
+        data = response.json()
+        assert data["status"] == "started"
+        assert "negotiation_id" in data
+        assert MockAgent.call_count == 2
+        # Suppliers are loaded with a single query, skipping deleted ones
+        assert mock_db_pool.fetch.call_count == 1
+        assert "deleted_at IS NULL" in mock_db_pool.fetch.call_args[0][0]
+        # Token usage is summed across the supplier agents
+        assert data["usage"] == {
+            "prompt_tokens": 20,
+            "completion_tokens": 40,
+            "total_tokens": 60,
+        }
+
+@pytest.mark.asyncio
+async def test_negotiate_unknown_supplier(client, mock_db_pool):
+    with patch("main.OrchestratorAgent"), \
+            patch("main.NegotiationSession"), \
+            patch("main.NegotiationAgent") as MockAgent:
+        mock_db_pool.fetch.return_value = []
+
+        payload = {
+            "product": PRODUCT_ID,
+            "prompt": "Buy cheap",
+            "tactics": "Aggressive",
+            "suppliers": ["sup-missing"]
+        }
+
+        response = client.post("/negotiate", json=payload)
+
+        assert response.status_code == 200
+        data = response.json()
+        assert data["results"] == {"sup-missing": {"error": "not found"}}
+        assert MockAgent.call_count == 0
+
+
+def test_negotiate_unknown_product(client, mock_db_pool):
+    mock_db_pool.fetchrow.return_value = None
+
+    response = client.post("/negotiate", json=NEGOTIATION_PAYLOAD)
+
+    assert response.status_code == 404
+    assert response.json() == {"detail": "product not found", "code": "not_found"}
+    mock_db_pool.execute.assert_not_called()
+
+
+PRODUCT_ID = "00000000-0000-4000-8000-0000000000cc"
+
+
+@pytest.mark.parametrize(
+    "product, lookup",
+    [(PRODUCT_ID.upper(), PRODUCT_ID), ("  widgets ", "widgets")],
+)
+def test_negotiate_uses_catalog_product_name(client, mock_db_pool, product, lookup):
+    mock_db_pool.fetchrow.return_value = MockRecord(
+        product_id=PRODUCT_ID, product_name="Widgets", price=None, currency=None,
+        matches=1,
+    )
+    mock_db_pool.fetch.return_value = []
+
+    with patch("main.OrchestratorAgent") as MockOrch, patch("main.NegotiationSession"):
+        response = client.post(
+            "/negotiate", json={**NEGOTIATION_PAYLOAD, "product": product}
+        )
+
+    assert response.status_code == 200
+    assert mock_db_pool.fetchrow.call_args[0][1] == lookup
+    assert MockOrch.call_args[1]["product"] == "Widgets"
+    assert mock_db_pool.execute.call_args_list[0][0][3] == "Widgets"
+
+
+def test_negotiate_rejects_ambiguous_product_name(client, mock_db_pool):
+    mock_db_pool.fetchrow.return_value = MockRecord(
+        product_id=PRODUCT_ID, product_name="Widgets", price=None, currency=None,
+        matches=2,
+    )
+
+    response = client.post(
+        "/negotiate", json={**NEGOTIATION_PAYLOAD, "product": "widgets"}
+    )
+
+    assert response.status_code == 409
+    assert response.json() == {
+        "detail": "product name matches several products; use its product_id",
+        "code": "conflict",
+    }
+    assert "ORDER BY product_id" in mock_db_pool.fetchrow.call_args[0][0]
+    mock_db_pool.execute.assert_not_called()
+
+
+def test_iter_stream_events_buffers_partial_chunks():
+    payload = (
+        '{"choices":[{"delta":{"content":"h\u00e9llo"}}]}'
+        '{"choices":[{"delta":{"content":" world"}}]}'
+    ).encode()
+    # Split mid-object and mid multi-byte character
+    split = payload.index("\u00e9".encode()) + 1
+    chunks = [payload[:10], payload[10:split], payload[split:]]
+
+    events = list(_iter_stream_events(chunks))
+
+    assert [e["choices"][0]["delta"]["content"] for e in events] == ["h\u00e9llo", " world"]
+
+
+NEGOTIATION_PAYLOAD = {
+    "product": PRODUCT_ID,
+    "prompt": "Buy cheap",
+    "tactics": "Aggressive",
+    "suppliers": ["sup-1"],
+}
+IDEMPOTENCY_HEADERS = {"Idempotency-Key": "key-1"}
+
+
+TEMPLATE_ID = "00000000-0000-4000-8000-0000000000dd"
+
+
+def test_create_template(client, mock_db_pool):
+    mock_db_pool.fetchrow.return_value = MockRecord(
+        template_id=TEMPLATE_ID, name="Bulk order", prompt="Buy 1000", tactics=""
+    )
+
+    response = client.post(
+        "/templates", json={"name": "  Bulk   order ", "prompt": "Buy 1000"}
+    )
+
+    assert response.status_code == 201
+    assert response.json()["template_id"] == TEMPLATE_ID
+    assert mock_db_pool.fetchrow.call_args[0][1:] == ("Bulk order", "Buy 1000", "")
+
+
+def test_create_template_duplicate_name(client, mock_db_pool):
+    mock_db_pool.fetchrow.side_effect = asyncpg.UniqueViolationError("duplicate key")
+
+    response = client.post("/templates", json={"name": "Bulk", "prompt": "Buy"})
+
+    assert response.status_code == 409
+    assert response.json()["detail"] == "template name already exists"
+
+
+def test_replace_template(client, mock_db_pool):
+    mock_db_pool.fetchrow.return_value = MockRecord(template_id=TEMPLATE_ID)
+
+    response = client.put(
+        f"/templates/{TEMPLATE_ID.upper()}",
+        json={"name": "Bulk", "prompt": "Buy more", "tactics": "Patient"},
+    )
+
+    assert response.status_code == 200
+    query, *args = mock_db_pool.fetchrow.call_args[0]
+    assert "updated_at = now()" in query
+    assert args == ["Bulk", "Buy more", "Patient", TEMPLATE_ID]
+
+
+@pytest.mark.parametrize(
+    "method, json",
+    [("get", None), ("put", {"name": "Bulk", "prompt": "Buy"}), ("delete", None)],
+)
+def test_unknown_template(client, mock_db_pool, method, json):
+    mock_db_pool.fetchrow.return_value = None
+    mock_db_pool.fetchval.return_value = None
+
+    response = client.request(method, f"/templates/{TEMPLATE_ID}", json=json)
+
+    assert response.status_code == 404
+    assert response.json()["detail"] == "template not found"
+
+
+def test_negotiate_fills_in_from_template(client, mock_db_pool):
+    mock_db_pool.fetchrow.side_effect = [
+        MockRecord(prompt="Template prompt", tactics="Template tactics"),
+        MockRecord(
+            product_id=PRODUCT_ID, product_name="Widgets", price=None, currency=None
+        ),
+    ]
+    mock_db_pool.fetch.return_value = []
+    payload = {
+        "product": PRODUCT_ID,
+        "template_id": TEMPLATE_ID,
+        "tactics": "Aggressive",
+        "suppliers": ["sup-1"],
+    }
+
+    with patch("main.OrchestratorAgent") as MockOrch, patch("main.NegotiationSession"):
+        response = client.post("/negotiate", json=payload)
+
+    assert response.status_code == 200
+    negotiation_args = mock_db_pool.execute.call_args_list[0][0]
+    assert negotiation_args[4:] == ("Aggressive", "Template prompt")
+    assert MockOrch.call_args[1]["strategy"] == "Aggressive"
+
+
+def test_negotiate_requires_prompt_without_template(client, mock_db_pool):
+    payload = {"product": PRODUCT_ID, "tactics": "Aggressive", "suppliers": ["sup-1"]}
+
+    response = client.post("/negotiate", json=payload)
+
+    assert response.status_code == 400
+    assert response.json()["detail"] == "prompt required unless template_id is given"
+    mock_db_pool.execute.assert_not_called()
+
+
+def test_negotiate_idempotency_key_stores_response(client, mock_db_pool):
+    mock_db_pool.fetchval.return_value = "key-1"
+
+    with patch("main._start_negotiation", new_callable=AsyncMock) as mock_start:
+        mock_start.return_value = {"negotiation_id": "ng-1", "status": "started"}
+        response = client.post(
+            "/negotiate", json=NEGOTIATION_PAYLOAD, headers=IDEMPOTENCY_HEADERS
+        )
+
+    assert response.status_code == 200
+    assert "Idempotent-Replayed" not in response.headers
+    query, key, stored = mock_db_pool.execute.call_args[0]
+    assert "UPDATE idempotency_key SET response" in query
+    assert key == "key-1"
+    assert json.loads(stored)["negotiation_id"] == "ng-1"
+
+
+def test_negotiate_idempotency_key_store_failure_returns_response(
+    client, mock_db_pool
+):
+    mock_db_pool.fetchval.return_value = "key-1"
+    mock_db_pool.execute.side_effect = asyncpg.PostgresConnectionError("gone")
+
+    with patch("main._start_negotiation", new_callable=AsyncMock) as mock_start:
+        mock_start.return_value = {"negotiation_id": "ng-1", "status": "started"}
+        response = client.post(
+            "/negotiate", json=NEGOTIATION_PAYLOAD, headers=IDEMPOTENCY_HEADERS
+        )
+
+    assert response.status_code == 200
+    assert response.json()["negotiation_id"] == "ng-1"
+    assert "UPDATE idempotency_key" in mock_db_pool.execute.call_args[0][0]
+    # Releasing the key would let a retry contact the suppliers again
+    queries = [c[0][0] for c in mock_db_pool.execute.call_args_list]
+    assert not any(q.startswith("DELETE FROM idempotency_key") for q in queries)
+
+
+def test_negotiate_idempotency_key_replays(client, mock_db_pool):
+    fingerprint = idempotency.fingerprint(
+        NegotiationRequest(**NEGOTIATION_PAYLOAD).model_dump(mode="json")
+    )
+    mock_db_pool.fetchval.return_value = None
+    mock_db_pool.fetchrow.return_value = MockRecord(
+        fingerprint=fingerprint, response='{"negotiation_id": "ng-1"}'
+    )
+
+    with patch("main._start_negotiation", new_callable=AsyncMock) as mock_start:
+        response = client.post(
+            "/negotiate", json=NEGOTIATION_PAYLOAD, headers=IDEMPOTENCY_HEADERS
+        )
+
+    assert response.status_code == 200
+    assert response.json() == {"negotiation_id": "ng-1"}
+    assert response.headers["Idempotent-Replayed"] == "true"
+    mock_start.assert_not_called()
+
+
+@pytest.mark.parametrize(
+    "stored, status",
+    [({"fingerprint": "other", "response": "{}"}, 422), ({"response": None}, 409)],
+)
+def test_negotiate_idempotency_key_conflicts(client, mock_db_pool, stored, status):
+    fingerprint = idempotency.fingerprint(
+        NegotiationRequest(**NEGOTIATION_PAYLOAD).model_dump(mode="json")
+    )
+    mock_db_pool.fetchval.return_value = None
+    mock_db_pool.fetchrow.return_value = MockRecord(
+        **{"fingerprint": fingerprint, **stored}
+    )
+
+    with patch("main._start_negotiation", new_callable=AsyncMock) as mock_start:
+        response = client.post(
+            "/negotiate", json=NEGOTIATION_PAYLOAD, headers=IDEMPOTENCY_HEADERS
+        )
+
+    assert response.status_code == status
+    mock_start.assert_not_called()
+
+
+def test_negotiate_idempotency_key_released_on_failure(client, mock_db_pool):
+    mock_db_pool.fetchval.return_value = "key-1"
+
+    with patch("main._start_negotiation", new_callable=AsyncMock) as mock_start:
+        mock_start.side_effect = HTTPException(status_code=400, detail="bad model")
+        response = client.post(
+            "/negotiate", json=NEGOTIATION_PAYLOAD, headers=IDEMPOTENCY_HEADERS
+        )
+
+    assert response.status_code == 400
+    query = mock_db_pool.execute.call_args[0][0]
+    assert query.startswith("DELETE FROM idempotency_key WHERE key = $1")
+
+
+def test_negotiate_rejects_unknown_model(client, mock_db_pool):
+    payload = {
+        "product": PRODUCT_ID,
+        "prompt": "Buy cheap",
+        "tactics": "Aggressive",
+        "suppliers": ["sup-1"],
+        "model": "anthropic.some-expensive-model",
+    }
+
+    response = client.post("/negotiate", json=payload)
+
+    assert response.status_code == 400
+    mock_db_pool.execute.assert_not_called()
+
+
+@pytest.mark.parametrize(
+    "overrides, field",
+    [
+        ({"suppliers": []}, "suppliers"),
+        ({"suppliers": [f"sup-{i}" for i in range(21)]}, "suppliers"),
+        ({"prompt": ""}, "prompt"),
+        ({"product": ""}, "product"),
+    ],
+)
+def test_negotiate_validates_request(client, mock_db_pool, overrides, field):
+    payload = {
+        "product": PRODUCT_ID,
+        "prompt": "Buy cheap",
+        "tactics": "Aggressive",
+        "suppliers": ["sup-1"],
+    }
+    payload.update(overrides)
+
+    response = client.post("/negotiate", json=payload)
+
+    assert response.status_code == 400
+    assert response.json()["errors"][0]["field"] == field
+    mock_db_pool.execute.assert_not_called()
+
+
+def test_validation_errors_are_structured(client, mock_db_pool):
+    response = client.post("/negotiate", json={"product": PRODUCT_ID, "prompt": ""})
+
+    assert response.status_code == 400
+    body = response.json()
+    assert body["detail"] == "invalid request"
+    assert {"field": "tactics", "message": "is required"} in body["errors"]
+    assert {"field": "suppliers", "message": "is required"} in body["errors"]
+    assert any(error["field"] == "prompt" for error in body["errors"])
+
+
+def test_malformed_json_is_reported(client):
+    response = client.post(
+        "/negotiate", content="{not json", headers={"Content-Type": "application/json"}
+    )
+
+    assert response.status_code == 400
+    assert response.json()["errors"] == [
+        {"field": "body", "message": "must be valid JSON"}
+    ]
+
+
+@pytest.fixture
+def compare_enabled():
+    with patch("main.config", replace(config, features=frozenset({"compare"}))):
+        yield
+
+
+@pytest.mark.parametrize(
+    "path", ["/debug/pprof", "/debug/pprof/heap", "/debug/pprof/tasks"]
+)
+def test_pprof_disabled_by_default(client, path):
+    response = client.get(path)
+
+    assert response.status_code == 404
+
+
+def test_pprof_requires_api_key(client):
+    profiling = replace(config, enable_pprof=True)
+    with patch("main.config", profiling), patch.object(
+        api_key_auth, "keys", {"secret"}
+    ):
+        anonymous = client.get("/debug/pprof/heap")
+        response = client.get(
+            "/debug/pprof/heap?limit=5", headers={"X-API-Key": "secret"}
+        )
+
+    assert anonymous.status_code == 401
+    assert response.status_code == 200
+    assert len(response.json()["top"]) <= 5
+
+
+def test_pprof_task_and_thread_dumps(client):
+    with patch("main.config", replace(config, enable_pprof=True)):
+        tasks = client.get("/debug/pprof/tasks").json()
+        threads = client.get("/debug/pprof/threads").json()
+        bad_limit = client.get("/debug/pprof/heap?limit=0")
+
+    assert tasks["count"] == len(tasks["tasks"]) >= 1
+    assert threads["count"] >= 1
+    assert bad_limit.status_code == 400
+
+
+@pytest.mark.parametrize(
+    "method, path",
+    [("get", "/test/stream"), ("post", "/negotiations/compare")],
+)
+def test_experimental_routes_disabled_by_default(client, method, path):
+    with patch("main.call_bedrock_stream") as mock_stream:
+        response = client.request(method, path, json={})
+
+    assert response.status_code == 404
+    assert response.json() == {
+        "detail": "not found",
+        "code": "not_found",
+        "path": path,
+    }
+    mock_stream.assert_not_called()
+
+
+def test_streaming_feature_enabled(client):
+    streaming = replace(config, features=frozenset({"streaming"}))
+    with patch("main.config", streaming), patch(
+        "main.call_bedrock_stream", return_value=iter(["Hi"])
+    ):
+        response = client.get("/test/stream")
+
+    assert response.status_code == 200
+    assert response.headers["content-type"].startswith("text/event-stream")
+
+
+def test_stream_prompt_override(client):
+    streaming = replace(config, features=frozenset({"streaming"}))
+    with patch("main.config", streaming), patch(
+        "main.call_bedrock_stream", return_value=iter(["Hi", "!"])
+    ) as mock_stream:
+        response = client.get("/test/stream", params={"prompt": "  Say hi  "})
+
+    mock_stream.assert_called_once_with("Say hi")
+    assert response.text.endswith('data: {"delta": "!"}\n\ndata: [DONE]\n\n')
+
+
+@pytest.mark.parametrize("prompt", ["", "   ", "a" * 2001])
+def test_stream_rejects_bad_prompt(client, prompt):
+    streaming = replace(config, features=frozenset({"streaming"}))
+    with patch("main.config", streaming), patch(
+        "main.call_bedrock_stream"
+    ) as mock_stream:
+        response = client.get("/test/stream", params={"prompt": prompt})
+
+    assert response.status_code == 400
+    mock_stream.assert_not_called()
+
+
+def test_stream_error_event_hides_details(client):
+    def broken_stream():
+        yield "Hi"
+        raise RuntimeError("ReadTimeoutError on https://bedrock-runtime.internal")
+
+    streaming = replace(config, features=frozenset({"streaming"}))
+    with patch("main.config", streaming), patch(
+        "main.call_bedrock_stream", return_value=broken_stream()
+    ):
+        response = client.get("/test/stream")
+
+    assert response.text.endswith(
+        'event: error\ndata: {"error": "Bedrock service is currently unavailable"}\n\n'
+    )
+    assert "bedrock-runtime.internal" not in response.text
+
+
+def test_stream_times_out_when_bedrock_hangs(client):
+    def hung_stream():
+        time.sleep(0.5)
+        yield "too late"
+
+    streaming = replace(
+        config, features=frozenset({"streaming"}), bedrock_timeout_seconds=0.05
+    )
+    with patch("main.config", streaming), patch(
+        "main.call_bedrock_stream", return_value=hung_stream()
+    ):
+        response = client.get("/test/stream")
+
+    assert response.status_code == 200
+    assert response.text.startswith("event: error\n")
+    assert "did not respond within 0.05 seconds" in response.text
+    assert "too late" not in response.text
+
+
+def test_compare_ranks_supplier_responses(client, compare_enabled):
+    ranking = """```json
+[{"supplier_id": "s-2", "score": 85, "rationale": "Lower unit price"},
+ {"supplier_id": "s-1", "score": 60, "rationale": "Longer lead time"},
+ {"supplier_id": "s-9", "score": 99, "rationale": "Not a real supplier"}]
+```"""
+    responses = [
+        {"supplier_id": "s-1", "supplier_name": "ACME", "text": "$10 per unit"},
+        {"supplier_id": "s-2", "supplier_name": "Globex", "text": "$8 per unit"},
+        {"supplier_id": "s-3", "text": "Call us"},
+    ]
+
+    with patch("main._bedrock_completion", new_callable=AsyncMock) as mock_completion:
+        mock_completion.return_value = (ranking, TokenUsage(10, 5, 15))
+        response = client.post(
+            "/negotiations/compare", json={"responses": responses, "product": "Anvils"}
+        )
+
+    assert response.status_code == 200
+    data = response.json()
+    assert [entry["supplier_id"] for entry in data["ranking"]] == ["s-2", "s-1", "s-3"]
+    assert data["ranking"][0] == {
+        "rank": 1,
+        "supplier_id": "s-2",
+        "supplier_name": "Globex",
+        "score": 85,
+        "rationale": "Lower unit price",
+    }
+    assert data["ranking"][2]["score"] is None
+    assert data["usage"]["total_tokens"] == 15
+    assert "Anvils" in mock_completion.call_args[0][0]
+
+
+def test_validate_prompt_with_classifier(client, mock_db_pool):
+    reply = '{"acceptable": false, "reasons": ["suggests bribing the buyer"]}'
+
+    with patch("main._bedrock_completion", new_callable=AsyncMock) as mock_completion:
+        mock_completion.return_value = (reply, TokenUsage(10, 5, 15))
+        response = client.post(
+            "/negotiations/validate",
+            json={**NEGOTIATION_PAYLOAD, "prompt": "Offer them a kickback"},
+        )
+
+    assert response.status_code == 200
+    assert response.json() == {
+        "acceptable": False,
+        "reasons": ["suggests bribing the buyer"],
+        "method": "classifier",
+        "usage": {"prompt_tokens": 10, "completion_tokens": 5, "total_tokens": 15},
+    }
+    assert "Offer them a kickback" in mock_completion.call_args[0][0]
+    mock_db_pool.execute.assert_not_called()
+
+
+def test_validate_prompt_with_guardrail(client, mock_db_pool):
+    guardrail = MagicMock()
+    guardrail.apply_guardrail.return_value = {
+        "action": "GUARDRAIL_INTERVENED",
+        "assessments": [
+            {
+                "topicPolicy": {"topics": [{"name": "Bribery", "action": "BLOCKED"}]},
+                "contentPolicy": {"filters": [{"type": "INSULTS"}]},
+            }
+        ],
+    }
+
+    with patch(
+        "main.config", replace(config, bedrock_guardrail_id="gr-1")
+    ), patch("main.bedrock_guardrail_client", guardrail):
+        response = client.post("/negotiations/validate", json=NEGOTIATION_PAYLOAD)
+
+    assert response.json() == {
+        "acceptable": False,
+        "reasons": ["denied topic: Bribery", "content filter: insults"],
+        "method": "guardrail",
+    }
+    kwargs = guardrail.apply_guardrail.call_args[1]
+    assert kwargs["guardrailIdentifier"] == "gr-1"
+    assert "Buy cheap" in kwargs["content"][0]["text"]["text"]
+
+
+def test_validate_prompt_unparseable_reply(client, mock_db_pool):
+    with patch("main._bedrock_completion", new_callable=AsyncMock) as mock_completion:
+        mock_completion.return_value = ("Looks fine to me", TokenUsage())
+        response = client.post("/negotiations/validate", json=NEGOTIATION_PAYLOAD)
+
+    assert response.status_code == 502
+
+
+def test_negotiate_withholds_flagged_output(client, mock_db_pool):
+    sup = "00000000-0000-4000-8000-000000000001"
+    mock_db_pool.fetch.return_value = [
+        MockRecord(supplier_id=sup, supplier_name="ACME", supplier_email=None,
+                   description="", insights="")
+    ]
+    fake = FakeBedrockClient("Agree or we'll tell your boss about the kickbacks")
+    verdict = '{"acceptable": false, "reasons": ["threatens the supplier"]}'
+
+    with patch("main.config", replace(config, moderate_output=True)), \
+            patch("main.bedrock_client", fake), \
+            patch("main._bedrock_completion", new_callable=AsyncMock) as mock_check, \
+            patch("main.OrchestratorAgent"), \
+            patch("main.NegotiationSession"):
+        mock_check.return_value = (verdict, TokenUsage())
+        response = client.post(
+            "/negotiate", json={**NEGOTIATION_PAYLOAD, "suppliers": [sup]}
+        )
+
+    assert response.status_code == 200
+    data = response.json()
+    assert data["results"][sup] == WITHHELD_REPLY
+    assert data["moderation"] == {
+        sup: {
+            "status": "flagged",
+            "reasons": ["threatens the supplier"],
+            "method": "classifier",
+        }
+    }
+    assert "kickbacks" in mock_check.call_args[0][0]
+    # The flagged reply is never stored
+    assert not any(
+        "INSERT INTO message" in call[0][0]
+        for call in mock_db_pool.execute.call_args_list
+    )
+    # The placeholder the caller saw is kept in the negotiation's history
+    assert mock_db_pool.executemany.call_args[0][1][0][3] == WITHHELD_REPLY
+
+
+def test_negotiate_omits_moderation_when_disabled(client, mock_db_pool):
+    sup = "00000000-0000-4000-8000-000000000001"
+    mock_db_pool.fetch.return_value = [
+        MockRecord(supplier_id=sup, supplier_name="ACME", supplier_email=None,
+                   description="", insights="")
+    ]
+
+    with patch("main.bedrock_client", FakeBedrockClient("Hello ACME")), \
+            patch("main.OrchestratorAgent"), \
+            patch("main.NegotiationSession"):
+        response = client.post(
+            "/negotiate", json={**NEGOTIATION_PAYLOAD, "suppliers": [sup]}
+        )
+
+    assert response.json()["results"][sup] == "Hello ACME"
+    assert "moderation" not in response.json()
+
+
+async def test_moderate_output_uses_guardrail_output_source():
+    guardrail = MagicMock()
+    guardrail.apply_guardrail.return_value = {"action": "NONE"}
+
+    with patch(
+        "main.config", replace(config, bedrock_guardrail_id="gr-1")
+    ), patch("main.bedrock_guardrail_client", guardrail):
+        result = await _moderate_output("Could you do $9 per unit?", "model-1")
+
+    assert result == {"status": "pass", "reasons": [], "method": "guardrail"}
+    assert guardrail.apply_guardrail.call_args[1]["source"] == "OUTPUT"
+
+
+async def test_moderate_output_fails_closed():
+    with patch("main._bedrock_completion", new_callable=AsyncMock) as mock_check:
+        mock_check.side_effect = RuntimeError("throttled")
+        result = await _moderate_output("Could you do $9 per unit?", "model-1")
+
+    assert result == {
+        "status": "flagged",
+        "reasons": ["moderation check failed"],
+        "method": "classifier",
+    }
+
+
+def test_compare_single_response_skips_bedrock(client, compare_enabled):
+    with patch("main._bedrock_completion", new_callable=AsyncMock) as mock_completion:
+        response = client.post(
+            "/negotiations/compare",
+            json={"responses": [{"supplier_id": "s-1", "text": "$10 per unit"}]},
+        )
+
+    assert response.status_code == 200
+    assert response.json()["ranking"][0]["rank"] == 1
+    mock_completion.assert_not_called()
+
+
+def test_compare_stored_negotiation(client, mock_db_pool, compare_enabled):
+    mock_db_pool.fetchval.return_value = "Anvils"
+    mock_db_pool.fetch.return_value = [
+        MockRecord(supplier_id="s-1", supplier_name="ACME", message_text="$10"),
+        MockRecord(supplier_id="s-2", supplier_name="Globex", message_text="$8"),
+    ]
+    ranking = '[{"supplier_id": "s-2", "score": 90, "rationale": "Cheaper"}]'
+
+    with patch("main._bedrock_completion", new_callable=AsyncMock) as mock_completion:
+        mock_completion.return_value = (ranking, TokenUsage())
+        response = client.post(
+            "/negotiations/compare", json={"negotiation_id": "ng-1"}
+        )
+
+    assert response.status_code == 200
+    data = response.json()
+    assert data["negotiation_id"] == "ng-1"
+    assert [entry["supplier_id"] for entry in data["ranking"]] == ["s-2", "s-1"]
+    assert "role = 'supplier'" in mock_db_pool.fetch.call_args[0][0]
+
+
+@pytest.mark.parametrize(
+    "payload",
+    [{}, {"negotiation_id": "ng-1", "responses": [{"supplier_id": "s", "text": "t"}]}],
+)
+def test_compare_requires_one_source(client, payload, compare_enabled):
+    response = client.post("/negotiations/compare", json=payload)
+
+    assert response.status_code == 400
+
+
+def test_compare_unparseable_ranking(client, compare_enabled):
+    responses = [
+        {"supplier_id": "s-1", "text": "$10 per unit"},
+        {"supplier_id": "s-2", "text": "$8 per unit"},
+    ]
+
+    with patch("main._bedrock_completion", new_callable=AsyncMock) as mock_completion:
+        mock_completion.return_value = ("Globex is best.", TokenUsage())
+        response = client.post("/negotiations/compare", json={"responses": responses})
+
+    assert response.status_code == 502
+
+
+def test_export_negotiation_markdown(client, mock_db_pool):
+    mock_db_pool.fetchrow.return_value = MockRecord(
+        ng_id="ng-1",
+        product="Anvils",
+        strategy="Anchor low",
+        prompt="Need 200 units",
+        status="active",
+        created_at=datetime(2026, 1, 2, tzinfo=timezone.utc),
+    )
+    mock_db_pool.fetch.return_value = [
+        MockRecord(supplier_id="s-1", supplier_name="ACME", role="negotiator",
+                   message_text="Hello ACME"),
+        MockRecord(supplier_id="s-1", supplier_name="ACME", role="supplier",
+                   message_text="$10 each"),
+        MockRecord(supplier_id="s-1", supplier_name="ACME", role="supplier",
+                   message_text="$9 each for 200"),
+        MockRecord(supplier_id="s-2", supplier_name="Globex", role="negotiator",
+                   message_text="Hello Globex"),
+    ]
+
+    response = client.get("/negotiations/ng-1/export")
+
+    assert response.status_code == 200
+    assert response.headers["content-type"].startswith("text/markdown")
+    assert (
+        response.headers["content-disposition"]
+        == "attachment; filename=negotiation-ng-1.md"
+    )
+    text = response.text
+    assert text.startswith("# Negotiation: Anvils")
+    assert "Anchor low" in text
+    assert "## ACME (s-1)" in text
+    assert "$9 each for 200" in text
+    assert "$10 each\n" not in text
+    assert "## Globex (s-2)" in text
+    assert "_No response yet_" in text
+
+
+def test_export_negotiation_rejects_unknown_format(client, mock_db_pool):
+    response = client.get("/negotiations/ng-1/export?format=docx")
+
+    assert response.status_code == 400
+    mock_db_pool.fetchrow.assert_not_called()
+
+
+def test_export_negotiation_not_found(client, mock_db_pool):
+    mock_db_pool.fetchrow.return_value = None
+
+    response = client.get("/negotiations/ng-1/export")
+
+    assert response.status_code == 404
+
+
+def test_get_negotiation(client, mock_db_pool):
+    created = datetime(2024, 3, 1, tzinfo=timezone.utc)
+    mock_db_pool.fetchrow.return_value = MockRecord(
+        ng_id="ng-1",
+        product_id=PRODUCT_ID,
+        product="Widgets",
+        strategy="Aggressive",
+        prompt="Buy cheap",
+        status="active",
+        created_at=created,
+    )
+    mock_db_pool.fetch.return_value = [
+        MockRecord(
+            supplier_id="s-1",
+            supplier_name="ACME",
+            product_id=PRODUCT_ID,
+            generated_text="Opening offer",
+            error=None,
+            error_code=None,
+            created_at=created,
+        ),
+        MockRecord(
+            supplier_id="s-2",
+            supplier_name="Globex",
+            product_id=PRODUCT_ID,
+            generated_text=None,
+            error="generation failed",
+            error_code="upstream_error",
+            created_at=created,
+        ),
+    ]
+
+    response = client.get("/negotiations/ng-1")
+
+    assert response.status_code == 200
+    data = response.json()
+    assert data["prompt"] == "Buy cheap"
+    assert data["product_id"] == PRODUCT_ID
+    assert data["results"][0]["generated_text"] == "Opening offer"
+    # Suppliers that failed stay in the history
+    assert data["results"][1] == {
+        "supplier_id": "s-2",
+        "supplier_name": "Globex",
+        "product_id": PRODUCT_ID,
+        "generated_text": None,
+        "error": "generation failed",
+        "error_code": "upstream_error",
+        "created_at": created.isoformat(),
+    }
+    assert "FROM negotiation_result" in mock_db_pool.fetch.call_args[0][0]
+
+
+def test_get_negotiation_not_found(client, mock_db_pool):
+    mock_db_pool.fetchrow.return_value = None
+
+    response = client.get("/negotiations/ng-missing")
+
+    assert response.status_code == 404
+
+
+def test_list_negotiations_filters(client, mock_db_pool):
+    mock_db_pool.fetchval.return_value = 1
+    mock_db_pool.fetch.return_value = [
+        MockRecord(
+            ng_id="ng-1",
+            product_id=PRODUCT_ID,
+            product="Widgets",
+            strategy="Aggressive",
+            prompt="Buy cheap",
+            status="active",
+            created_at=None,
+        )
+    ]
+
+    response = client.get(
+        "/negotiations",
+        params={
+            "product_id": f" {PRODUCT_ID.upper()} ",
+            "supplier_id": "0A1B2C3D-0000-4000-8000-00000000000F",
+        },
+    )
+
+    assert response.status_code == 200
+    data = response.json()
+    assert data["total"] == 1
+    assert data["data"][0]["negotiation_id"] == "ng-1"
+    assert data["data"][0]["product_id"] == PRODUCT_ID
+    query, *args = mock_db_pool.fetch.call_args[0]
+    assert "n.product_id = $1::uuid" in query
+    assert "r.supplier_id = $2" in query
+    assert "FROM negotiation_result r" in query
+    assert "ORDER BY n.created_at DESC" in query
+    assert args == [PRODUCT_ID, "0a1b2c3d-0000-4000-8000-00000000000f", 50, 0]
+
+
+def test_list_negotiations_rejects_bad_product_id(client, mock_db_pool):
+    response = client.get("/negotiations?product_id=Widgets")
+
+    assert response.status_code == 400
+    assert response.json()["detail"] == "product_id must be a UUID"
+    mock_db_pool.fetch.assert_not_called()
+
+
+@pytest.mark.parametrize(
+    "tactics, template, expected",
+    [
+        ("00000000-0000-4000-8000-0000000000aa", "Anchor low, concede slowly",
+         "Anchor low, concede slowly"),
+        ("00000000-0000-4000-8000-0000000000bb", None,
+         "00000000-0000-4000-8000-0000000000bb"),
+        ("Be friendly", None, "Be friendly"),
+    ],
+)
+def test_negotiate_expands_tactic_templates(
+    client, mock_db_pool, tactics, template, expected
+):
+    mock_db_pool.fetchval.return_value = template
+    mock_db_pool.fetch.return_value = []
+
+    with patch("main.OrchestratorAgent") as MockOrch, patch("main.NegotiationSession"):
+        payload = {
+            "product": PRODUCT_ID,
+            "prompt": "Buy cheap",
+            "tactics": tactics,
+            "suppliers": ["sup-missing"],
+        }
+        response = client.post("/negotiate", json=payload)
+
+    assert response.status_code == 200
+    assert MockOrch.call_args[1]["strategy"] == expected
+    insert_args = mock_db_pool.execute.call_args_list[0][0]
+    assert insert_args[4] == expected
+    if tactics == "Be friendly":
+        mock_db_pool.fetchval.assert_not_called()
+
+
+def test_negotiate_prepends_history(client, mock_db_pool):
+    sup = "00000000-0000-4000-8000-000000000001"
+    mock_db_pool.fetch.return_value = [
+        MockRecord(supplier_id=sup, supplier_name="ACME", supplier_email=None,
+                   description="", insights=None),
+    ]
+    history = [
+        {"role": "user", "content": "We need 500 widgets by May"},
+        {"role": "assistant", "content": "Noted, I'll ask for volume pricing"},
+    ]
+    payload = {**NEGOTIATION_PAYLOAD, "suppliers": [sup], "dry_run": True}
+
+    response = client.post("/negotiate", json={**payload, "history": history})
+
+    assert response.status_code == 200
+    prompt = response.json()["results"][sup]["prompt"]
+    assert prompt[1:3] == history
+    assert prompt[-1]["role"] == "user"
+
+
+@pytest.mark.parametrize(
+    "history, message",
+    [
+        (
+            [
+                {"role": "user", "content": "a"},
+                {"role": "user", "content": "b"},
+                {"role": "assistant", "content": "c"},
+            ],
+            "roles must alternate between user and assistant",
+        ),
+        ([{"role": "user", "content": "a"}], "must end with an assistant message"),
+        (
+            [{"role": "assistant", "content": "x" * 20_001}],
+            "must be at most 20000 characters in total",
+        ),
+    ],
+)
+def test_negotiate_validates_history(client, mock_db_pool, history, message):
+    response = client.post(
+        "/negotiate", json={**NEGOTIATION_PAYLOAD, "history": history}
+    )
+
+    assert response.status_code == 400
+    assert response.json()["errors"] == [{"field": "history", "message": message}]
+    mock_db_pool.execute.assert_not_called()
+
+
+def test_negotiate_normalizes_supplier_ids(client, mock_db_pool):
+    sup = "00000000-0000-4000-8000-00000000000a"
+    mock_db_pool.fetch.return_value = [
+        MockRecord(supplier_id=sup, supplier_name="ACME", supplier_email=None,
+                   description="", insights=None),
+    ]
+    payload = {
+        **NEGOTIATION_PAYLOAD,
+        "suppliers": [f"  {sup.upper()} ", " sup-missing"],
+        "dry_run": True,
+    }
+
+    response = client.post("/negotiate", json=payload)
+
+    assert response.status_code == 200
+    data = response.json()
+    assert data["suppliers"] == [sup, "sup-missing"]
+    assert data["results"][sup]["generated_text"].endswith("ACME")
+    assert mock_db_pool.fetch.call_args[0][1] == [sup]
+
+
+def test_negotiate_anchors_on_product_price(client, mock_db_pool):
+    sup = "00000000-0000-4000-8000-000000000001"
+    mock_db_pool.fetchrow.return_value = MockRecord(
+        product_name="Widgets", price=Decimal("12.50"), currency="EUR"
+    )
+    mock_db_pool.fetch.return_value = [
+        MockRecord(supplier_id=sup, supplier_name="ACME", insights=None)
+    ]
+
+    response = client.post(
+        "/negotiate",
+        json={**NEGOTIATION_PAYLOAD, "suppliers": [sup], "dry_run": True},
+    )
+
+    prompt = response.json()["results"][sup]["prompt"][-1]["content"]
+    assert "We currently pay 12.50 EUR per unit" in prompt
+
+
+@pytest.mark.parametrize(
+    "length, status",
+    [(MAX_SYSTEM_PROMPT_LENGTH, 200), (MAX_SYSTEM_PROMPT_LENGTH + 1, 422)],
+)
+def test_negotiate_caps_system_prompt(client, mock_db_pool, length, status):
+    sup = "00000000-0000-4000-8000-000000000001"
+    mock_db_pool.fetch.return_value = [
+        MockRecord(supplier_id=sup, supplier_name="ACME", supplier_email=None,
+                   description="", insights=""),
+    ]
+    payload = {
+        **NEGOTIATION_PAYLOAD,
+        "suppliers": [sup],
+        "system_prompt": "x" * length,
+        "dry_run": True,
+    }
+
+    response = client.post("/negotiate", json=payload)
+
+    assert response.status_code == status
+    if status == 200:
+        prompt = response.json()["results"][sup]["prompt"]
+        assert prompt[0] == {"role": "system", "content": "x" * length}
+    else:
+        limit = MAX_SYSTEM_PROMPT_LENGTH
+        assert response.json() == {
+            "detail": f"system_prompt must be at most {limit} characters",
+            "code": "unprocessable",
+        }
+    mock_db_pool.execute.assert_not_called()
+
+
+def test_negotiate_dry_run(client, mock_db_pool):
+    sup = "00000000-0000-4000-8000-000000000001"
+    mock_db_pool.fetch.return_value = [
+        MockRecord(supplier_id=sup, supplier_name="ACME", supplier_email=None,
+                   description="", insights="Prefers long contracts"),
+    ]
+    payload = {
+        "product": PRODUCT_ID,
+        "prompt": "Buy cheap",
+        "tactics": "Aggressive",
+        "suppliers": [sup, "sup-missing"],
+        "dry_run": True,
+    }
+
+    with patch("main.invoke_model_with_retry", new_callable=AsyncMock) as mock_invoke:
+        response = client.post("/negotiate", json=payload)
+
+    assert response.status_code == 200
+    data = response.json()
+    assert data["status"] == "dry_run"
+    assert data["negotiation_id"] is None
+    result = data["results"][sup]
+    assert result["generated_text"] == "[dry run] Opening message to ACME"
+    assert result["prompt"][0]["role"] == "system"
+    assert "Buy cheap" in result["prompt"][-1]["content"]
+    assert "Prefers long contracts" in result["prompt"][-1]["content"]
+    assert data["results"]["sup-missing"] == {"error": "not found"}
+    mock_invoke.assert_not_called()
+    mock_db_pool.execute.assert_not_called()
+
+
+@pytest.mark.parametrize("include_prompt", [False, True])
+def test_negotiate_include_prompt(client, mock_db_pool, include_prompt):
+    sup = "00000000-0000-4000-8000-000000000001"
+    mock_db_pool.fetch.return_value = [
+        MockRecord(supplier_id=sup, supplier_name="ACME", supplier_email=None,
+                   description="", insights=""),
+    ]
+    prompt = [{"role": "user", "content": "Open talks with ACME"}]
+
+    with patch("main.OrchestratorAgent"), \
+            patch("main.NegotiationSession"), \
+            patch("main.NegotiationAgent") as MockAgent:
+        MockAgent.return_value.send_initial_message = AsyncMock(return_value="Hello")
+        MockAgent.return_value.build_initial_messages.return_value = prompt
+        MockAgent.return_value.usage = TokenUsage()
+        payload = {
+            "product": PRODUCT_ID,
+            "prompt": "Buy cheap",
+            "tactics": "Aggressive",
+            "suppliers": [sup],
+            "include_prompt": include_prompt,
+        }
+
+        response = client.post("/negotiate", json=payload)
+
+    assert response.status_code == 200
+    result = response.json()["results"][sup]
+    if include_prompt:
+        assert result == {"generated_text": "Hello", "prompt": prompt}
+    else:
+        assert result == "Hello"
+
+
+def test_negotiate_rejects_oversized_body(client, mock_db_pool):
+    payload = {
+        "product": PRODUCT_ID,
+        "prompt": "x" * (config.max_body_bytes + 1),
+        "tactics": "Aggressive",
+        "suppliers": ["00000000-0000-4000-8000-000000000001"],
+    }
+
+    response = client.post("/negotiate", json=payload)
+
+    assert response.status_code == 413
+    mock_db_pool.execute.assert_not_called()
+
+
+def test_negotiate_isolates_supplier_failures(client, mock_db_pool):
+    sup_ok = "00000000-0000-4000-8000-000000000001"
+    sup_bad = "00000000-0000-4000-8000-000000000002"
+    mock_db_pool.fetchrow.return_value = MockRecord(
+        product_id=PRODUCT_ID, product_name="Widgets", price=None, currency=None
+    )
+    mock_db_pool.fetch.return_value = [
+        MockRecord(supplier_id=sup_ok, supplier_name="ACME", supplier_email=None,
+                   description="", insights=""),
+        MockRecord(supplier_id=sup_bad, supplier_name="Globex", supplier_email=None,
+                   description="", insights=""),
+    ]
+
+    def make_agent(**kwargs):
+        agent = AsyncMock()
+        agent.usage = TokenUsage()
+        if kwargs["sup_id"] == sup_bad:
+            agent.send_initial_message.side_effect = RuntimeError("email bounced")
+        else:
+            agent.send_initial_message.return_value = "Hello ACME"
+        return agent
+
+    with patch("main.OrchestratorAgent"), \
+            patch("main.NegotiationSession"), \
+            patch("main.NegotiationAgent", side_effect=make_agent):
+        payload = {
+            "product": PRODUCT_ID,
+            "prompt": "Buy cheap",
+            "tactics": "Aggressive",
+            "suppliers": [sup_ok, sup_bad],
+        }
+
+        response = client.post("/negotiate", json=payload)
+
+    assert response.status_code == 200
+    results = response.json()["results"]
+    assert results[sup_ok] == "Hello ACME"
+    # The cause is logged; clients get a stable message
+    assert results[sup_bad] == {
+        "error": "generation failed",
+        "code": "upstream_error",
+    }
+    # Both outcomes are recorded for GET /negotiations/{id}
+    query, rows = mock_db_pool.executemany.call_args[0]
+    assert "INSERT INTO negotiation_result" in query
+    ng_id = response.json()["negotiation_id"]
+    assert rows == [
+        (ng_id, sup_ok, PRODUCT_ID, 0, "Hello ACME", None, None),
+        (ng_id, sup_bad, PRODUCT_ID, 1, None, "generation failed", "upstream_error"),
+    ]
+    # The negotiation keys on the catalog product, not just its name
+    negotiation_insert = mock_db_pool.execute.call_args_list[0][0]
+    assert negotiation_insert[2] == PRODUCT_ID
+
+
+def test_negotiate_hides_bedrock_error_details(client, mock_db_pool):
+    sup = "00000000-0000-4000-8000-000000000001"
+    mock_db_pool.fetch.return_value = [
+        MockRecord(supplier_id=sup, supplier_name="ACME", supplier_email=None,
+                   description="", insights="")
+    ]
+    failing = MagicMock()
+    failing.invoke_model.side_effect = RuntimeError(
+        "AccessDeniedException: arn:aws:iam::123456789012:role/negotiator"
+    )
+
+    with patch("main.bedrock_client", failing), \
+            patch("main.OrchestratorAgent"), \
+            patch("main.NegotiationSession"):
+        response = client.post(
+            "/negotiate", json={**NEGOTIATION_PAYLOAD, "suppliers": [sup]}
+        )
+
+    assert response.status_code == 200
+    assert response.json()["results"][sup] == {
+        "error": "generation failed",
+        "code": "upstream_error",
+    }
+    assert "123456789012" not in response.text
+
@@ -0,0 +1,332 @@
+import ipaddress
+import json
+import logging
+import pytest
+import re
+import zlib
+from middleware import (
+    BodySizeLimitMiddleware,
+    DebugBodyLogMiddleware,
+    GZipMiddleware,
+    JSONContentTypeMiddleware,
+    JsonFormatter,
+    ProxyHeadersMiddleware,
+    RateLimiter,
+    RequestIdFilter,
+    request_id_var,
+)
+
+
+def _record(msg, **extra):
+    record = logging.LogRecord("test", logging.INFO, __file__, 1, msg, None, None)
+    for key, value in extra.items():
+        setattr(record, key, value)
+    return record
+
+
+def test_json_formatter_includes_request_id_and_fields():
+    token = request_id_var.set("req-123")
+    try:
+        record = _record("GET /health 200", fields={"status": 200, "path": "/health"})
+        RequestIdFilter().filter(record)
+        line = JsonFormatter().format(record)
+    finally:
+        request_id_var.reset(token)
+
+    entry = json.loads(line)
+    assert entry["message"] == "GET /health 200"
+    assert entry["request_id"] == "req-123"
+    assert entry["status"] == 200
+    assert entry["path"] == "/health"
+
+
+def test_json_formatter_without_request():
+    record = _record("startup")
+    RequestIdFilter().filter(record)
+
+    entry = json.loads(JsonFormatter().format(record))
+
+    assert "request_id" not in entry
+    assert entry["level"] == "INFO"
+
+
+def test_rate_limiter_refills_over_time():
+    now = [0.0]
+    limiter = RateLimiter(rate=1.0, burst=2, clock=lambda: now[0])
+
+    assert limiter.acquire("1.2.3.4") == 0
+    assert limiter.acquire("1.2.3.4") == 0
+    assert limiter.acquire("1.2.3.4") == 1.0
+    # Other clients have their own bucket
+    assert limiter.acquire("5.6.7.8") == 0
+
+    now[0] = 1.0
+    assert limiter.acquire("1.2.3.4") == 0
+
+
+def test_rate_limiter_prunes_idle_keys():
+    now = [0.0]
+    limiter = RateLimiter(rate=1.0, burst=2, clock=lambda: now[0])
+    limiter.acquire("1.2.3.4")
+
+    now[0] = 10.0
+    limiter.prune()
+
+    assert limiter._buckets == {}
+
+
+async def _run_asgi(app, headers, chunks, path="/"):
+    messages = [
+        {"type": "http.request", "body": chunk, "more_body": i < len(chunks) - 1}
+        for i, chunk in enumerate(chunks)
+    ]
+    sent = []
+
+    async def receive():
+        return messages.pop(0)
+
+    async def send(message):
+        sent.append(message)
+
+    scope = {"type": "http", "method": "POST", "path": path, "headers": headers}
+    await app(scope, receive, send)
+    return sent[0]["status"]
+
+
+async def _echo_app(scope, receive, send):
+    while (await receive()).get("more_body"):
+        pass
+    await send({"type": "http.response.start", "status": 200, "headers": []})
+    await send({"type": "http.response.body", "body": b""})
+
+
+@pytest.mark.asyncio
+async def test_body_limit_rejects_declared_length():
+    app = BodySizeLimitMiddleware(_echo_app, max_bytes=10)
+
+    status = await _run_asgi(app, [(b"content-length", b"11")], [b"x" * 11])
+
+    assert status == 413
+
+
+@pytest.mark.asyncio
+async def test_body_limit_counts_chunked_bodies():
+    app = BodySizeLimitMiddleware(_echo_app, max_bytes=10)
+
+    assert await _run_asgi(app, [], [b"x" * 5, b"x" * 5]) == 200
+    assert await _run_asgi(app, [], [b"x" * 6, b"x" * 6]) == 413
+
+
+@pytest.mark.asyncio
+async def test_body_limit_route_override():
+    app = BodySizeLimitMiddleware(
+        _echo_app, max_bytes=10, route_limits=[(re.compile(r"^/upload$"), 100)]
+    )
+
+    assert await _run_asgi(app, [], [b"x" * 50], path="/upload") == 200
+    assert await _run_asgi(app, [], [b"x" * 50], path="/other") == 413
+
+
+@pytest.mark.asyncio
+@pytest.mark.parametrize(
+    "headers, status",
+    [
+        ([(b"content-type", b"application/json"), (b"content-length", b"2")], 200),
+        (
+            [
+                (b"content-type", b"Application/JSON; charset=utf-8"),
+                (b"content-length", b"2"),
+            ],
+            200,
+        ),
+        ([(b"content-length", b"0")], 200),
+        ([(b"content-type", b"text/plain"), (b"content-length", b"2")], 415),
+        ([(b"transfer-encoding", b"chunked")], 415),
+    ],
+)
+async def test_json_content_type_required_on_writes(headers, status):
+    app = JSONContentTypeMiddleware(_echo_app)
+
+    assert await _run_asgi(app, headers, [b"{}"]) == status
+
+
+@pytest.mark.asyncio
+async def test_json_content_type_route_override():
+    app = JSONContentTypeMiddleware(
+        _echo_app,
+        route_types=[(re.compile(r"^/upload$"), frozenset({"multipart/form-data"}))],
+    )
+    headers = [
+        (b"content-type", b"multipart/form-data; boundary=x"),
+        (b"content-length", b"2"),
+    ]
+
+    assert await _run_asgi(app, headers, [b"{}"], path="/upload") == 200
+    assert await _run_asgi(app, headers, [b"{}"], path="/other") == 415
+
+
+async def _client_ip(trusted, peer, forwarded=None):
+    seen = {}
+
+    async def app(scope, receive, send):
+        seen["client"] = scope["client"][0]
+
+    headers = [(b"x-forwarded-for", forwarded.encode())] if forwarded else []
+    scope = {"type": "http", "headers": headers, "client": (peer, 1234)}
+    await ProxyHeadersMiddleware(app, trusted=trusted)(scope, None, None)
+    return seen["client"]
+
+
+@pytest.mark.asyncio
+@pytest.mark.parametrize(
+    "peer, forwarded, expected",
+    [
+        ("10.0.0.5", "203.0.113.7", "203.0.113.7"),
+        # The client-supplied left part is ignored past the first untrusted hop
+        ("10.0.0.5", "1.1.1.1, 203.0.113.7, 10.0.0.9", "203.0.113.7"),
+        ("10.0.0.5", None, "10.0.0.5"),
+        ("198.51.100.1", "203.0.113.7", "198.51.100.1"),
+    ],
+)
+async def test_proxy_headers_from_trusted_proxy(peer, forwarded, expected):
+    trusted = [ipaddress.ip_network("10.0.0.0/8")]
+
+    assert await _client_ip(trusted, peer, forwarded) == expected
+
+
+@pytest.mark.asyncio
+async def test_proxy_headers_ignored_without_trusted_proxies():
+    assert await _client_ip([], "10.0.0.5", "203.0.113.7") == "10.0.0.5"
+
+
+def _response_app(content_type, chunks):
+    async def app(scope, receive, send):
+        await send(
+            {
+                "type": "http.response.start",
+                "status": 200,
+                "headers": [(b"content-type", content_type)],
+            }
+        )
+        for i, chunk in enumerate(chunks):
+            more_body = i < len(chunks) - 1
+            await send(
+                {"type": "http.response.body", "body": chunk, "more_body": more_body}
+            )
+
+    return app
+
+
+async def _get(app, accept_encoding=b"gzip, deflate"):
+    sent = []
+
+    async def send(message):
+        sent.append(message)
+
+    scope = {
+        "type": "http",
+        "method": "GET",
+        "path": "/",
+        "headers": [(b"accept-encoding", accept_encoding)],
+    }
+    await app(scope, None, send)
+    headers = dict(sent[0]["headers"])
+    body = b"".join(message.get("body", b"") for message in sent[1:])
+    return headers, body, len(sent) - 1
+
+
+@pytest.mark.asyncio
+async def test_gzip_compresses_large_responses():
+    payload = b'{"data": []}' * 200
+    app = GZipMiddleware(_response_app(b"application/json", [payload]), 500)
+
+    headers, body, _ = await _get(app)
+
+    assert headers[b"content-encoding"] == b"gzip"
+    assert int(headers[b"content-length"]) == len(body)
+    assert zlib.decompress(body, 31) == payload
+
+
+@pytest.mark.asyncio
+async def test_gzip_skips_small_responses_and_other_encodings():
+    small = GZipMiddleware(_response_app(b"application/json", [b"{}"]), 500)
+    large = GZipMiddleware(_response_app(b"application/json", [b"x" * 1000]), 500)
+
+    headers, body, _ = await _get(small)
+    assert b"content-encoding" not in headers
+    assert body == b"{}"
+
+    headers, body, _ = await _get(large, accept_encoding=b"br")
+    assert b"content-encoding" not in headers
+    assert body == b"x" * 1000
+
+
+@pytest.mark.asyncio
+async def test_gzip_excludes_event_streams():
+    chunks = [b"data: one\n\n", b"data: two\n\n"]
+    app = GZipMiddleware(_response_app(b"text/event-stream", chunks), minimum_size=0)
+
+    headers, body, sent = await _get(app)
+
+    assert b"content-encoding" not in headers
+    assert body == b"".join(chunks)
+    assert sent == 2
+
+
+@pytest.mark.asyncio
+async def test_gzip_streams_chunks_without_buffering():
+    chunks = [b"a" * 600, b"b" * 600, b""]
+    app = GZipMiddleware(_response_app(b"text/csv", chunks), minimum_size=500)
+
+    headers, body, sent = await _get(app)
+
+    assert headers[b"content-encoding"] == b"gzip"
+    assert b"content-length" not in headers
+    assert sent == 3
+    assert zlib.decompress(body, 31) == b"a" * 600 + b"b" * 600
+
+
+async def _reading_app(scope, receive, send):
+    body = b""
+    while True:
+        message = await receive()
+        body += message.get("body", b"")
+        if not message.get("more_body"):
+            break
+    await send({"type": "http.response.start", "status": 201, "headers": []})
+    await send({"type": "http.response.body", "body": body})
+
+
+@pytest.mark.asyncio
+async def test_debug_body_log_redacts_and_truncates(caplog):
+    app = DebugBodyLogMiddleware(_reading_app, max_body_bytes=35)
+    body = b'{"email": "a@b.c", "password": "hunter2", "note": "' + b"x" * 50 + b'"}'
+    headers = [(b"authorization", b"Bearer secret"), (b"content-type", b"text/json")]
+
+    with caplog.at_level(logging.DEBUG, logger="negotiation.middleware"):
+        status = await _run_asgi(app, headers, [body[:30], body[30:]])
+
+    assert status == 201
+    fields = caplog.records[-1].fields
+    assert fields["request_headers"] == {
+        "authorization": "[redacted]",
+        "content-type": "text/json",
+    }
+    # Cut off mid-password by the 35 byte cap, and still redacted
+    assert "hun" not in caplog.text
+    assert fields["request_bytes"] == len(body)
+    assert fields["request_truncated"] is True
+    assert fields["status"] == 201
+    assert fields["response_bytes"] == len(body)
+
+
+def test_secret_fields_redacted():
+    from middleware import SECRET_FIELD_PATTERN
+
+    text = '{"Password": "a\\"b", "api_key":"k", "name": "ACME"}'
+
+    redacted = SECRET_FIELD_PATTERN.sub(r'\1"[redacted]"', text)
+
+    assert redacted == (
+        '{"Password": "[redacted]", "api_key":"[redacted]", "name": "ACME"}'
+    )
@@ -0,0 +1,52 @@
+import pytest
+from migrations import MigrationError, apply_migrations
+from tests.conftest import MockRecord
+
+
+def _write(directory, name, sql):
+    (directory / name).write_text(sql)
+
+
+@pytest.mark.asyncio
+async def test_apply_migrations_in_order(mock_db_pool, tmp_path):
+    _write(tmp_path, "0002_second.sql", "ALTER TABLE t ADD COLUMN b INT;")
+    _write(tmp_path, "0001_first.sql", "CREATE TABLE t (a INT);")
+    conn = mock_db_pool.acquire.return_value.__aenter__.return_value
+    conn.fetch.return_value = []
+
+    applied = await apply_migrations(mock_db_pool, tmp_path)
+
+    assert applied == ["0001_first", "0002_second"]
+    executed = [call[0][0] for call in conn.execute.call_args_list]
+    assert executed.index("CREATE TABLE t (a INT);") < executed.index(
+        "ALTER TABLE t ADD COLUMN b INT;"
+    )
+
+
+@pytest.mark.asyncio
+async def test_apply_migrations_skips_applied(mock_db_pool, tmp_path):
+    _write(tmp_path, "0001_first.sql", "CREATE TABLE t (a INT);")
+    conn = mock_db_pool.acquire.return_value.__aenter__.return_value
+    conn.fetch.return_value = [MockRecord(version="0001_first")]
+
+    applied = await apply_migrations(mock_db_pool, tmp_path)
+
+    assert applied == []
+    executed = [call[0][0] for call in conn.execute.call_args_list]
+    assert "CREATE TABLE t (a INT);" not in executed
+
+
+@pytest.mark.asyncio
+async def test_apply_migrations_reports_failing_file(mock_db_pool, tmp_path):
+    _write(tmp_path, "0001_broken.sql", "CREATE TABLE oops (;")
+    conn = mock_db_pool.acquire.return_value.__aenter__.return_value
+    conn.fetch.return_value = []
+
+    async def execute(sql, *args):
+        if sql.startswith("CREATE TABLE oops"):
+            raise Exception("syntax error")
+
+    conn.execute.side_effect = execute
+
+    with pytest.raises(MigrationError):
+        await apply_migrations(mock_db_pool, tmp_path)
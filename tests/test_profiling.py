@@ -0,0 +1,52 @@
+import asyncio
+import tracemalloc
+
+from profiling import heap_profile, start_heap_tracing, task_dump, thread_dump
+
+
+def test_heap_profile_lists_largest_call_sites():
+    start_heap_tracing()
+    retained = [bytes(1024) for _ in range(1000)]
+    try:
+        profile = heap_profile(limit=3)
+    finally:
+        tracemalloc.stop()
+
+    assert profile["tracing"] is True
+    assert profile["current_bytes"] >= len(retained) * 1024
+    assert 1 <= len(profile["top"]) <= 3
+    sizes = [entry["size_bytes"] for entry in profile["top"]]
+    assert sizes == sorted(sizes, reverse=True)
+    assert any("test_profiling.py" in line for line in profile["top"][0]["traceback"])
+
+
+async def test_task_dump_follows_await_chain():
+    async def wait_for_supplier():
+        await asyncio.sleep(10)
+
+    async def negotiate():
+        await wait_for_supplier()
+
+    task = asyncio.create_task(negotiate(), name="negotiation-1")
+    await asyncio.sleep(0)
+    try:
+        dump = task_dump()
+    finally:
+        task.cancel()
+
+    [entry] = [t for t in dump["tasks"] if t["name"] == "negotiation-1"]
+    assert entry["coro"].endswith("negotiate")
+    assert [line.rsplit(" in ", 1)[1] for line in entry["stack"][:2]] == [
+        "negotiate",
+        "wait_for_supplier",
+    ]
+
+
+def test_thread_dump_includes_current_thread():
+    dump = thread_dump()
+
+    assert dump["count"] == len(dump["threads"])
+    assert any(
+        "test_thread_dump_includes_current_thread" in "".join(thread["stack"])
+        for thread in dump["threads"]
+    )
@@ -0,0 +1,48 @@
+from types import SimpleNamespace
+from unittest.mock import MagicMock, patch
+
+import pytest
+from querylog import SlowQueryLogger
+
+
+def _record(elapsed, query="SELECT 1", exception=None):
+    return SimpleNamespace(
+        query=query, args=("secret",), elapsed=elapsed, exception=exception
+    )
+
+
+def test_fast_queries_are_not_logged():
+    with patch("querylog.logger") as logger:
+        SlowQueryLogger(threshold_ms=100)(_record(elapsed=0.05))
+
+    logger.warning.assert_not_called()
+
+
+def test_slow_query_logged_with_sql_and_duration():
+    query = """
+        SELECT *
+        FROM product
+        WHERE supplier_id = $1
+    """
+    with patch("querylog.logger") as logger:
+        SlowQueryLogger(threshold_ms=100)(_record(elapsed=0.25, query=query))
+
+    message = logger.warning.call_args[0][0]
+    fields = logger.warning.call_args[1]["extra"]["fields"]
+    assert message == "Slow query (250ms): SELECT * FROM product WHERE supplier_id = $1"
+    assert fields == {
+        "query": "SELECT * FROM product WHERE supplier_id = $1",
+        "duration_ms": 250.0,
+        "failed": False,
+    }
+    assert "secret" not in repr(logger.warning.call_args)
+
+
+@pytest.mark.asyncio
+async def test_install_registers_on_connection():
+    conn = MagicMock()
+    slow_query_logger = SlowQueryLogger(threshold_ms=100)
+
+    await slow_query_logger.install(conn)
+
+    conn.add_query_logger.assert_called_once_with(slow_query_logger)
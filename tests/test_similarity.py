@@ -0,0 +1,53 @@
+import pytest
+from similarity import cluster_by_similarity, cosine_similarity, embedding_key
+
+
+def test_cosine_similarity():
+    assert cosine_similarity([1, 0], [2, 0]) == pytest.approx(1.0)
+    assert cosine_similarity([1, 0], [0, 3]) == pytest.approx(0.0)
+    assert cosine_similarity([1, 0], [-1, 0]) == pytest.approx(-1.0)
+    assert cosine_similarity([0, 0], [1, 0]) == 0.0
+
+
+def test_cosine_similarity_rejects_mismatched_lengths():
+    with pytest.raises(ValueError):
+        cosine_similarity([1, 0], [1, 0, 0])
+
+
+def test_embedding_key_changes_with_text_and_model():
+    key = embedding_key("titan", "Steel anvils")
+
+    assert key == embedding_key("titan", "Steel anvils")
+    assert key != embedding_key("titan", "Steel anvils, wholesale")
+    assert key != embedding_key("cohere", "Steel anvils")
+
+
+def test_cluster_by_similarity_groups_close_vectors():
+    vectors = {
+        "a": [1.0, 0.0],
+        "b": [0.99, 0.1],
+        "c": [0.0, 1.0],
+        "d": [0.1, 0.99],
+        "e": [1.0, 1.0],
+    }
+
+    groups = cluster_by_similarity(vectors, 0.95)
+
+    assert [members for members, _ in groups] == [["a", "b"], ["c", "d"]]
+    assert groups[0][1] == pytest.approx(cosine_similarity([1, 0], [0.99, 0.1]))
+
+
+def test_cluster_by_similarity_chains_and_reports_weakest_link():
+    # a~b and b~c are above the threshold, a~c on its own is not
+    vectors = {"a": [1.0, 0.0], "b": [1.0, 0.3], "c": [1.0, 0.6]}
+
+    [(members, weakest)] = cluster_by_similarity(vectors, 0.94)
+
+    assert members == ["a", "b", "c"]
+    assert weakest == pytest.approx(cosine_similarity([1, 0], [1, 0.3]))
+    assert cosine_similarity(vectors["a"], vectors["c"]) < 0.94
+
+
+def test_cluster_by_similarity_without_matches():
+    assert cluster_by_similarity({"a": [1.0, 0.0], "b": [0.0, 1.0]}, 0.5) == []
+    assert cluster_by_similarity({}, 0.5) == []
@@ -0,0 +1,106 @@
+from datetime import datetime, timezone
+from unittest.mock import AsyncMock, patch
+
+import asyncpg
+import pytest
+from store import PgStore
+from tests.conftest import MockRecord
+
+
+@pytest.mark.asyncio
+async def test_list_suppliers_filters_and_pages(mock_db_pool):
+    mock_db_pool.fetchval.return_value = 1
+    mock_db_pool.fetch.return_value = [MockRecord(supplier_id="s-1")]
+
+    rows, total = await PgStore(mock_db_pool).list_suppliers(
+        10, 20, tag="logistics"
+    )
+
+    assert (rows, total) == ([{"supplier_id": "s-1"}], 1)
+    query, *args = mock_db_pool.fetch.call_args[0]
+    assert "WHERE deleted_at IS NULL AND tags @> ARRAY[$1]::text[]" in query
+    assert args == ["logistics", 10, 20]
+
+
+@pytest.mark.asyncio
+async def test_list_suppliers_created_after(mock_db_pool):
+    mock_db_pool.fetchval.return_value = 0
+    after = datetime(2026, 10, 8, tzinfo=timezone.utc)
+
+    await PgStore(mock_db_pool).list_suppliers(10, 0, created_after=after)
+
+    query, *args = mock_db_pool.fetch.call_args[0]
+    assert "WHERE deleted_at IS NULL AND created_at > $1" in query
+    assert args == [after, 10, 0]
+
+
+@pytest.mark.asyncio
+async def test_list_suppliers_including_deleted(mock_db_pool):
+    mock_db_pool.fetchval.return_value = 0
+
+    await PgStore(mock_db_pool).list_suppliers(10, 0, include_deleted=True)
+
+    query, *args = mock_db_pool.fetch.call_args[0]
+    assert "WHERE" not in query
+    assert args == [10, 0]
+
+
+@pytest.mark.asyncio
+@pytest.mark.parametrize(
+    "sort, expected",
+    [
+        ("supplier_id", "ORDER BY supplier_id ASC LIMIT"),
+        ("-supplier_name", "ORDER BY supplier_name DESC, supplier_id ASC LIMIT"),
+    ],
+)
+async def test_list_suppliers_sort(mock_db_pool, sort, expected):
+    mock_db_pool.fetchval.return_value = 0
+
+    await PgStore(mock_db_pool).list_suppliers(10, 0, sort=sort)
+
+    assert expected in mock_db_pool.fetch.call_args[0][0]
+
+
+@pytest.mark.asyncio
+async def test_list_suppliers_rejects_unknown_sort(mock_db_pool):
+    with pytest.raises(ValueError):
+        await PgStore(mock_db_pool).list_suppliers(10, 0, sort="description")
+
+    mock_db_pool.fetch.assert_not_called()
+
+
+@pytest.mark.asyncio
+async def test_lookups_treat_malformed_ids_as_missing(mock_db_pool):
+    mock_db_pool.fetchrow.side_effect = asyncpg.DataError("invalid UUID")
+    mock_db_pool.fetchval.side_effect = asyncpg.DataError("invalid UUID")
+    store = PgStore(mock_db_pool)
+
+    assert await store.get_supplier("nope") is None
+    assert await store.get_product("nope") is None
+    assert await store.delete_supplier("nope") is False
+
+
+@pytest.mark.asyncio
+async def test_get_supplier_hides_deleted_unless_asked(mock_db_pool):
+    mock_db_pool.fetchrow.return_value = MockRecord(supplier_id="s-1")
+    store = PgStore(mock_db_pool)
+
+    assert await store.get_supplier("s-1") == {"supplier_id": "s-1"}
+    assert "deleted_at IS NULL" in mock_db_pool.fetchrow.call_args[0][0]
+
+    await store.get_supplier("s-1", include_deleted=True)
+    assert "deleted_at" not in mock_db_pool.fetchrow.call_args[0][0]
+
+
+@pytest.mark.asyncio
+async def test_reads_retry_after_failover(mock_db_pool):
+    mock_db_pool.fetchrow.side_effect = [
+        asyncpg.AdminShutdownError("terminating connection due to administrator"),
+        MockRecord(product_id="p-1"),
+    ]
+
+    with patch("dbretry.asyncio.sleep", new_callable=AsyncMock):
+        product = await PgStore(mock_db_pool).get_product("p-1")
+
+    assert product == {"product_id": "p-1"}
+    assert mock_db_pool.fetchrow.await_count == 2
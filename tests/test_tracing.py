@@ -0,0 +1,10 @@
+from unittest.mock import MagicMock
+
+from tracing import configure_tracing
+
+
+def test_tracing_disabled_without_endpoint():
+    app = MagicMock()
+
+    assert configure_tracing(app, None, "negotiation-api") is None
+    app.add_middleware.assert_not_called()
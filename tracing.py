@@ -0,0 +1,35 @@
+from typing import Any
+import logging
+
+from opentelemetry import trace
+
+logger = logging.getLogger("negotiation.tracing")
+
+
+def configure_tracing(app: Any, endpoint: str | None, service_name: str) -> Any:
+    """
+    Export traces for HTTP requests and asyncpg queries over OTLP/HTTP.
+    Without an endpoint nothing is installed, and spans created through the
+    OpenTelemetry API (such as the Bedrock call span) are no-ops.
+    Returns the tracer provider so it can be flushed on shutdown, or None.
+    """
+    if not endpoint:
+        logger.info("OTLP endpoint not set - tracing disabled")
+        return None
+
+    # Imported lazily so the SDK and instrumentations load only when used
+    from opentelemetry.exporter.otlp.proto.http.trace_exporter import OTLPSpanExporter
+    from opentelemetry.instrumentation.asyncpg import AsyncPGInstrumentor
+    from opentelemetry.instrumentation.fastapi import FastAPIInstrumentor
+    from opentelemetry.sdk.resources import Resource
+    from opentelemetry.sdk.trace import TracerProvider
+    from opentelemetry.sdk.trace.export import BatchSpanProcessor
+
+    provider = TracerProvider(resource=Resource.create({"service.name": service_name}))
+    exporter = OTLPSpanExporter(endpoint=f"{endpoint.rstrip('/')}/v1/traces")
+    provider.add_span_processor(BatchSpanProcessor(exporter))
+    trace.set_tracer_provider(provider)
+    FastAPIInstrumentor.instrument_app(app, tracer_provider=provider)
+    AsyncPGInstrumentor().instrument(tracer_provider=provider)
+    logger.info(f"Exporting traces to {endpoint}")
+    return provider